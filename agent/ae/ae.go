@@ -2,11 +2,14 @@
 package ae
 
 import (
+	"context"
 	"fmt"
 	"math"
+	"sort"
 	"sync"
 	"time"
 
+	"github.com/armon/go-metrics"
 	"github.com/hashicorp/go-hclog"
 
 	"github.com/hashicorp/consul/lib"
@@ -26,6 +29,21 @@ import (
 // CoordinateUpdatePeriod and CoordinateUpdateMaxBatchSize.
 const scaleThreshold = 128
 
+// ScaleFn returns a factor by which the next sync run should be delayed
+// for the given cluster size.
+type ScaleFn func(nodes int) int
+
+// LogScale returns a ScaleFn which doubles the delay between sync runs
+// every time the cluster doubles in size beyond the given threshold.
+func LogScale(threshold int) ScaleFn {
+	return func(nodes int) int {
+		if nodes <= threshold {
+			return 1.0
+		}
+		return int(math.Ceil(math.Log2(float64(nodes))-math.Log2(float64(threshold))) + 1.0)
+	}
+}
+
 // scaleFactor returns a factor by which the next sync run should be delayed to
 // avoid saturation of the cluster. The larger the cluster grows the farther
 // the sync runs should be spread apart.
@@ -33,10 +51,7 @@ const scaleThreshold = 128
 // The current implementation uses a log2 scale which doubles the delay between
 // runs every time the cluster doubles in size.
 func scaleFactor(nodes int) int {
-	if nodes <= scaleThreshold {
-		return 1.0
-	}
-	return int(math.Ceil(math.Log2(float64(nodes))-math.Log2(float64(scaleThreshold))) + 1.0)
+	return LogScale(scaleThreshold)(nodes)
 }
 
 type SyncState interface {
@@ -44,6 +59,42 @@ type SyncState interface {
 	SyncFull() error
 }
 
+// DrySyncState is an optional interface for SyncState implementations that
+// can report what a sync would have done without mutating remote state. It
+// is consulted when the StateSyncer runs in dry-run mode.
+type DrySyncState interface {
+	DrySyncChanges() error
+	DrySyncFull() error
+}
+
+// ContextSyncState is an optional interface for SyncState implementations
+// whose syncs can be cancelled. When implemented, the StateSyncer passes
+// a context that is cancelled on shutdown so a sync blocked on a slow RPC
+// aborts promptly instead of holding up the shutdown.
+type ContextSyncState interface {
+	SyncChangesContext(context.Context) error
+	SyncFullContext(context.Context) error
+}
+
+// SyncStateReporter is an optional interface for SyncState implementations
+// that can report how many resources their last full sync pushed. When
+// implemented, the StateSyncer records the counts after every successful
+// full sync and exposes them through LastSyncedCounts for audit and
+// debugging.
+type SyncStateReporter interface {
+	// SyncedCounts returns the number of services, checks and nodes the
+	// last full sync pushed.
+	SyncedCounts() (services, checks, nodes int)
+}
+
+// SyncedCounts holds the resource counts reported by a SyncStateReporter
+// after a full sync.
+type SyncedCounts struct {
+	Services int
+	Checks   int
+	Nodes    int
+}
+
 // StateSyncer manages background synchronization of the given state.
 //
 // The state is synchronized on a regular basis or on demand when either
@@ -69,6 +120,29 @@ type StateSyncer struct {
 	// This needs to be set before Run() is called.
 	ClusterSize func() int
 
+	// Delayer computes the cluster size dependent jitter applied to
+	// scheduled sync runs. Set MaxJitter on it before Run() is called to
+	// cap how far a sync can be pushed out in large clusters.
+	Delayer *Delayer
+
+	// TolerateUnbalancedResume downgrades the panic on an over-resume to a
+	// logged error and clamps the pause counter at zero, so one buggy
+	// caller cannot take down a production agent. The default keeps the
+	// panic so tests surface unbalanced callers loudly.
+	TolerateUnbalancedResume bool
+
+	// DryRun exercises the full scheduling behavior of the syncer without
+	// mutating remote state. If State implements DrySyncState its dry-run
+	// variants are called in place of the real syncs; otherwise the syncs
+	// are logged and skipped. This needs to be set before Run() is called.
+	DryRun bool
+
+	// HasLocalState optionally reports whether there is local state worth
+	// synchronizing. When set, full syncs are deferred until it returns
+	// true which avoids no-op reconciliation RPCs on freshly started
+	// agents. A nil predicate means always sync.
+	HasLocalState func() bool
+
 	// SyncFull allows triggering an immediate but staggered full sync
 	// in a non-blocking way.
 	SyncFull *Trigger
@@ -77,9 +151,33 @@ type StateSyncer struct {
 	// in a non-blocking way.
 	SyncChanges *Trigger
 
+	// SyncChangesCritical allows triggering an immediate partial sync
+	// that runs even while the syncer is paused. It is meant for changes
+	// that must propagate promptly, such as de-registrations during a
+	// graceful leave.
+	SyncChangesCritical *Trigger
+
+	// Results, when non-nil, receives a SyncResult after every sync
+	// attempt. Sends are non-blocking, so a slow consumer drops results
+	// rather than stalling the sync loop.
+	Results chan<- SyncResult
+
 	// paused stores whether sync runs are temporarily disabled.
-	pauseLock sync.Mutex
-	paused    int
+	pauseLock    sync.Mutex
+	paused       int
+	pauseReasons map[string]int
+
+	// unpauseCh is closed when the pause counter drops back to zero, to
+	// wake ForceFullSync callers waiting for the pause to lift. It is
+	// created lazily by the first waiter.
+	unpauseCh chan struct{}
+
+	// shutdownOverride, when non-nil, replaces ShutdownCh everywhere the
+	// syncer waits for shutdown. RunContext installs a merged channel here
+	// so ctx cancellation is observed too; the lock makes the swap safe
+	// for waiters on other goroutines.
+	shutdownLock     sync.Mutex
+	shutdownOverride chan struct{}
 
 	// serverUpInterval is the max time after which a full sync is
 	// performed when a server has been added to the cluster.
@@ -88,6 +186,34 @@ type StateSyncer struct {
 	// retryFailInterval is the time after which a failed full sync is retried.
 	retryFailInterval time.Duration
 
+	// retryFailMaxInterval caps the exponential growth of the retry
+	// delay for consecutive full sync failures.
+	retryFailMaxInterval time.Duration
+
+	// syncChangesDebounce is the window during which additional
+	// SyncChanges triggers are absorbed into a single partial sync.
+	syncChangesDebounce time.Duration
+
+	// startupJitter is the upper bound of the random delay applied before
+	// the very first full sync. Zero starts syncing immediately.
+	startupJitter time.Duration
+
+	// breakerThreshold is the number of consecutive full sync failures
+	// after which the circuit breaker opens. Zero disables the breaker.
+	breakerThreshold int
+
+	// breakerOpenInterval replaces the retry delay while the breaker is
+	// open so a partitioned cluster is not hammered indefinitely.
+	breakerOpenInterval time.Duration
+
+	// breakerOpen records whether the circuit breaker is currently open.
+	// It is only accessed from the state machine goroutine.
+	breakerOpen bool
+
+	// failedAttempts counts consecutive full sync failures. It is only
+	// accessed from the state machine goroutine.
+	failedAttempts int
+
 	// stagger randomly picks a duration between 0s and the given duration.
 	stagger func(time.Duration) time.Duration
 
@@ -102,6 +228,22 @@ type StateSyncer struct {
 	// nextFullSyncCh is a chan that receives a time.Time when the next
 	// full sync should occur.
 	nextFullSyncCh <-chan time.Time
+
+	// lastSyncTime and lastSyncError track the outcome of the most
+	// recent sync attempt for LastSyncTime and LastSyncError. The synced
+	// counts are recorded after a successful full sync when the State
+	// implements SyncStateReporter.
+	lastSyncLock     sync.Mutex
+	lastSyncTime     time.Time
+	lastSyncError    error
+	syncedCounts     SyncedCounts
+	haveSyncedCounts bool
+
+	// triggerStatsLock guards the trigger consumption counters reported
+	// by TriggerStats.
+	triggerStatsLock    sync.Mutex
+	fullSyncsConsumed   uint64
+	syncChangesConsumed uint64
 }
 
 const (
@@ -111,31 +253,134 @@ const (
 
 	// retryFailIntv is the min time to wait before a failed sync is retried.
 	retryFailIntv = 15 * time.Second
+
+	// retryFailMaxIntv is the max time to wait before a failed sync is
+	// retried once consecutive failures have grown the delay exponentially.
+	retryFailMaxIntv = 4 * time.Minute
+
+	// breakerOpenIntv is the default retry delay while the circuit
+	// breaker is open.
+	breakerOpenIntv = 10 * time.Minute
 )
 
+// SyncerConfig holds the optional tuning knobs for a StateSyncer. The
+// zero value of each field selects the corresponding default.
+type SyncerConfig struct {
+	// ServerUpInterval is the max time to wait before a full sync is
+	// triggered when a consul server has been added to the cluster.
+	// Defaults to serverUpIntv.
+	ServerUpInterval time.Duration
+
+	// RetryFailInterval is the min time to wait before a failed full
+	// sync is retried. Defaults to retryFailIntv.
+	RetryFailInterval time.Duration
+
+	// RetryFailMaxInterval caps the retry delay as consecutive full sync
+	// failures grow it exponentially. Defaults to retryFailMaxIntv.
+	RetryFailMaxInterval time.Duration
+
+	// SyncChangesDebounce delays a partial sync by the given window after
+	// the first SyncChanges trigger so that a burst of local changes is
+	// synced once instead of per change. Defaults to no debouncing.
+	SyncChangesDebounce time.Duration
+
+	// BreakerFailureThreshold is the number of consecutive full sync
+	// failures after which the retry delay switches to
+	// BreakerOpenInterval. Zero, the default, disables the breaker.
+	BreakerFailureThreshold int
+
+	// BreakerOpenInterval is the retry delay while the breaker is open.
+	// Defaults to breakerOpenIntv.
+	BreakerOpenInterval time.Duration
+
+	// StartupJitter delays the first full sync by a random duration up to
+	// the given value, spreading the load of a mass agent restart over
+	// time. Defaults to no delay.
+	StartupJitter time.Duration
+}
+
 func NewStateSyncer(state SyncState, intv time.Duration, shutdownCh chan struct{}, logger hclog.Logger) *StateSyncer {
+	s, err := NewStateSyncerWithConfig(state, intv, shutdownCh, logger, SyncerConfig{})
+	if err != nil {
+		// a zero config never fails validation
+		panic(err)
+	}
+	return s
+}
+
+// NewStateSyncerWithConfig is NewStateSyncer with additional tuning knobs.
+// It returns an error if any of the configured intervals is negative.
+func NewStateSyncerWithConfig(state SyncState, intv time.Duration, shutdownCh chan struct{}, logger hclog.Logger, cfg SyncerConfig) (*StateSyncer, error) {
 	if logger == nil {
 		logger = hclog.New(&hclog.LoggerOptions{})
 	}
 
+	if cfg.ServerUpInterval < 0 {
+		return nil, fmt.Errorf("ServerUpInterval must be positive, got %s", cfg.ServerUpInterval)
+	}
+	if cfg.RetryFailInterval < 0 {
+		return nil, fmt.Errorf("RetryFailInterval must be positive, got %s", cfg.RetryFailInterval)
+	}
+	if cfg.RetryFailMaxInterval < 0 {
+		return nil, fmt.Errorf("RetryFailMaxInterval must be positive, got %s", cfg.RetryFailMaxInterval)
+	}
+	if cfg.SyncChangesDebounce < 0 {
+		return nil, fmt.Errorf("SyncChangesDebounce must be positive, got %s", cfg.SyncChangesDebounce)
+	}
+	if cfg.BreakerFailureThreshold < 0 {
+		return nil, fmt.Errorf("BreakerFailureThreshold must be positive, got %d", cfg.BreakerFailureThreshold)
+	}
+	if cfg.BreakerOpenInterval < 0 {
+		return nil, fmt.Errorf("BreakerOpenInterval must be positive, got %s", cfg.BreakerOpenInterval)
+	}
+	if cfg.StartupJitter < 0 {
+		return nil, fmt.Errorf("StartupJitter must be positive, got %s", cfg.StartupJitter)
+	}
+	if cfg.BreakerOpenInterval == 0 {
+		cfg.BreakerOpenInterval = breakerOpenIntv
+	}
+	if cfg.ServerUpInterval == 0 {
+		cfg.ServerUpInterval = serverUpIntv
+	}
+	if cfg.RetryFailInterval == 0 {
+		cfg.RetryFailInterval = retryFailIntv
+	}
+	if cfg.RetryFailMaxInterval == 0 {
+		cfg.RetryFailMaxInterval = retryFailMaxIntv
+	}
+	if cfg.RetryFailMaxInterval < cfg.RetryFailInterval {
+		return nil, fmt.Errorf("RetryFailMaxInterval must not be less than RetryFailInterval, got %s < %s",
+			cfg.RetryFailMaxInterval, cfg.RetryFailInterval)
+	}
+
 	s := &StateSyncer{
-		State:             state,
-		Interval:          intv,
-		ShutdownCh:        shutdownCh,
-		Logger:            logger.Named(logging.AntiEntropy),
-		SyncFull:          NewTrigger(),
-		SyncChanges:       NewTrigger(),
-		serverUpInterval:  serverUpIntv,
-		retryFailInterval: retryFailIntv,
+		State:                state,
+		Interval:             intv,
+		ShutdownCh:           shutdownCh,
+		Logger:               logger.Named(logging.AntiEntropy),
+		SyncFull:             NewTrigger(),
+		SyncChanges:          NewTrigger(),
+		SyncChangesCritical:  NewTrigger(),
+		serverUpInterval:     cfg.ServerUpInterval,
+		retryFailInterval:    cfg.RetryFailInterval,
+		retryFailMaxInterval: cfg.RetryFailMaxInterval,
+		syncChangesDebounce:  cfg.SyncChangesDebounce,
+		startupJitter:        cfg.StartupJitter,
+		breakerThreshold:     cfg.BreakerFailureThreshold,
+		breakerOpenInterval:  cfg.BreakerOpenInterval,
 	}
 
+	// ClusterSize is resolved through a closure since it is only set
+	// after construction and before Run() is called.
+	s.Delayer = NewClusterSizeDelayer(func() int { return s.ClusterSize() })
+
 	// retain these methods as member variables so that
 	// we can mock them for testing.
 	s.retrySyncFullEvent = s.retrySyncFullEventFn
 	s.syncChangesEvent = s.syncChangesEventFn
 	s.stagger = s.staggerFn
 
-	return s
+	return s, nil
 }
 
 // fsmState defines states for the state machine.
@@ -154,10 +399,64 @@ func (s *StateSyncer) Run() {
 	if s.ClusterSize == nil {
 		panic("ClusterSize not set")
 	}
+	if s.startupJitter > 0 {
+		// Spread mass restarts out so every agent's first full sync does
+		// not hit the servers at the same moment.
+		select {
+		case <-time.After(s.stagger(s.startupJitter)):
+		case <-s.shutdownCh():
+			return
+		}
+	}
 	s.resetNextFullSyncCh()
 	s.runFSM(fullSyncState, s.nextFSMState)
 }
 
+// RunContext is like Run but additionally stops when ctx is cancelled and
+// then returns ctx.Err(). Cancellation is observed everywhere the
+// shutdown channel is consulted, so an in-between wait does not delay the
+// return.
+func (s *StateSyncer) RunContext(ctx context.Context) error {
+	// Merge ctx cancellation with the shutdown channel so that either one
+	// stops the state machine. The merged channel is installed as an
+	// override rather than written to the exported field, so concurrent
+	// readers such as ForceFullSync pick it up safely.
+	merged := make(chan struct{})
+	stop := make(chan struct{})
+	go func() {
+		defer close(merged)
+		select {
+		case <-ctx.Done():
+		case <-s.ShutdownCh:
+		case <-stop:
+		}
+	}()
+	s.shutdownLock.Lock()
+	s.shutdownOverride = merged
+	s.shutdownLock.Unlock()
+	defer func() {
+		s.shutdownLock.Lock()
+		s.shutdownOverride = nil
+		s.shutdownLock.Unlock()
+		close(stop)
+	}()
+
+	s.Run()
+	return ctx.Err()
+}
+
+// shutdownCh returns the channel that terminates the syncer when closed:
+// the exported ShutdownCh, or the merged override while RunContext is
+// running. Safe to call from any goroutine.
+func (s *StateSyncer) shutdownCh() chan struct{} {
+	s.shutdownLock.Lock()
+	defer s.shutdownLock.Unlock()
+	if s.shutdownOverride != nil {
+		return s.shutdownOverride
+	}
+	return s.ShutdownCh
+}
+
 // runFSM runs the state machine.
 func (s *StateSyncer) runFSM(fs fsmState, next func(fsmState) fsmState) {
 	for {
@@ -175,11 +474,31 @@ func (s *StateSyncer) nextFSMState(fs fsmState) fsmState {
 			return retryFullSyncState
 		}
 
-		if err := s.State.SyncFull(); err != nil {
+		if s.HasLocalState != nil && !s.HasLocalState() {
+			s.Logger.Debug("deferring full sync until there is local state to sync")
+			return retryFullSyncState
+		}
+
+		if err := s.syncFull(); err != nil {
+			s.failedAttempts++
+			metrics.SetGauge([]string{"ae", "sync", "failed_attempts"}, float32(s.failedAttempts))
 			s.Logger.Error("failed to sync remote state", "error", err)
+			if s.breakerThreshold > 0 && s.failedAttempts >= s.breakerThreshold && !s.breakerOpen {
+				s.breakerOpen = true
+				s.Logger.Warn("circuit breaker open after consecutive full sync failures",
+					"failures", s.failedAttempts,
+					"retry_interval", s.breakerOpenInterval,
+				)
+			}
 			return retryFullSyncState
 		}
 
+		s.failedAttempts = 0
+		metrics.SetGauge([]string{"ae", "sync", "failed_attempts"}, 0)
+		if s.breakerOpen {
+			s.breakerOpen = false
+			s.Logger.Info("circuit breaker closed after successful full sync")
+		}
 		return partialSyncState
 
 	case retryFullSyncState:
@@ -199,12 +518,22 @@ func (s *StateSyncer) nextFSMState(fs fsmState) fsmState {
 		case syncFullNotifEvent, syncFullTimerEvent:
 			return fullSyncState
 
-		case syncChangesNotifEvent:
-			if s.Paused() {
+		case syncChangesNotifEvent, syncChangesCriticalNotifEvent:
+			// critical changes such as de-registrations during a graceful
+			// leave must propagate even while the syncer is paused.
+			if s.Paused() && e != syncChangesCriticalNotifEvent {
 				return partialSyncState
 			}
 
-			err := s.State.SyncChanges()
+			// a pending full sync supersedes a routine partial sync, but
+			// it may itself be held up by a pause, so critical changes are
+			// synced regardless.
+			if e != syncChangesCriticalNotifEvent && s.fullSyncPending() {
+				s.Logger.Debug("skipping partial sync since a full sync is pending")
+				return partialSyncState
+			}
+
+			err := s.syncChanges()
 			if err != nil {
 				s.Logger.Error("failed to sync changes", "error", err)
 			}
@@ -222,15 +551,108 @@ func (s *StateSyncer) nextFSMState(fs fsmState) fsmState {
 	}
 }
 
+// recordSyncMetrics emits the duration and outcome of a sync attempt so
+// operators can alert on anti-entropy health.
+func recordSyncMetrics(kind string, start time.Time, err error) {
+	labels := []metrics.Label{{Name: "kind", Value: kind}}
+	metrics.MeasureSinceWithLabels([]string{"ae", "sync"}, start, labels)
+	if err != nil {
+		metrics.IncrCounterWithLabels([]string{"ae", "sync", "failure"}, 1, labels)
+		return
+	}
+	metrics.IncrCounterWithLabels([]string{"ae", "sync", "success"}, 1, labels)
+}
+
+// SyncResult describes the outcome of a single sync attempt.
+type SyncResult struct {
+	// Kind is "full" or "partial".
+	Kind string
+
+	// Start is when the attempt began.
+	Start time.Time
+
+	// Duration is how long the attempt took.
+	Duration time.Duration
+
+	// Err is the error the attempt returned, or nil on success.
+	Err error
+}
+
+// reportSyncResult delivers the outcome of a sync attempt to the Results
+// channel, if one is configured.
+func (s *StateSyncer) reportSyncResult(kind string, start time.Time, err error) {
+	if s.Results == nil {
+		return
+	}
+	select {
+	case s.Results <- SyncResult{Kind: kind, Start: start, Duration: time.Since(start), Err: err}:
+	default:
+	}
+}
+
+// syncFull performs a full sync or, in dry-run mode, the no-side-effect
+// variant of it.
+func (s *StateSyncer) syncFull() (err error) {
+	start := time.Now()
+	defer func() {
+		recordSyncMetrics("full", start, err)
+		s.recordSyncResult(err)
+		s.reportSyncResult("full", start, err)
+		if err == nil {
+			s.recordSyncedCounts()
+		}
+	}()
+	if !s.DryRun {
+		if cs, ok := s.State.(ContextSyncState); ok {
+			ctx, cancel := s.shutdownContext()
+			defer cancel()
+			return cs.SyncFullContext(ctx)
+		}
+		return s.State.SyncFull()
+	}
+	if dry, ok := s.State.(DrySyncState); ok {
+		s.Logger.Info("dry-run: performing full sync without mutating remote state")
+		return dry.DrySyncFull()
+	}
+	s.Logger.Warn("dry-run: skipping full sync since the state does not support dry-run")
+	return nil
+}
+
+// syncChanges performs a partial sync or, in dry-run mode, the
+// no-side-effect variant of it.
+func (s *StateSyncer) syncChanges() (err error) {
+	start := time.Now()
+	defer func() {
+		recordSyncMetrics("partial", start, err)
+		s.recordSyncResult(err)
+		s.reportSyncResult("partial", start, err)
+	}()
+	if !s.DryRun {
+		if cs, ok := s.State.(ContextSyncState); ok {
+			ctx, cancel := s.shutdownContext()
+			defer cancel()
+			return cs.SyncChangesContext(ctx)
+		}
+		return s.State.SyncChanges()
+	}
+	if dry, ok := s.State.(DrySyncState); ok {
+		s.Logger.Info("dry-run: performing partial sync without mutating remote state")
+		return dry.DrySyncChanges()
+	}
+	s.Logger.Warn("dry-run: skipping partial sync since the state does not support dry-run")
+	return nil
+}
+
 // event defines a timing or notification event from multiple timers and
 // channels.
 type event string
 
 const (
-	shutdownEvent         event = "shutdown"
-	syncFullNotifEvent    event = "syncFullNotif"
-	syncFullTimerEvent    event = "syncFullTimer"
-	syncChangesNotifEvent event = "syncChangesNotif"
+	shutdownEvent                 event = "shutdown"
+	syncFullNotifEvent            event = "syncFullNotif"
+	syncFullTimerEvent            event = "syncFullTimer"
+	syncChangesNotifEvent         event = "syncChangesNotif"
+	syncChangesCriticalNotifEvent event = "syncChangesCriticalNotif"
 )
 
 // retrySyncFullEventFn waits for an event which triggers a retry
@@ -238,25 +660,37 @@ const (
 // called directly but through s.retryFullSyncState to allow mocking for
 // testing.
 func (s *StateSyncer) retrySyncFullEventFn() event {
+	// retry full sync after some time. The delay grows with consecutive
+	// failures so a server that is down for a while is not hammered at a
+	// constant rate.
+	delay := s.retryDelay()
+	retryTimer := time.After(delay + s.stagger(delay))
+
 	select {
 	// trigger a full sync immediately.
 	// this is usually called when a consul server was added to the cluster.
 	// stagger the delay to avoid a thundering herd.
 	case <-s.SyncFull.Notif():
+		s.countFullSyncTrigger()
 		select {
 		case <-time.After(s.stagger(s.serverUpInterval)):
 			return syncFullNotifEvent
-		case <-s.ShutdownCh:
+
+		// do not let the server-up stagger postpone a retry that was
+		// already scheduled before the server joined.
+		case <-retryTimer:
+			s.resetNextFullSyncCh()
+			return syncFullTimerEvent
+
+		case <-s.shutdownCh():
 			return shutdownEvent
 		}
 
-	// retry full sync after some time
-	// it is using retryFailInterval because it is retrying the sync
-	case <-time.After(s.retryFailInterval + s.stagger(s.retryFailInterval)):
+	case <-retryTimer:
 		s.resetNextFullSyncCh()
 		return syncFullTimerEvent
 
-	case <-s.ShutdownCh:
+	case <-s.shutdownCh():
 		return shutdownEvent
 	}
 }
@@ -271,11 +705,12 @@ func (s *StateSyncer) syncChangesEventFn() event {
 	// this is usually called when a consul server was added to the cluster.
 	// stagger the delay to avoid a thundering herd.
 	case <-s.SyncFull.Notif():
+		s.countFullSyncTrigger()
 		select {
 		case <-time.After(s.stagger(s.serverUpInterval)):
 			s.resetNextFullSyncCh()
 			return syncFullNotifEvent
-		case <-s.ShutdownCh:
+		case <-s.shutdownCh():
 			return shutdownEvent
 		}
 
@@ -286,13 +721,229 @@ func (s *StateSyncer) syncChangesEventFn() event {
 
 	// do partial syncs on demand
 	case <-s.SyncChanges.Notif():
+		s.countSyncChangesTrigger()
+		if s.syncChangesDebounce > 0 {
+			// absorb the burst: further triggers within the window
+			// collapse into the single sync that runs once the window
+			// elapses. The window is fixed from the first trigger so a
+			// continuous stream of changes cannot postpone the sync
+			// forever.
+			debounce := time.After(s.syncChangesDebounce)
+			for {
+				select {
+				case <-s.SyncChanges.Notif():
+					s.countSyncChangesTrigger()
+				case <-debounce:
+					return syncChangesNotifEvent
+				case <-s.shutdownCh():
+					return shutdownEvent
+				}
+			}
+		}
 		return syncChangesNotifEvent
 
-	case <-s.ShutdownCh:
+	// critical changes are neither debounced nor suppressed by a pause
+	case <-s.SyncChangesCritical.Notif():
+		s.countSyncChangesTrigger()
+		return syncChangesCriticalNotifEvent
+
+	case <-s.shutdownCh():
 		return shutdownEvent
 	}
 }
 
+// ForceFullSync runs a full sync immediately and reports its outcome,
+// unlike SyncFull.Trigger which only schedules a staggered one. It waits
+// for any outstanding Pause to be lifted before syncing and returns the
+// context error if cancelled while waiting or syncing. The sync runs on
+// the caller's goroutine so it cannot deadlock with the background Run
+// loop; the State implementation must tolerate a concurrent background
+// sync.
+func (s *StateSyncer) ForceFullSync(ctx context.Context) error {
+	for {
+		s.pauseLock.Lock()
+		if s.paused == 0 {
+			s.pauseLock.Unlock()
+			break
+		}
+		if s.unpauseCh == nil {
+			s.unpauseCh = make(chan struct{})
+		}
+		unpaused := s.unpauseCh
+		s.pauseLock.Unlock()
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-s.shutdownCh():
+			return fmt.Errorf("syncer is shutting down")
+		case <-unpaused:
+		}
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	done := make(chan error, 1)
+	go func() { done <- s.syncFull() }()
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// fullSyncPending reports whether a full sync is already queued or the
+// full sync timer has expired. A partial sync in that window is a wasted
+// RPC since the imminent full sync supersedes it. Peeking consumes the
+// signal, so the SyncFull trigger is re-armed to make sure the full sync
+// still happens promptly.
+func (s *StateSyncer) fullSyncPending() bool {
+	select {
+	case <-s.SyncFull.Notif():
+		s.SyncFull.Trigger()
+		return true
+	default:
+	}
+	select {
+	case <-s.nextFullSyncCh:
+		s.SyncFull.Trigger()
+		return true
+	default:
+	}
+	return false
+}
+
+// shutdownContext returns a context that is cancelled when the syncer
+// shuts down. The returned cancel func must be called to release the
+// watcher goroutine once the sync is finished.
+func (s *StateSyncer) shutdownContext() (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		select {
+		case <-s.shutdownCh():
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	return ctx, cancel
+}
+
+// recordSyncResult stores the outcome of a sync attempt.
+func (s *StateSyncer) recordSyncResult(err error) {
+	s.lastSyncLock.Lock()
+	if err == nil {
+		s.lastSyncTime = time.Now()
+	}
+	s.lastSyncError = err
+	s.lastSyncLock.Unlock()
+}
+
+// LastSyncTime returns the time of the last successful sync. The zero
+// value means no sync has succeeded yet.
+func (s *StateSyncer) LastSyncTime() time.Time {
+	s.lastSyncLock.Lock()
+	defer s.lastSyncLock.Unlock()
+	return s.lastSyncTime
+}
+
+// recordSyncedCounts stores the resource counts of a successful full sync
+// when the State can report them.
+func (s *StateSyncer) recordSyncedCounts() {
+	r, ok := s.State.(SyncStateReporter)
+	if !ok {
+		return
+	}
+	services, checks, nodes := r.SyncedCounts()
+	s.lastSyncLock.Lock()
+	s.syncedCounts = SyncedCounts{Services: services, Checks: checks, Nodes: nodes}
+	s.haveSyncedCounts = true
+	s.lastSyncLock.Unlock()
+}
+
+// LastSyncedCounts returns the resource counts of the most recent
+// successful full sync. The bool is false until a full sync has succeeded
+// with a State that implements SyncStateReporter.
+func (s *StateSyncer) LastSyncedCounts() (SyncedCounts, bool) {
+	s.lastSyncLock.Lock()
+	defer s.lastSyncLock.Unlock()
+	return s.syncedCounts, s.haveSyncedCounts
+}
+
+// LastSyncError returns the error of the most recent sync attempt, or nil
+// if it succeeded.
+func (s *StateSyncer) LastSyncError() error {
+	s.lastSyncLock.Lock()
+	defer s.lastSyncLock.Unlock()
+	return s.lastSyncError
+}
+
+// TriggerStats is a point-in-time view of the sync triggers, suitable
+// for publishing through an agent metrics hook.
+type TriggerStats struct {
+	// FullSyncsConsumed is the number of SyncFull triggers the state
+	// machine has consumed so far.
+	FullSyncsConsumed uint64
+
+	// SyncChangesConsumed is the number of SyncChanges triggers the
+	// state machine has consumed so far.
+	SyncChangesConsumed uint64
+
+	// FullSyncPending indicates that a SyncFull trigger has fired but
+	// has not been consumed yet.
+	FullSyncPending bool
+
+	// SyncChangesPending indicates that a SyncChanges trigger has fired
+	// but has not been consumed yet.
+	SyncChangesPending bool
+}
+
+// TriggerStats returns the current trigger consumption counters and
+// whether a trigger is pending.
+func (s *StateSyncer) TriggerStats() TriggerStats {
+	s.triggerStatsLock.Lock()
+	defer s.triggerStatsLock.Unlock()
+	return TriggerStats{
+		FullSyncsConsumed:   s.fullSyncsConsumed,
+		SyncChangesConsumed: s.syncChangesConsumed,
+		FullSyncPending:     s.SyncFull.Pending(),
+		SyncChangesPending:  s.SyncChanges.Pending(),
+	}
+}
+
+// countFullSyncTrigger records that a SyncFull trigger was consumed.
+func (s *StateSyncer) countFullSyncTrigger() {
+	s.triggerStatsLock.Lock()
+	s.fullSyncsConsumed++
+	s.triggerStatsLock.Unlock()
+}
+
+// countSyncChangesTrigger records that a SyncChanges trigger was consumed.
+func (s *StateSyncer) countSyncChangesTrigger() {
+	s.triggerStatsLock.Lock()
+	s.syncChangesConsumed++
+	s.triggerStatsLock.Unlock()
+}
+
+// retryDelay returns the base delay before a failed full sync is retried.
+// It doubles with every consecutive failure after the first, capped at
+// retryFailMaxInterval, and drops back to retryFailInterval once a sync
+// succeeds.
+func (s *StateSyncer) retryDelay() time.Duration {
+	if s.breakerOpen {
+		return s.breakerOpenInterval
+	}
+	delay := s.retryFailInterval
+	for i := 1; i < s.failedAttempts; i++ {
+		delay *= 2
+		if delay >= s.retryFailMaxInterval {
+			return s.retryFailMaxInterval
+		}
+	}
+	return delay
+}
+
 // resetNextFullSyncCh resets nextFullSyncCh and sets it to interval+stagger.
 // Call this function everytime a full sync is performed.
 func (s *StateSyncer) resetNextFullSyncCh() {
@@ -311,17 +962,50 @@ var libRandomStagger = lib.RandomStagger
 // cluster wide events. This function should not be called directly
 // but through s.stagger to allow mocking for testing.
 func (s *StateSyncer) staggerFn(d time.Duration) time.Duration {
-	f := scaleFactor(s.ClusterSize())
-	return libRandomStagger(time.Duration(f) * d)
+	return s.Delayer.Jitter(d)
 }
 
 // Pause temporarily disables sync runs.
 func (s *StateSyncer) Pause() {
+	s.PauseReason("")
+}
+
+// PauseReason temporarily disables sync runs like Pause and additionally
+// records the given reason so that operators can tell which subsystems hold
+// the syncer paused. An empty reason is counted but not recorded.
+func (s *StateSyncer) PauseReason(reason string) {
 	s.pauseLock.Lock()
 	s.paused++
+	if reason != "" {
+		if s.pauseReasons == nil {
+			s.pauseReasons = make(map[string]int)
+		}
+		s.pauseReasons[reason]++
+	}
 	s.pauseLock.Unlock()
 }
 
+// PauseFor pauses sync runs like Pause and schedules an automatic Resume
+// after the given duration, so a caller that crashes before resuming
+// cannot stall anti-entropy indefinitely. The returned func resumes
+// early; it and the timer share a single Resume so whichever fires
+// second is a no-op. Like Resume it reports whether the syncer actually
+// resumed.
+func (s *StateSyncer) PauseFor(d time.Duration) (resume func() bool) {
+	s.Pause()
+	var once sync.Once
+	doResume := func() bool {
+		resumed := false
+		once.Do(func() { resumed = s.Resume() })
+		return resumed
+	}
+	timer := time.AfterFunc(d, func() { doResume() })
+	return func() bool {
+		timer.Stop()
+		return doResume()
+	}
+}
+
 // Paused returns whether sync runs are temporarily disabled.
 func (s *StateSyncer) Paused() bool {
 	s.pauseLock.Lock()
@@ -329,15 +1013,57 @@ func (s *StateSyncer) Paused() bool {
 	return s.paused != 0
 }
 
+// PauseReasons returns the sorted set of reasons for which the syncer is
+// currently paused. Pauses without a reason are not included.
+func (s *StateSyncer) PauseReasons() []string {
+	s.pauseLock.Lock()
+	defer s.pauseLock.Unlock()
+	reasons := make([]string, 0, len(s.pauseReasons))
+	for reason := range s.pauseReasons {
+		reasons = append(reasons, reason)
+	}
+	sort.Strings(reasons)
+	return reasons
+}
+
 // Resume re-enables sync runs. It returns true if it was the last pause/resume
 // pair on the stack and so actually caused the state syncer to resume.
 func (s *StateSyncer) Resume() bool {
+	return s.ResumeReason("")
+}
+
+// ResumeReason re-enables sync runs like Resume and additionally clears the
+// given reason recorded by a matching PauseReason call.
+func (s *StateSyncer) ResumeReason(reason string) bool {
 	s.pauseLock.Lock()
 	s.paused--
 	if s.paused < 0 {
-		panic("unbalanced pause/resume")
+		if !s.TolerateUnbalancedResume {
+			s.pauseLock.Unlock()
+			panic("unbalanced pause/resume")
+		}
+		s.Logger.Error("unbalanced pause/resume, clamping pause counter to zero")
+		s.paused = 0
+	}
+	if reason != "" {
+		if s.pauseReasons[reason] == 0 {
+			if !s.TolerateUnbalancedResume {
+				s.pauseLock.Unlock()
+				panic("unbalanced pause/resume for reason: " + reason)
+			}
+			s.Logger.Error("unbalanced pause/resume for reason", "reason", reason)
+		} else {
+			s.pauseReasons[reason]--
+			if s.pauseReasons[reason] == 0 {
+				delete(s.pauseReasons, reason)
+			}
+		}
 	}
 	trigger := s.paused == 0
+	if trigger && s.unpauseCh != nil {
+		close(s.unpauseCh)
+		s.unpauseCh = nil
+	}
 	s.pauseLock.Unlock()
 	if trigger {
 		s.SyncChanges.Trigger()
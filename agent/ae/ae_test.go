@@ -1,13 +1,18 @@
 package ae
 
 import (
+	"bytes"
+	"context"
 	"errors"
 	"fmt"
 	"reflect"
+	"strings"
 	"sync"
 	"testing"
 	"time"
 
+	"github.com/armon/go-metrics"
+
 	"github.com/hashicorp/consul/lib"
 	"github.com/hashicorp/consul/sdk/testutil"
 	"github.com/hashicorp/go-hclog"
@@ -68,6 +73,49 @@ func TestAE_Pause_nestedPauseResume(t *testing.T) {
 	l.Resume()
 }
 
+func TestAE_Pause_nestedPauseReasons(t *testing.T) {
+	t.Parallel()
+	l := NewStateSyncer(nil, 0, nil, nil)
+	if got := l.PauseReasons(); len(got) != 0 {
+		t.Fatalf("got reasons %v want none", got)
+	}
+	l.PauseReason("acl")
+	l.PauseReason("acl")
+	l.PauseReason("config-reload")
+	l.Pause()
+	if got, want := l.PauseReasons(), []string{"acl", "config-reload"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("got reasons %v want %v", got, want)
+	}
+	l.ResumeReason("acl")
+	if got, want := l.PauseReasons(), []string{"acl", "config-reload"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("got reasons %v want %v", got, want)
+	}
+	l.ResumeReason("config-reload")
+	if got, want := l.PauseReasons(), []string{"acl"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("got reasons %v want %v", got, want)
+	}
+	l.ResumeReason("acl")
+	if got := l.PauseReasons(); len(got) != 0 {
+		t.Fatalf("got reasons %v want none", got)
+	}
+	if l.Paused() != true {
+		t.Fatal("syncer should STILL be Paused with the unlabeled pause outstanding")
+	}
+	l.Resume()
+	if l.Paused() != false {
+		t.Fatal("syncer should NOT be Paused after all resumes")
+	}
+
+	defer func() {
+		err := recover()
+		if err == nil {
+			t.Fatal("ResumeReason() without matching PauseReason() should panic")
+		}
+	}()
+	l.PauseReason("acl")
+	l.ResumeReason("other")
+}
+
 func TestAE_Pause_ResumeTriggersSyncChanges(t *testing.T) {
 	l := NewStateSyncer(nil, 0, nil, nil)
 	l.Pause()
@@ -157,6 +205,28 @@ func TestAE_FSM(t *testing.T) {
 				t.Fatalf("got state %v want %v", got, want)
 			}
 		})
+		t.Run("HasLocalState false -> retryFullSyncState", func(t *testing.T) {
+			l := testSyncer(t)
+			l.State = &mock{}
+			l.HasLocalState = func() bool { return false }
+			fs := l.nextFSMState(fullSyncState)
+			if got, want := fs, retryFullSyncState; got != want {
+				t.Fatalf("got state %v want %v", got, want)
+			}
+			if got := l.State.(*mock).seq; len(got) != 0 {
+				t.Fatalf("got call sequence %v want none", got)
+			}
+
+			// once local state appears the full sync runs
+			l.HasLocalState = func() bool { return true }
+			fs = l.nextFSMState(fullSyncState)
+			if got, want := fs, partialSyncState; got != want {
+				t.Fatalf("got state %v want %v", got, want)
+			}
+			if got, want := l.State.(*mock).seq, []string{"full"}; !reflect.DeepEqual(got, want) {
+				t.Fatalf("got call sequence %v want %v", got, want)
+			}
+		})
 		t.Run("SyncFull() error -> retryFullSyncState", func(t *testing.T) {
 			l := testSyncer(t)
 			l.State = &mock{syncFull: func() error { return errors.New("boom") }}
@@ -319,6 +389,28 @@ func TestAE_RetrySyncFullEvent(t *testing.T) {
 			t.Fatalf("got event %q want %q", got, want)
 		}
 	})
+	t.Run("server-up stagger does not postpone pending retry", func(t *testing.T) {
+		l := testSyncer(t)
+		l.retryFailInterval = 50 * time.Millisecond
+		// a pathological server-up stagger longer than the scheduled retry
+		l.stagger = func(d time.Duration) time.Duration {
+			if d == l.serverUpInterval {
+				return time.Minute
+			}
+			return 0
+		}
+		evch := make(chan event)
+		go func() { evch <- l.retrySyncFullEvent() }()
+		l.SyncFull.Trigger()
+		select {
+		case got := <-evch:
+			if want := syncFullTimerEvent; got != want {
+				t.Fatalf("got event %q want %q", got, want)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("retry was postponed behind the server-up stagger")
+		}
+	})
 }
 
 func TestAE_SyncChangesEvent(t *testing.T) {
@@ -411,3 +503,906 @@ func testSyncer(t *testing.T) *StateSyncer {
 	l.resetNextFullSyncCh()
 	return l
 }
+
+func TestAE_DryRun(t *testing.T) {
+	t.Run("dry-run full sync uses DrySyncFull", func(t *testing.T) {
+		l := testSyncer(t)
+		m := &dryMock{}
+		l.State = m
+		l.DryRun = true
+		fs := l.nextFSMState(fullSyncState)
+		if got, want := fs, partialSyncState; got != want {
+			t.Fatalf("got state %v want %v", got, want)
+		}
+		if got, want := m.seq, []string{"dry-full"}; !reflect.DeepEqual(got, want) {
+			t.Fatalf("got call sequence %v want %v", got, want)
+		}
+	})
+	t.Run("dry-run partial sync uses DrySyncChanges", func(t *testing.T) {
+		l := testSyncer(t)
+		m := &dryMock{}
+		l.State = m
+		l.DryRun = true
+		l.syncChangesEvent = func() event { return syncChangesNotifEvent }
+		fs := l.nextFSMState(partialSyncState)
+		if got, want := fs, partialSyncState; got != want {
+			t.Fatalf("got state %v want %v", got, want)
+		}
+		if got, want := m.seq, []string{"dry-changes"}; !reflect.DeepEqual(got, want) {
+			t.Fatalf("got call sequence %v want %v", got, want)
+		}
+	})
+	t.Run("dry-run without DrySyncState skips syncs", func(t *testing.T) {
+		l := testSyncer(t)
+		m := &mock{}
+		l.State = m
+		l.DryRun = true
+		fs := l.nextFSMState(fullSyncState)
+		if got, want := fs, partialSyncState; got != want {
+			t.Fatalf("got state %v want %v", got, want)
+		}
+		if got := m.seq; len(got) != 0 {
+			t.Fatalf("got call sequence %v want none", got)
+		}
+	})
+}
+
+// dryMock records real and dry-run sync calls in sequence.
+type dryMock struct {
+	mock
+}
+
+func (m *dryMock) DrySyncFull() error {
+	m.seq = append(m.seq, "dry-full")
+	return nil
+}
+
+func (m *dryMock) DrySyncChanges() error {
+	m.seq = append(m.seq, "dry-changes")
+	return nil
+}
+
+func TestAE_Resume_Unbalanced(t *testing.T) {
+	t.Parallel()
+	t.Run("strict mode panics", func(t *testing.T) {
+		l := NewStateSyncer(nil, 0, nil, nil)
+		defer func() {
+			if err := recover(); err == nil {
+				t.Fatal("unbalanced Resume() should panic")
+			}
+		}()
+		l.Resume()
+	})
+	t.Run("lenient mode clamps to zero", func(t *testing.T) {
+		l := NewStateSyncer(nil, 0, nil, nil)
+		l.TolerateUnbalancedResume = true
+		if got := l.Resume(); !got {
+			t.Fatal("over-resume should still report the syncer as resumed")
+		}
+		if l.Paused() {
+			t.Fatal("syncer should not be Paused after clamped over-resume")
+		}
+
+		// the counter really is clamped: one Pause pauses again
+		l.Pause()
+		if !l.Paused() {
+			t.Fatal("syncer should be Paused again after Pause()")
+		}
+		l.Resume()
+	})
+	t.Run("lenient mode tolerates unknown reason", func(t *testing.T) {
+		l := NewStateSyncer(nil, 0, nil, nil)
+		l.TolerateUnbalancedResume = true
+		l.Pause()
+		l.ResumeReason("not-paused-for-this")
+		if l.Paused() {
+			t.Fatal("syncer should not be Paused")
+		}
+		if got := l.PauseReasons(); len(got) != 0 {
+			t.Fatalf("got reasons %v want none", got)
+		}
+	})
+}
+
+func TestAE_NewStateSyncerWithConfig(t *testing.T) {
+	t.Run("defaults when unset", func(t *testing.T) {
+		l, err := NewStateSyncerWithConfig(nil, 0, nil, nil, SyncerConfig{})
+		if err != nil {
+			t.Fatalf("got error %v want nil", err)
+		}
+		if got, want := l.serverUpInterval, serverUpIntv; got != want {
+			t.Fatalf("got serverUpInterval %v want %v", got, want)
+		}
+		if got, want := l.retryFailInterval, retryFailIntv; got != want {
+			t.Fatalf("got retryFailInterval %v want %v", got, want)
+		}
+	})
+
+	t.Run("custom values", func(t *testing.T) {
+		l, err := NewStateSyncerWithConfig(nil, 0, nil, nil, SyncerConfig{
+			ServerUpInterval:  5 * time.Millisecond,
+			RetryFailInterval: 10 * time.Millisecond,
+		})
+		if err != nil {
+			t.Fatalf("got error %v want nil", err)
+		}
+		if got, want := l.serverUpInterval, 5*time.Millisecond; got != want {
+			t.Fatalf("got serverUpInterval %v want %v", got, want)
+		}
+		if got, want := l.retryFailInterval, 10*time.Millisecond; got != want {
+			t.Fatalf("got retryFailInterval %v want %v", got, want)
+		}
+	})
+
+	t.Run("negative values are rejected", func(t *testing.T) {
+		if _, err := NewStateSyncerWithConfig(nil, 0, nil, nil, SyncerConfig{ServerUpInterval: -time.Second}); err == nil {
+			t.Fatal("expected error for negative ServerUpInterval")
+		}
+		if _, err := NewStateSyncerWithConfig(nil, 0, nil, nil, SyncerConfig{RetryFailInterval: -time.Second}); err == nil {
+			t.Fatal("expected error for negative RetryFailInterval")
+		}
+	})
+
+	t.Run("custom retry interval drives the retry timer", func(t *testing.T) {
+		l, err := NewStateSyncerWithConfig(nil, time.Second, nil, nil, SyncerConfig{
+			RetryFailInterval: 5 * time.Millisecond,
+		})
+		if err != nil {
+			t.Fatalf("got error %v want nil", err)
+		}
+		l.stagger = func(time.Duration) time.Duration { return 0 }
+		l.ClusterSize = func() int { return 1 }
+
+		start := time.Now()
+		if got, want := l.retrySyncFullEventFn(), syncFullTimerEvent; got != want {
+			t.Fatalf("got event %q want %q", got, want)
+		}
+		if elapsed := time.Since(start); elapsed > time.Second {
+			t.Fatalf("retry took %v, custom interval was not applied", elapsed)
+		}
+	})
+}
+
+func TestAE_retryDelay_backoff(t *testing.T) {
+	t.Parallel()
+	l := testSyncer(t)
+	boom := errors.New("boom")
+	l.State = &mock{syncFull: func() error { return boom }}
+
+	want := []time.Duration{
+		retryFailIntv,      // first failure
+		2 * retryFailIntv,  // second
+		4 * retryFailIntv,  // third
+		8 * retryFailIntv,  // fourth
+		16 * retryFailIntv, // fifth, at the cap
+		16 * retryFailIntv, // capped from here on
+	}
+	for i, w := range want {
+		if fs := l.nextFSMState(fullSyncState); fs != retryFullSyncState {
+			t.Fatalf("got state %v want %v", fs, retryFullSyncState)
+		}
+		if got := l.retryDelay(); got != w {
+			t.Fatalf("failure %d: got delay %v want %v", i+1, got, w)
+		}
+	}
+
+	// the first success resets the backoff
+	l.State = &mock{}
+	if fs := l.nextFSMState(fullSyncState); fs != partialSyncState {
+		t.Fatalf("got state %v want %v", fs, partialSyncState)
+	}
+	if got, want := l.retryDelay(), retryFailIntv; got != want {
+		t.Fatalf("got delay %v after success want %v", got, want)
+	}
+}
+
+func TestAE_retryDelay_customMax(t *testing.T) {
+	t.Parallel()
+	l, err := NewStateSyncerWithConfig(nil, 0, nil, nil, SyncerConfig{
+		RetryFailInterval:    10 * time.Millisecond,
+		RetryFailMaxInterval: 25 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatalf("got error %v want nil", err)
+	}
+	l.failedAttempts = 3
+	if got, want := l.retryDelay(), 25*time.Millisecond; got != want {
+		t.Fatalf("got delay %v want %v", got, want)
+	}
+
+	if _, err := NewStateSyncerWithConfig(nil, 0, nil, nil, SyncerConfig{
+		RetryFailInterval:    time.Minute,
+		RetryFailMaxInterval: time.Second,
+	}); err == nil {
+		t.Fatal("expected error for max below base interval")
+	}
+}
+
+func TestAE_syncMetrics(t *testing.T) {
+	sink := metrics.NewInmemSink(time.Minute, time.Minute)
+	cfg := metrics.DefaultConfig("")
+	cfg.EnableHostname = false
+	cfg.EnableRuntimeMetrics = false
+	metrics.NewGlobal(cfg, sink)
+
+	l := testSyncer(t)
+	boom := errors.New("boom")
+	l.State = &mock{syncFull: func() error { return boom }}
+
+	// one failed full sync, then a successful full and partial sync
+	l.nextFSMState(fullSyncState)
+	l.State = &mock{}
+	l.nextFSMState(fullSyncState)
+	l.SyncChanges.Trigger()
+	l.nextFSMState(partialSyncState)
+
+	data := sink.Data()[0]
+	data.RLock()
+	defer data.RUnlock()
+
+	counters := map[string]int{
+		"ae.sync.failure;kind=full":    1,
+		"ae.sync.success;kind=full":    1,
+		"ae.sync.success;kind=partial": 1,
+	}
+	for key, want := range counters {
+		c, ok := data.Counters[key]
+		if !ok {
+			t.Fatalf("missing counter %q, got %v", key, data.Counters)
+		}
+		if c.Count != want {
+			t.Fatalf("counter %q: got %d want %d", key, c.Count, want)
+		}
+	}
+	if _, ok := data.Samples["ae.sync;kind=full"]; !ok {
+		t.Fatalf("missing duration sample, got %v", data.Samples)
+	}
+	g, ok := data.Gauges["ae.sync.failed_attempts"]
+	if !ok {
+		t.Fatalf("missing failed_attempts gauge, got %v", data.Gauges)
+	}
+	if g.Value != 0 {
+		t.Fatalf("got failed_attempts gauge %v want 0 after success", g.Value)
+	}
+}
+
+func TestAE_RunContext_CancelStopsTheSyncer(t *testing.T) {
+	t.Parallel()
+	l := testSyncer(t)
+	l.Interval = time.Hour
+	l.State = &mock{}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	errCh := make(chan error, 1)
+	go func() { errCh <- l.RunContext(ctx) }()
+
+	// let the first full sync happen, then cancel while the syncer is
+	// waiting for the next event
+	time.Sleep(50 * time.Millisecond)
+	cancel()
+
+	select {
+	case err := <-errCh:
+		if err != context.Canceled {
+			t.Fatalf("got error %v want %v", err, context.Canceled)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("RunContext did not return after cancellation")
+	}
+}
+
+func TestAE_RunContext_ShutdownChStillWorks(t *testing.T) {
+	t.Parallel()
+	shutdownCh := make(chan struct{})
+	l := testSyncer(t)
+	l.Interval = time.Hour
+	l.ShutdownCh = shutdownCh
+	l.State = &mock{}
+
+	errCh := make(chan error, 1)
+	go func() { errCh <- l.RunContext(context.Background()) }()
+
+	time.Sleep(50 * time.Millisecond)
+	close(shutdownCh)
+
+	select {
+	case err := <-errCh:
+		if err != nil {
+			t.Fatalf("got error %v want nil", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("RunContext did not return after shutdown")
+	}
+}
+
+func TestAE_LastSync(t *testing.T) {
+	t.Parallel()
+	l := testSyncer(t)
+	l.State = &mock{}
+
+	if !l.LastSyncTime().IsZero() {
+		t.Fatal("LastSyncTime should be zero before the first sync")
+	}
+	if l.LastSyncError() != nil {
+		t.Fatal("LastSyncError should be nil before the first sync")
+	}
+
+	// successful full sync records the time and clears the error
+	l.nextFSMState(fullSyncState)
+	first := l.LastSyncTime()
+	if first.IsZero() {
+		t.Fatal("LastSyncTime should be set after a successful sync")
+	}
+	if err := l.LastSyncError(); err != nil {
+		t.Fatalf("got error %v want nil", err)
+	}
+
+	// a failed sync keeps the last success time but records the error
+	boom := errors.New("boom")
+	l.State = &mock{syncFull: func() error { return boom }}
+	l.nextFSMState(fullSyncState)
+	if got := l.LastSyncTime(); got != first {
+		t.Fatalf("got time %v want %v", got, first)
+	}
+	if err := l.LastSyncError(); err != boom {
+		t.Fatalf("got error %v want %v", err, boom)
+	}
+
+	// a successful partial sync updates both again
+	l.State = &mock{}
+	l.SyncChanges.Trigger()
+	l.nextFSMState(partialSyncState)
+	if got := l.LastSyncTime(); !got.After(first) && got != first {
+		t.Fatalf("got time %v want >= %v", got, first)
+	}
+	if err := l.LastSyncError(); err != nil {
+		t.Fatalf("got error %v want nil", err)
+	}
+}
+
+// ctxMock is a mock whose context variants block until cancelled.
+type ctxMock struct {
+	mock
+	seq []string
+}
+
+func (m *ctxMock) SyncFullContext(ctx context.Context) error {
+	m.seq = append(m.seq, "fullCtx")
+	<-ctx.Done()
+	return ctx.Err()
+}
+
+func (m *ctxMock) SyncChangesContext(ctx context.Context) error {
+	m.seq = append(m.seq, "changesCtx")
+	return nil
+}
+
+func TestAE_ContextSyncState(t *testing.T) {
+	t.Run("shutdown cancels a blocked full sync", func(t *testing.T) {
+		shutdownCh := make(chan struct{})
+		l := testSyncer(t)
+		m := &ctxMock{}
+		l.State = m
+		l.ShutdownCh = shutdownCh
+
+		errCh := make(chan error, 1)
+		go func() { errCh <- l.syncFull() }()
+
+		time.Sleep(50 * time.Millisecond)
+		close(shutdownCh)
+
+		select {
+		case err := <-errCh:
+			if err != context.Canceled {
+				t.Fatalf("got error %v want %v", err, context.Canceled)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("blocked sync was not cancelled on shutdown")
+		}
+		if got, want := m.seq, []string{"fullCtx"}; !reflect.DeepEqual(got, want) {
+			t.Fatalf("got call sequence %v want %v", got, want)
+		}
+	})
+
+	t.Run("context variant is preferred for partial syncs", func(t *testing.T) {
+		l := testSyncer(t)
+		m := &ctxMock{}
+		l.State = m
+		if err := l.syncChanges(); err != nil {
+			t.Fatalf("got error %v want nil", err)
+		}
+		if got, want := m.seq, []string{"changesCtx"}; !reflect.DeepEqual(got, want) {
+			t.Fatalf("got call sequence %v want %v", got, want)
+		}
+	})
+
+	t.Run("plain SyncState still works", func(t *testing.T) {
+		l := testSyncer(t)
+		m := &mock{}
+		l.State = m
+		if err := l.syncFull(); err != nil {
+			t.Fatalf("got error %v want nil", err)
+		}
+		if got, want := m.seq, []string{"full"}; !reflect.DeepEqual(got, want) {
+			t.Fatalf("got call sequence %v want %v", got, want)
+		}
+	})
+}
+
+func TestAE_PauseFor(t *testing.T) {
+	t.Run("auto-resume fires", func(t *testing.T) {
+		l := testSyncer(t)
+		l.PauseFor(10 * time.Millisecond)
+		if !l.Paused() {
+			t.Fatal("syncer should be Paused right after PauseFor")
+		}
+		deadline := time.After(time.Second)
+		for l.Paused() {
+			select {
+			case <-deadline:
+				t.Fatal("auto-resume did not fire")
+			case <-time.After(time.Millisecond):
+			}
+		}
+	})
+
+	t.Run("manual resume beats the timer", func(t *testing.T) {
+		l := testSyncer(t)
+		resume := l.PauseFor(10 * time.Millisecond)
+		if got := resume(); !got {
+			t.Fatal("early resume should report that the syncer resumed")
+		}
+		if l.Paused() {
+			t.Fatal("syncer should not be Paused after early resume")
+		}
+		// the timer firing later must not over-resume
+		time.Sleep(30 * time.Millisecond)
+		if l.Paused() {
+			t.Fatal("syncer should still be resumed")
+		}
+		if got := resume(); got {
+			t.Fatal("second resume should be a no-op")
+		}
+	})
+
+	t.Run("plays with the refcount", func(t *testing.T) {
+		l := testSyncer(t)
+		l.Pause()
+		resume := l.PauseFor(time.Hour)
+		resume()
+		if !l.Paused() {
+			t.Fatal("syncer should still be Paused by the manual Pause")
+		}
+		l.Resume()
+		if l.Paused() {
+			t.Fatal("syncer should not be Paused after all resumes")
+		}
+	})
+}
+
+func TestAE_syncChangesDebounce(t *testing.T) {
+	t.Parallel()
+	l, err := NewStateSyncerWithConfig(nil, time.Hour, nil, nil, SyncerConfig{
+		SyncChangesDebounce: 100 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatalf("got error %v want nil", err)
+	}
+	l.ClusterSize = func() int { return 1 }
+	l.stagger = func(d time.Duration) time.Duration { return d }
+	l.resetNextFullSyncCh()
+
+	// fire a burst of triggers while the debounce window is open
+	l.SyncChanges.Trigger()
+	go func() {
+		for i := 0; i < 4; i++ {
+			time.Sleep(10 * time.Millisecond)
+			l.SyncChanges.Trigger()
+		}
+	}()
+
+	if got, want := l.syncChangesEventFn(), syncChangesNotifEvent; got != want {
+		t.Fatalf("got event %q want %q", got, want)
+	}
+
+	// the whole burst collapsed into one event with nothing left over
+	select {
+	case <-l.SyncChanges.Notif():
+		t.Fatal("trigger from the burst survived the debounce window")
+	default:
+	}
+}
+
+func TestAE_skipPartialSyncWhenFullPending(t *testing.T) {
+	t.Run("queued SyncFull trigger", func(t *testing.T) {
+		l := testSyncer(t)
+		m := &mock{}
+		l.State = m
+		l.SyncFull.Trigger()
+		l.syncChangesEvent = func() event { return syncChangesNotifEvent }
+
+		if got, want := l.nextFSMState(partialSyncState), partialSyncState; got != want {
+			t.Fatalf("got state %v want %v", got, want)
+		}
+		if len(m.seq) != 0 {
+			t.Fatalf("got call sequence %v want none", m.seq)
+		}
+		// the peeked trigger is still pending for the event loop
+		select {
+		case <-l.SyncFull.Notif():
+		default:
+			t.Fatal("SyncFull trigger was consumed")
+		}
+	})
+
+	t.Run("expired full sync timer", func(t *testing.T) {
+		l := testSyncer(t)
+		m := &mock{}
+		l.State = m
+		ch := make(chan time.Time, 1)
+		ch <- time.Now()
+		l.nextFullSyncCh = ch
+		l.syncChangesEvent = func() event { return syncChangesNotifEvent }
+
+		if got, want := l.nextFSMState(partialSyncState), partialSyncState; got != want {
+			t.Fatalf("got state %v want %v", got, want)
+		}
+		if len(m.seq) != 0 {
+			t.Fatalf("got call sequence %v want none", m.seq)
+		}
+		// the timer fire is converted into a SyncFull trigger
+		select {
+		case <-l.SyncFull.Notif():
+		default:
+			t.Fatal("expired timer did not re-arm the SyncFull trigger")
+		}
+	})
+
+	t.Run("no full sync pending", func(t *testing.T) {
+		l := testSyncer(t)
+		m := &mock{}
+		l.State = m
+		l.syncChangesEvent = func() event { return syncChangesNotifEvent }
+
+		if got, want := l.nextFSMState(partialSyncState), partialSyncState; got != want {
+			t.Fatalf("got state %v want %v", got, want)
+		}
+		if got, want := m.seq, []string{"changes"}; !reflect.DeepEqual(got, want) {
+			t.Fatalf("got call sequence %v want %v", got, want)
+		}
+	})
+}
+
+func TestAE_circuitBreaker(t *testing.T) {
+	var buf bytes.Buffer
+	logger := hclog.New(&hclog.LoggerOptions{Output: &buf})
+
+	l, err := NewStateSyncerWithConfig(nil, time.Hour, nil, logger, SyncerConfig{
+		BreakerFailureThreshold: 2,
+		BreakerOpenInterval:     42 * time.Minute,
+	})
+	if err != nil {
+		t.Fatalf("got error %v want nil", err)
+	}
+	l.ClusterSize = func() int { return 1 }
+	l.stagger = func(d time.Duration) time.Duration { return d }
+	boom := errors.New("boom")
+	l.State = &mock{syncFull: func() error { return boom }}
+
+	// first failure keeps the normal backoff
+	l.nextFSMState(fullSyncState)
+	if l.breakerOpen {
+		t.Fatal("breaker should not trip below the threshold")
+	}
+	if got, want := l.retryDelay(), retryFailIntv; got != want {
+		t.Fatalf("got delay %v want %v", got, want)
+	}
+
+	// the second and third failures trip the breaker once
+	l.nextFSMState(fullSyncState)
+	l.nextFSMState(fullSyncState)
+	if !l.breakerOpen {
+		t.Fatal("breaker should be open after reaching the threshold")
+	}
+	if got, want := l.retryDelay(), 42*time.Minute; got != want {
+		t.Fatalf("got delay %v want %v", got, want)
+	}
+	if got := strings.Count(buf.String(), "circuit breaker open"); got != 1 {
+		t.Fatalf("got %d open-state logs want 1:\n%s", got, buf.String())
+	}
+
+	// the first success closes the breaker and resets the delay
+	l.State = &mock{}
+	l.nextFSMState(fullSyncState)
+	if l.breakerOpen {
+		t.Fatal("breaker should be closed after a successful sync")
+	}
+	if got, want := l.retryDelay(), retryFailIntv; got != want {
+		t.Fatalf("got delay %v want %v", got, want)
+	}
+	if !strings.Contains(buf.String(), "circuit breaker closed") {
+		t.Fatalf("missing closed-state log:\n%s", buf.String())
+	}
+}
+
+func TestAE_ForceFullSync(t *testing.T) {
+	t.Run("success", func(t *testing.T) {
+		l := testSyncer(t)
+		m := &mock{}
+		l.State = m
+		if err := l.ForceFullSync(context.Background()); err != nil {
+			t.Fatalf("got error %v want nil", err)
+		}
+		if got, want := m.seq, []string{"full"}; !reflect.DeepEqual(got, want) {
+			t.Fatalf("got call sequence %v want %v", got, want)
+		}
+	})
+
+	t.Run("failure is reported", func(t *testing.T) {
+		l := testSyncer(t)
+		boom := errors.New("boom")
+		l.State = &mock{syncFull: func() error { return boom }}
+		if err := l.ForceFullSync(context.Background()); err != boom {
+			t.Fatalf("got error %v want %v", err, boom)
+		}
+	})
+
+	t.Run("cancellation while syncing", func(t *testing.T) {
+		l := testSyncer(t)
+		block := make(chan struct{})
+		defer close(block)
+		l.State = &mock{syncFull: func() error { <-block; return nil }}
+
+		ctx, cancel := context.WithCancel(context.Background())
+		errCh := make(chan error, 1)
+		go func() { errCh <- l.ForceFullSync(ctx) }()
+
+		time.Sleep(20 * time.Millisecond)
+		cancel()
+		select {
+		case err := <-errCh:
+			if err != context.Canceled {
+				t.Fatalf("got error %v want %v", err, context.Canceled)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("ForceFullSync did not return after cancellation")
+		}
+	})
+
+	t.Run("waits for resume", func(t *testing.T) {
+		l := testSyncer(t)
+		m := &mock{}
+		l.State = m
+		l.Pause()
+
+		errCh := make(chan error, 1)
+		go func() { errCh <- l.ForceFullSync(context.Background()) }()
+
+		time.Sleep(30 * time.Millisecond)
+		if len(errCh) != 0 {
+			t.Fatal("ForceFullSync should not sync while paused")
+		}
+		l.Resume()
+		select {
+		case err := <-errCh:
+			if err != nil {
+				t.Fatalf("got error %v want nil", err)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("ForceFullSync did not run after resume")
+		}
+	})
+}
+
+func TestAE_startupJitterDelaysFirstSync(t *testing.T) {
+	shutdownCh := make(chan struct{})
+	defer close(shutdownCh)
+
+	synced := make(chan time.Time, 1)
+	l, err := NewStateSyncerWithConfig(
+		&mock{syncFull: func() error {
+			synced <- time.Now()
+			return nil
+		}},
+		time.Hour, shutdownCh, nil,
+		SyncerConfig{StartupJitter: 100 * time.Millisecond},
+	)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	l.ClusterSize = func() int { return 1 }
+	// make the jitter deterministic: always the full configured delay
+	l.stagger = func(d time.Duration) time.Duration { return d }
+
+	start := time.Now()
+	go l.Run()
+
+	select {
+	case ts := <-synced:
+		if got := ts.Sub(start); got < 100*time.Millisecond {
+			t.Fatalf("first sync ran after %s, want at least the startup jitter", got)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for first sync")
+	}
+}
+
+func TestAE_negativeStartupJitter(t *testing.T) {
+	if _, err := NewStateSyncerWithConfig(nil, time.Second, nil, nil, SyncerConfig{
+		StartupJitter: -1 * time.Second,
+	}); err == nil {
+		t.Fatal("expected error for negative startup jitter")
+	}
+}
+
+func TestAE_triggerStats(t *testing.T) {
+	l := testSyncer(t)
+	l.stagger = func(time.Duration) time.Duration { return time.Millisecond }
+
+	if got := l.TriggerStats(); got != (TriggerStats{}) {
+		t.Fatalf("got initial stats %+v, want zero value", got)
+	}
+
+	// a fired but unconsumed trigger shows up as pending
+	l.SyncFull.Trigger()
+	if got := l.TriggerStats(); !got.FullSyncPending || got.FullSyncsConsumed != 0 {
+		t.Fatalf("got stats %+v, want pending full sync trigger", got)
+	}
+
+	// consuming the trigger moves it from pending to the counter
+	if got, want := l.retrySyncFullEventFn(), syncFullNotifEvent; got != want {
+		t.Fatalf("got event %q, want %q", got, want)
+	}
+	if got := l.TriggerStats(); got.FullSyncPending || got.FullSyncsConsumed != 1 {
+		t.Fatalf("got stats %+v, want one consumed full sync trigger", got)
+	}
+
+	l.SyncChanges.Trigger()
+	if got := l.TriggerStats(); !got.SyncChangesPending || got.SyncChangesConsumed != 0 {
+		t.Fatalf("got stats %+v, want pending sync changes trigger", got)
+	}
+	if got, want := l.syncChangesEventFn(), syncChangesNotifEvent; got != want {
+		t.Fatalf("got event %q, want %q", got, want)
+	}
+	if got := l.TriggerStats(); got.SyncChangesPending || got.SyncChangesConsumed != 1 {
+		t.Fatalf("got stats %+v, want one consumed sync changes trigger", got)
+	}
+	if got := l.TriggerStats().FullSyncsConsumed; got != 1 {
+		t.Fatalf("got %d consumed full sync triggers, want 1", got)
+	}
+}
+
+func TestAE_criticalSyncChangesBypassPause(t *testing.T) {
+	var calls int
+	l := testSyncer(t)
+	l.State = &mock{syncChanges: func() error { calls++; return nil }}
+	l.Pause()
+
+	// a routine partial sync is suppressed while paused
+	l.syncChangesEvent = func() event { return syncChangesNotifEvent }
+	if got, want := l.nextFSMState(partialSyncState), partialSyncState; got != want {
+		t.Fatalf("got state %v want %v", got, want)
+	}
+	if calls != 0 {
+		t.Fatalf("routine sync ran %d times while paused, want 0", calls)
+	}
+
+	// a critical partial sync runs despite the pause
+	l.syncChangesEvent = func() event { return syncChangesCriticalNotifEvent }
+	if got, want := l.nextFSMState(partialSyncState), partialSyncState; got != want {
+		t.Fatalf("got state %v want %v", got, want)
+	}
+	if calls != 1 {
+		t.Fatalf("critical sync ran %d times while paused, want 1", calls)
+	}
+}
+
+func TestAE_syncChangesEventFnCriticalTrigger(t *testing.T) {
+	l := testSyncer(t)
+	l.SyncChangesCritical.Trigger()
+	if got, want := l.syncChangesEventFn(), syncChangesCriticalNotifEvent; got != want {
+		t.Fatalf("got event %q, want %q", got, want)
+	}
+}
+
+func TestAE_syncResults(t *testing.T) {
+	boom := errors.New("boom")
+	l := testSyncer(t)
+	l.State = &mock{
+		syncFull:    func() error { return boom },
+		syncChanges: func() error { return nil },
+	}
+	results := make(chan SyncResult, 2)
+	l.Results = results
+
+	start := time.Now()
+	l.syncFull()
+	l.syncChanges()
+
+	want := []struct {
+		kind string
+		err  error
+	}{
+		{"full", boom},
+		{"partial", nil},
+	}
+	for _, w := range want {
+		select {
+		case r := <-results:
+			if r.Kind != w.kind {
+				t.Fatalf("got kind %q, want %q", r.Kind, w.kind)
+			}
+			if r.Err != w.err {
+				t.Fatalf("got err %v, want %v", r.Err, w.err)
+			}
+			if r.Start.Before(start) {
+				t.Fatalf("got start %v before the test started", r.Start)
+			}
+			if r.Duration < 0 {
+				t.Fatalf("got negative duration %s", r.Duration)
+			}
+		default:
+			t.Fatalf("no result reported for %q sync", w.kind)
+		}
+	}
+}
+
+func TestAE_syncResultsNonBlocking(t *testing.T) {
+	l := testSyncer(t)
+	l.State = &mock{}
+	l.Results = make(chan SyncResult) // unbuffered and never drained
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		l.syncChanges()
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("sync blocked on an undrained results channel")
+	}
+}
+
+// reportingMock is a mock SyncState that also reports synced counts.
+type reportingMock struct {
+	mock
+	services, checks, nodes int
+}
+
+func (m *reportingMock) SyncedCounts() (services, checks, nodes int) {
+	return m.services, m.checks, m.nodes
+}
+
+func TestAE_lastSyncedCounts(t *testing.T) {
+	l := testSyncer(t)
+
+	// no counts without a reporter
+	l.State = &mock{}
+	l.syncFull()
+	if _, ok := l.LastSyncedCounts(); ok {
+		t.Fatal("counts reported without a SyncStateReporter")
+	}
+
+	// a reporting state surfaces its counts after a successful full sync
+	r := &reportingMock{services: 3, checks: 7, nodes: 2}
+	l.State = r
+	l.syncFull()
+	got, ok := l.LastSyncedCounts()
+	if !ok {
+		t.Fatal("expected counts after a successful full sync")
+	}
+	if want := (SyncedCounts{Services: 3, Checks: 7, Nodes: 2}); got != want {
+		t.Fatalf("got counts %+v, want %+v", got, want)
+	}
+
+	// a failed full sync keeps the previous counts
+	l.State = &reportingMock{
+		mock:     mock{syncFull: func() error { return errors.New("boom") }},
+		services: 99,
+	}
+	l.syncFull()
+	if got, _ = l.LastSyncedCounts(); got != (SyncedCounts{Services: 3, Checks: 7, Nodes: 2}) {
+		t.Fatalf("failed sync overwrote counts: %+v", got)
+	}
+}
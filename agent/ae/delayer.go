@@ -0,0 +1,74 @@
+package ae
+
+import (
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// Delayer computes the random delay applied to scheduled sync runs so
+// that cluster wide events are spread out over time. The delay grows with
+// the size of the cluster.
+type Delayer struct {
+	// MaxJitter caps the duration returned by Jitter. For very large
+	// clusters the scaled jitter is otherwise unbounded and could push a
+	// sync out arbitrarily far. Zero means no cap.
+	MaxJitter time.Duration
+
+	// clusterSize returns the number of members in the cluster.
+	clusterSize func() int
+
+	// scale computes the delay factor for the current cluster size.
+	scale ScaleFn
+
+	// stagger draws the random part of the jitter. When nil the shared
+	// package-level source is used.
+	stagger func(time.Duration) time.Duration
+}
+
+// NewClusterSizeDelayer returns a Delayer which scales the jitter with
+// the cluster size reported by the given function. An optional ScaleFn
+// overrides the default log2 delay curve.
+func NewClusterSizeDelayer(clusterSize func() int, scale ...ScaleFn) *Delayer {
+	d := &Delayer{clusterSize: clusterSize, scale: scaleFactor}
+	if len(scale) > 0 && scale[0] != nil {
+		d.scale = scale[0]
+	}
+	return d
+}
+
+// NewSeededClusterSizeDelayer is NewClusterSizeDelayer with the jitter
+// drawn from a private random source seeded with the given value, so the
+// jitter sequence is reproducible. This is meant for tests and
+// deterministic simulations; production callers should use the shared
+// source via NewClusterSizeDelayer.
+func NewSeededClusterSizeDelayer(seed int64, clusterSize func() int, scale ...ScaleFn) *Delayer {
+	d := NewClusterSizeDelayer(clusterSize, scale...)
+	rnd := rand.New(rand.NewSource(seed))
+	var mu sync.Mutex
+	d.stagger = func(dur time.Duration) time.Duration {
+		if dur <= 0 {
+			return 0
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		return time.Duration(rnd.Int63n(int64(dur)))
+	}
+	return d
+}
+
+// Jitter returns a random duration between 0s and the given duration
+// multiplied by the scale factor for the current cluster size. If
+// MaxJitter is set the result never exceeds it.
+func (d *Delayer) Jitter(dur time.Duration) time.Duration {
+	f := d.scale(d.clusterSize())
+	stagger := d.stagger
+	if stagger == nil {
+		stagger = libRandomStagger
+	}
+	delay := stagger(time.Duration(f) * dur)
+	if d.MaxJitter > 0 && delay > d.MaxJitter {
+		return d.MaxJitter
+	}
+	return delay
+}
@@ -0,0 +1,109 @@
+package ae
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/consul/lib"
+)
+
+func TestAE_Delayer_JitterCap(t *testing.T) {
+	libRandomStagger = func(d time.Duration) time.Duration { return d }
+	defer func() { libRandomStagger = lib.RandomStagger }()
+
+	nodes := 128
+	d := NewClusterSizeDelayer(func() int { return nodes })
+
+	if got, want := d.Jitter(time.Minute), time.Minute; got != want {
+		t.Fatalf("got %v want %v", got, want)
+	}
+
+	// At a million nodes the scale factor is 14 which would push the
+	// jitter to 14 minutes without a cap.
+	nodes = 1 << 20
+	if got, want := d.Jitter(time.Minute), 14*time.Minute; got != want {
+		t.Fatalf("got %v want %v", got, want)
+	}
+
+	d.MaxJitter = 10 * time.Minute
+	if got, want := d.Jitter(time.Minute), 10*time.Minute; got != want {
+		t.Fatalf("got %v want %v", got, want)
+	}
+
+	// The cap only kicks in when the scaled jitter exceeds it.
+	if got, want := d.Jitter(time.Second), 14*time.Second; got != want {
+		t.Fatalf("got %v want %v", got, want)
+	}
+}
+
+func TestAE_Delayer_CapThroughStagger(t *testing.T) {
+	libRandomStagger = func(d time.Duration) time.Duration { return d }
+	defer func() { libRandomStagger = lib.RandomStagger }()
+
+	l := testSyncer(t)
+	l.ClusterSize = func() int { return 1 << 20 }
+	l.Delayer.MaxJitter = 10 * time.Minute
+	if got, want := l.staggerFn(time.Minute), 10*time.Minute; got != want {
+		t.Fatalf("got %v want %v", got, want)
+	}
+}
+
+func TestAE_Delayer_CustomScaleFn(t *testing.T) {
+	libRandomStagger = func(d time.Duration) time.Duration { return d }
+	defer func() { libRandomStagger = lib.RandomStagger }()
+
+	var gotNodes int
+	d := NewClusterSizeDelayer(
+		func() int { return 42 },
+		func(nodes int) int { gotNodes = nodes; return 3 },
+	)
+	if got, want := d.Jitter(time.Second), 3*time.Second; got != want {
+		t.Fatalf("got %v want %v", got, want)
+	}
+	if gotNodes != 42 {
+		t.Fatalf("scale function saw %d nodes want 42", gotNodes)
+	}
+}
+
+func TestAE_LogScale_CustomThreshold(t *testing.T) {
+	t.Parallel()
+	scale := LogScale(32)
+	tests := []struct {
+		nodes int
+		want  int
+	}{
+		{32, 1},
+		{64, 2},
+		{128, 3},
+		{256, 4},
+	}
+	for _, tt := range tests {
+		if got := scale(tt.nodes); got != tt.want {
+			t.Fatalf("%d nodes: got scale %d want %d", tt.nodes, got, tt.want)
+		}
+	}
+}
+
+func TestAE_Delayer_SeededJitter(t *testing.T) {
+	t.Parallel()
+	one := func() int { return 1 }
+	jitters := func(d *Delayer) []time.Duration {
+		var out []time.Duration
+		for i := 0; i < 10; i++ {
+			out = append(out, d.Jitter(time.Hour))
+		}
+		return out
+	}
+
+	a := jitters(NewSeededClusterSizeDelayer(1, one))
+	b := jitters(NewSeededClusterSizeDelayer(1, one))
+	if !reflect.DeepEqual(a, b) {
+		t.Fatalf("same seed produced different sequences:\n%v\n%v", a, b)
+	}
+
+	c := jitters(NewSeededClusterSizeDelayer(2, one))
+	if reflect.DeepEqual(a, c) {
+		t.Fatalf("different seeds produced the same sequence: %v", a)
+	}
+}
@@ -21,3 +21,9 @@ func (t Trigger) Trigger() {
 func (t Trigger) Notif() <-chan struct{} {
 	return t.ch
 }
+
+// Pending reports whether an event has been triggered but not yet
+// consumed.
+func (t Trigger) Pending() bool {
+	return len(t.ch) > 0
+}
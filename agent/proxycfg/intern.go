@@ -0,0 +1,80 @@
+package proxycfg
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/hashicorp/consul/agent/structs"
+)
+
+// internedEntriesMax bounds the number of canonical entries an interner
+// retains. Old versions of a node accumulate as watches deliver updates, so
+// once the cap is reached the table is reset rather than evicted piecemeal;
+// live entries repopulate it on the next round of updates.
+const internedEntriesMax = 8192
+
+// csnInterner deduplicates identical CheckServiceNode entries across the
+// endpoint maps of a single proxy's snapshot. In large meshes many upstream
+// targets resolve to overlapping node sets and each watch delivers its own
+// copy, so sharing the inner Node/Service/Check pointers across maps reduces
+// snapshot memory and clone cost. Entries are keyed by the raft modify
+// indexes of their components, which change whenever the underlying data
+// changes, so a stale canonical entry is never handed out for newer content.
+//
+// The shared pointers are treated as immutable by snapshot consumers and
+// ConfigSnapshot.Clone deep-copies them, so delivered snapshots never alias
+// the interner's canonical entries. The interner is only used from the state's
+// run goroutine and needs no locking.
+type csnInterner struct {
+	entries map[string]structs.CheckServiceNode
+}
+
+func newCSNInterner() *csnInterner {
+	return &csnInterner{entries: make(map[string]structs.CheckServiceNode)}
+}
+
+// key returns a string identifying both the identity and the content version
+// of csn, or false if the entry is missing the parts the key is derived from.
+func (i *csnInterner) key(csn structs.CheckServiceNode) (string, bool) {
+	if csn.Node == nil || csn.Service == nil {
+		return "", false
+	}
+	var b strings.Builder
+	fmt.Fprintf(&b, "%s/%s/%d/%d",
+		csn.Node.Node,
+		csn.Service.CompoundServiceID(),
+		csn.Node.ModifyIndex,
+		csn.Service.ModifyIndex,
+	)
+	for _, chk := range csn.Checks {
+		fmt.Fprintf(&b, "/%s:%d", chk.CheckID, chk.ModifyIndex)
+	}
+	return b.String(), true
+}
+
+// intern returns a slice with the same contents as nodes where entries that
+// were seen before are replaced by the canonical copy, sharing the inner
+// pointers. Entries seen for the first time become the canonical copy.
+func (i *csnInterner) intern(nodes structs.CheckServiceNodes) structs.CheckServiceNodes {
+	if i == nil || len(nodes) == 0 {
+		return nodes
+	}
+	if len(i.entries) > internedEntriesMax {
+		i.entries = make(map[string]structs.CheckServiceNode)
+	}
+	out := make(structs.CheckServiceNodes, len(nodes))
+	for idx, csn := range nodes {
+		k, ok := i.key(csn)
+		if !ok {
+			out[idx] = csn
+			continue
+		}
+		if canonical, ok := i.entries[k]; ok {
+			out[idx] = canonical
+			continue
+		}
+		i.entries[k] = csn
+		out[idx] = csn
+	}
+	return out
+}
@@ -0,0 +1,78 @@
+package proxycfg
+
+import (
+	"testing"
+
+	"github.com/hashicorp/consul/agent/structs"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCSNInterner(t *testing.T) {
+	t.Run("identical entries share pointers", func(t *testing.T) {
+		i := newCSNInterner()
+
+		out1 := i.intern(TestUpstreamNodes(t))
+		out2 := i.intern(TestUpstreamNodes(t))
+
+		require.Equal(t, out1, out2)
+		for idx := range out1 {
+			require.True(t, out1[idx].Node == out2[idx].Node, "expected shared Node pointer at %d", idx)
+			require.True(t, out1[idx].Service == out2[idx].Service, "expected shared Service pointer at %d", idx)
+		}
+	})
+
+	t.Run("changed modify index is not shared", func(t *testing.T) {
+		i := newCSNInterner()
+
+		out1 := i.intern(TestUpstreamNodes(t))
+
+		updated := TestUpstreamNodes(t)
+		updated[0].Node.ModifyIndex = 99
+		out2 := i.intern(updated)
+
+		require.True(t, out1[0].Node != out2[0].Node, "expected distinct Node pointer for newer entry")
+		require.True(t, out1[1].Node == out2[1].Node, "expected unchanged entry to remain shared")
+	})
+
+	t.Run("entries without node or service pass through", func(t *testing.T) {
+		i := newCSNInterner()
+
+		nodes := structs.CheckServiceNodes{
+			{Service: structs.TestNodeService(t)},
+		}
+		out := i.intern(nodes)
+		require.Equal(t, nodes, out)
+		require.Empty(t, i.entries)
+	})
+
+	t.Run("nil interner passes through", func(t *testing.T) {
+		var i *csnInterner
+		nodes := TestUpstreamNodes(t)
+		require.Equal(t, nodes, i.intern(nodes))
+	})
+
+	t.Run("table resets at cap", func(t *testing.T) {
+		i := newCSNInterner()
+
+		nodes := TestUpstreamNodes(t)
+		for idx := uint64(0); len(i.entries) <= internedEntriesMax; idx++ {
+			nodes[0].Node.ModifyIndex = idx
+			i.intern(nodes)
+		}
+		i.intern(TestUpstreamNodes(t))
+		require.LessOrEqual(t, len(i.entries), internedEntriesMax)
+	})
+}
+
+func BenchmarkCSNInterner(b *testing.B) {
+	// Simulates many upstream targets resolving to the same node set, the
+	// case interning is meant to compress.
+	nodes := TestUpstreamNodes(b)
+	i := newCSNInterner()
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		i.intern(nodes)
+	}
+}
@@ -4,6 +4,7 @@ import (
 	"context"
 	"fmt"
 	"sort"
+	"time"
 
 	"github.com/mitchellh/copystructure"
 
@@ -14,6 +15,11 @@ import (
 // A shared data structure that contains information about discovered upstreams
 type ConfigSnapshotUpstreams struct {
 	Leaf *structs.IssuedCert
+
+	// LeafCertStale is true when the leaf watch is erroring but we are still
+	// serving the last-known leaf above rather than dropping proxy config. It
+	// is cleared by the next successful leaf update.
+	LeafCertStale bool
 	// DiscoveryChain is a map of upstream.Identifier() ->
 	// CompiledDiscoveryChain's, and is used to determine what services could be
 	// targeted by this upstream. We then instantiate watches for those targets.
@@ -50,6 +56,82 @@ type ConfigSnapshotUpstreams struct {
 
 	// PassthroughEndpoints is a map of: ServiceName -> ServicePassthroughAddrs.
 	PassthroughUpstreams map[string]ServicePassthroughAddrs
+
+	// PassthroughContributions records, per upstream-target watch, which
+	// addresses it contributed to PassthroughUpstreams for each destination
+	// service. When a later update for the same watch no longer lists an
+	// address it is pruned, unless another watch still supplies it.
+	PassthroughContributions map[string]map[string]map[string]struct{}
+
+	// UpstreamLimits is a map of upstream.Identifier() -> the typed limits
+	// parsed from that upstream's opaque config. Per-upstream settings take
+	// precedence field by field over the wildcard defaults.
+	UpstreamLimits map[string]*structs.UpstreamLimits
+
+	// UpstreamProtocolConflicts is a map of upstream.Identifier() -> the
+	// compiled chain's protocol for upstreams whose configured "protocol"
+	// override disagrees with the chain. The override keeps its documented
+	// precedence; this only surfaces the disagreement to operators.
+	UpstreamProtocolConflicts map[string]string
+
+	// ChainCompileErrors is a map of upstream.Identifier() -> an error
+	// message for upstreams whose discovery chain watch delivered no
+	// compiled chain. The prior good chain and endpoints are kept in the
+	// maps above while the entry is present; it is cleared by the next
+	// successful chain update.
+	ChainCompileErrors map[string]string
+
+	// UpstreamEndpointHealth summarizes, per upstream.Identifier(), how
+	// many of its watched endpoints are healthy across all targets. It is
+	// recomputed whenever an upstream-target watch delivers, so readiness
+	// checks can answer "does this upstream have any healthy endpoint"
+	// without walking WatchedUpstreamEndpoints.
+	UpstreamEndpointHealth map[string]UpstreamHealthSummary
+
+	// WatchedUpstreamsCount and WatchedGatewaysCount are the number of
+	// upstream target watches and mesh-gateway datacenter watches currently
+	// registered across all upstreams. They are recomputed whenever the
+	// watch maps above change so debug output can report them from a
+	// snapshot copy without iterating the live maps.
+	WatchedUpstreamsCount int
+	WatchedGatewaysCount  int
+}
+
+// recomputeWatchCounts refreshes WatchedUpstreamsCount and
+// WatchedGatewaysCount from the watch maps. It must be called after any
+// mutation that adds or removes target or gateway watches.
+func (u *ConfigSnapshotUpstreams) recomputeWatchCounts() {
+	upstreams, gateways := 0, 0
+	for _, targets := range u.WatchedUpstreams {
+		upstreams += len(targets)
+	}
+	for _, dcs := range u.WatchedGateways {
+		gateways += len(dcs)
+	}
+	u.WatchedUpstreamsCount = upstreams
+	u.WatchedGatewaysCount = gateways
+}
+
+// warm reports whether every target of every watched upstream has received
+// at least one endpoint update. It reads the watch-cancel maps, which Clone
+// nils out, so it is only meaningful on the snapshot the run loop tracks.
+func (u *ConfigSnapshotUpstreams) warm() bool {
+	for id, targets := range u.WatchedUpstreams {
+		for tid := range targets {
+			if _, ok := u.WatchedUpstreamEndpoints[id][tid]; !ok {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// UpstreamHealthSummary counts an upstream's watched endpoints by health.
+// An endpoint is healthy unless its aggregated check status is critical
+// or maintenance.
+type UpstreamHealthSummary struct {
+	Healthy int
+	Total   int
 }
 
 // ServicePassthroughAddrs contains the LAN addrs
@@ -59,6 +141,44 @@ type ServicePassthroughAddrs struct {
 
 	// Addrs is a set of the best LAN addresses for the instances of the upstream.
 	Addrs map[string]struct{}
+
+	// AddrWeights carries the passing weight of the instance behind each
+	// address in Addrs, defaulting to 1 when the instance has no weights,
+	// so passthrough traffic can respect instance weighting.
+	AddrWeights map[string]int
+}
+
+// InboundPermission is a typed representation of the inbound RBAC rules
+// derived from the service-intentions that match this proxy as a
+// destination. Entries are ordered by intention precedence so consumers can
+// evaluate them first-match-wins, falling back to the snapshot's
+// IntentionDefaultAllow when nothing matches.
+type InboundPermission struct {
+	// Source is the source service the intention applies to.
+	Source structs.ServiceName
+
+	// Action is the L4 action of the intention. It is empty when the
+	// intention specifies L7 permissions instead.
+	Action structs.IntentionAction
+
+	// Permissions are the L7 permissions in evaluation order. When empty
+	// the intention is L4-only and Action applies.
+	Permissions []*structs.IntentionPermission
+}
+
+// sharedChainWatch is a single compiled-discovery-chain watch referenced by
+// one or more upstreams with identical request parameters. Results arrive
+// under the primary upstream's correlation ID and are fanned out to every
+// referencing upstream.
+type sharedChainWatch struct {
+	// Primary is the upstream id the watch was registered under.
+	Primary string
+
+	// Refs is the set of upstream ids referencing this watch.
+	Refs map[string]struct{}
+
+	// Cancel stops the underlying watch once Refs drains.
+	Cancel context.CancelFunc
 }
 
 type configSnapshotConnectProxy struct {
@@ -67,14 +187,62 @@ type configSnapshotConnectProxy struct {
 	WatchedServiceChecks   map[structs.ServiceID][]structs.CheckType // TODO: missing garbage collection
 	PreparedQueryEndpoints map[string]structs.CheckServiceNodes      // DEPRECATED:see:WatchedUpstreamEndpoints
 
+	// PeerUpstreamEndpoints is a map of upstream.Identifier() -> instances
+	// of the service imported from the upstream's DestinationPeer.
+	PeerUpstreamEndpoints map[string]structs.CheckServiceNodes
+
+	// WatchedPreparedQueries is a map of upstream.Identifier() -> CancelFunc
+	// for prepared-query upstream polls, so they can be stopped when the
+	// corresponding upstream is removed.
+	WatchedPreparedQueries map[string]context.CancelFunc
+
+	// ChainWatchKeys maps an upstream.Identifier() to the cache key of the
+	// discovery chain request backing it. Upstreams with the same key share
+	// one underlying chain watch.
+	ChainWatchKeys map[string]string
+
+	// WatchedChainsByKey holds the shared chain watches, keyed by request
+	// cache key. The per-upstream entries in WatchedDiscoveryChains release
+	// references here instead of cancelling the watch directly.
+	WatchedChainsByKey map[string]*sharedChainWatch
+
 	// NOTE: Intentions stores a list of lists as returned by the Intentions
 	// Match RPC. So far we only use the first list as the list of matching
 	// intentions.
 	Intentions    structs.Intentions
 	IntentionsSet bool
 
+	// InboundPermissions is the typed representation of the inbound RBAC
+	// rules derived from Intentions. It is recomputed whenever the
+	// intentions watch fires.
+	InboundPermissions []InboundPermission
+
+	// RoutingConfigVersions tracks the raft modify index of the
+	// service-router and service-splitter config entries watched for each
+	// upstream, keyed by "<kind>/<name>". Upstreams without such an entry
+	// are absent from the map. The effective routing still comes from the
+	// compiled discovery chain; this exists for debug output so route
+	// changes can be traced back to the entry that caused them.
+	RoutingConfigVersions map[string]uint64
+
 	MeshConfig    *structs.MeshConfigEntry
 	MeshConfigSet bool
+
+	// IntentionUpstreamsSet indicates that the intention-upstreams watch
+	// has returned at least once. It is only ever set in transparent proxy
+	// mode where upstreams are discovered from intentions.
+	IntentionUpstreamsSet bool
+}
+
+// sharedChainWatchFor returns the shared chain watch registered under the
+// given primary upstream id, if any.
+func (c *configSnapshotConnectProxy) sharedChainWatchFor(primary string) *sharedChainWatch {
+	for _, shared := range c.WatchedChainsByKey {
+		if shared.Primary == primary {
+			return shared
+		}
+	}
+	return nil
 }
 
 func (c *configSnapshotConnectProxy) IsEmpty() bool {
@@ -90,10 +258,20 @@ func (c *configSnapshotConnectProxy) IsEmpty() bool {
 		len(c.WatchedGateways) == 0 &&
 		len(c.WatchedGatewayEndpoints) == 0 &&
 		len(c.WatchedServiceChecks) == 0 &&
+		len(c.WatchedPreparedQueries) == 0 &&
+		len(c.ChainWatchKeys) == 0 &&
+		len(c.WatchedChainsByKey) == 0 &&
 		len(c.PreparedQueryEndpoints) == 0 &&
+		len(c.PeerUpstreamEndpoints) == 0 &&
 		len(c.UpstreamConfig) == 0 &&
 		len(c.PassthroughUpstreams) == 0 &&
-		!c.MeshConfigSet
+		len(c.PassthroughContributions) == 0 &&
+		len(c.UpstreamLimits) == 0 &&
+		len(c.UpstreamProtocolConflicts) == 0 &&
+		len(c.InboundPermissions) == 0 &&
+		len(c.RoutingConfigVersions) == 0 &&
+		!c.MeshConfigSet &&
+		!c.IntentionUpstreamsSet
 }
 
 type configSnapshotTerminatingGateway struct {
@@ -153,6 +331,10 @@ type configSnapshotTerminatingGateway struct {
 	// service in the local datacenter.
 	ServiceGroups map[structs.ServiceName]structs.CheckServiceNodes
 
+	// ServiceGroupLastUpdated is a map of service name to the time its entry
+	// in ServiceGroups last received a successful watch update.
+	ServiceGroupLastUpdated map[structs.ServiceName]time.Time
+
 	// GatewayServices is a map of service name to the config entry association
 	// between the gateway and a service. TLS configuration stored here is
 	// used for TLS origination from the gateway to the linked service.
@@ -204,6 +386,7 @@ func (c *configSnapshotTerminatingGateway) IsEmpty() bool {
 		len(c.WatchedIntentions) == 0 &&
 		len(c.Intentions) == 0 &&
 		len(c.ServiceGroups) == 0 &&
+		len(c.ServiceGroupLastUpdated) == 0 &&
 		len(c.WatchedServices) == 0 &&
 		len(c.ServiceResolvers) == 0 &&
 		len(c.ServiceResolversSet) == 0 &&
@@ -235,10 +418,20 @@ type configSnapshotMeshGateway struct {
 	// that datacenter.
 	WatchedDatacenters map[string]context.CancelFunc
 
+	// WatchedDatacentersCancel cancels the watch on the catalog datacenter
+	// list that feeds WatchedDatacenters. The watch only runs while WAN
+	// federation is enabled or a service-resolver points at a remote
+	// datacenter, so this is nil for a purely local gateway.
+	WatchedDatacentersCancel context.CancelFunc
+
 	// ServiceGroups is a map of service name to the service instances of that
 	// service in the local datacenter.
 	ServiceGroups map[structs.ServiceName]structs.CheckServiceNodes
 
+	// ServiceGroupLastUpdated is a map of service name to the time its entry
+	// in ServiceGroups last received a successful watch update.
+	ServiceGroupLastUpdated map[structs.ServiceName]time.Time
+
 	// ServiceResolvers is a map of service name to an associated
 	// service-resolver config entry for that service.
 	ServiceResolvers map[structs.ServiceName]*structs.ServiceResolverConfigEntry
@@ -247,10 +440,41 @@ type configSnapshotMeshGateway struct {
 	// mesh-gateway in that datacenter.
 	GatewayGroups map[string]structs.CheckServiceNodes
 
+	// GatewayGroupLastUpdated is a map of datacenter name to the time its
+	// mesh-gateway watch last delivered successfully. When a remote
+	// datacenter becomes unreachable its last-known endpoints linger in
+	// GatewayGroups and HostnameDatacenters; the timestamp lets consumers
+	// surface or expire those stale entries.
+	GatewayGroupLastUpdated map[string]time.Time
+
 	// FedStateGateways is a map of datacenter names to mesh gateways in that
 	// datacenter.
 	FedStateGateways map[string]structs.CheckServiceNodes
 
+	// GatewayEndpointSources records per datacenter which source the
+	// gateway endpoints in use come from. A datacenter present in both
+	// sources uses the live gateway dump; federation state only fills in
+	// datacenters the dump has not discovered. This mirrors the precedence
+	// applied when endpoints are generated.
+	GatewayEndpointSources map[string]GatewayEndpointSource
+
+	// ServiceList is the last service list received from the catalog watch.
+	// It is kept so service watches can be reconciled again when the set of
+	// connect-capable services changes.
+	ServiceList []structs.ServiceName
+
+	// ConnectServices is the set of services known to have connect proxy
+	// instances in the local datacenter. It is nil unless the gateway is
+	// configured to watch only connect-capable services, in which case
+	// services outside the set do not get a connect-service watch.
+	ConnectServices map[structs.ServiceName]struct{}
+
+	// ConnectNativeServices is the set of services with connect-native
+	// instances in the local datacenter. Like ConnectServices it is only
+	// populated when the connect-services filter is configured, and services
+	// in either set keep their connect-service watch.
+	ConnectNativeServices map[structs.ServiceName]struct{}
+
 	// ConsulServers is the list of consul servers in this datacenter.
 	ConsulServers structs.CheckServiceNodes
 
@@ -259,6 +483,38 @@ type configSnapshotMeshGateway struct {
 	HostnameDatacenters map[string]structs.CheckServiceNodes
 }
 
+// GatewayEndpointSource identifies which watch produced the mesh gateway
+// endpoints in use for a datacenter.
+type GatewayEndpointSource string
+
+const (
+	// GatewayEndpointSourceDump means the endpoints come from the live
+	// gateway dump of that datacenter.
+	GatewayEndpointSourceDump GatewayEndpointSource = "gateway-dump"
+
+	// GatewayEndpointSourceFedState means the endpoints come from the
+	// federation state replicated for that datacenter.
+	GatewayEndpointSourceFedState GatewayEndpointSource = "federation-state"
+)
+
+// recomputeGatewayEndpointSources rebuilds GatewayEndpointSources from the
+// current contents of GatewayGroups and FedStateGateways. Call it whenever
+// either source changes.
+func (c *configSnapshotMeshGateway) recomputeGatewayEndpointSources() {
+	sources := make(map[string]GatewayEndpointSource, len(c.GatewayGroups)+len(c.FedStateGateways))
+	for dc, nodes := range c.FedStateGateways {
+		if len(nodes) > 0 {
+			sources[dc] = GatewayEndpointSourceFedState
+		}
+	}
+	for dc, nodes := range c.GatewayGroups {
+		if len(nodes) > 0 {
+			sources[dc] = GatewayEndpointSourceDump
+		}
+	}
+	c.GatewayEndpointSources = sources
+}
+
 func (c *configSnapshotMeshGateway) Datacenters() []string {
 	sz1, sz2 := len(c.GatewayGroups), len(c.FedStateGateways)
 
@@ -291,13 +547,33 @@ func (c *configSnapshotMeshGateway) IsEmpty() bool {
 		!c.WatchedServicesSet &&
 		len(c.WatchedDatacenters) == 0 &&
 		len(c.ServiceGroups) == 0 &&
+		len(c.ServiceGroupLastUpdated) == 0 &&
 		len(c.ServiceResolvers) == 0 &&
 		len(c.GatewayGroups) == 0 &&
 		len(c.FedStateGateways) == 0 &&
+		len(c.GatewayEndpointSources) == 0 &&
+		len(c.ServiceList) == 0 &&
+		len(c.ConnectServices) == 0 &&
+		len(c.ConnectNativeServices) == 0 &&
 		len(c.ConsulServers) == 0 &&
 		len(c.HostnameDatacenters) == 0
 }
 
+// connectCapable returns whether the given service may have a
+// connect-service watch. With no connect-services filter configured every
+// catalog service qualifies; otherwise a service qualifies when it has
+// connect proxy instances or registers as connect-native.
+func (c *configSnapshotMeshGateway) connectCapable(svc structs.ServiceName) bool {
+	if c.ConnectServices == nil && c.ConnectNativeServices == nil {
+		return true
+	}
+	if _, ok := c.ConnectServices[svc]; ok {
+		return true
+	}
+	_, ok := c.ConnectNativeServices[svc]
+	return ok
+}
+
 type configSnapshotIngressGateway struct {
 	ConfigSnapshotUpstreams
 
@@ -313,10 +589,35 @@ type configSnapshotIngressGateway struct {
 	// leaf cert watch with different parameters.
 	LeafCertWatchCancel context.CancelFunc
 
+	// ListenerHosts is the set of custom host entries from each listener's
+	// services, keyed by listener. Listeners with their own hosts get a
+	// dedicated leaf cert watch so they can present a listener-specific
+	// certificate rather than the gateway-wide one.
+	ListenerHosts map[IngressListenerKey][]string
+
+	// ListenerLeaves holds the leaf certs issued for listeners with their own
+	// hosts, keyed by listener.
+	ListenerLeaves map[IngressListenerKey]*structs.IssuedCert
+
+	// WatchedListenerLeaves is a map of listener keys to a cancel function for
+	// that listener's leaf cert watch.
+	WatchedListenerLeaves map[IngressListenerKey]context.CancelFunc
+
+	// WatchedListenerLeafHosts is the host set each watch in
+	// WatchedListenerLeaves was registered with, so a watch is only
+	// restarted when its listener's hosts actually change.
+	WatchedListenerLeafHosts map[IngressListenerKey][]string
+
 	// Upstreams is a list of upstreams this ingress gateway should serve traffic
 	// to. This is constructed from the ingress-gateway config entry, and uses
 	// the GatewayServices RPC to retrieve them.
 	Upstreams map[IngressListenerKey]structs.Upstreams
+
+	// ListenerErrors records per-listener validation problems, such as two
+	// listeners declaring different protocols on the same port. Consumers
+	// should skip building config for listeners with an error here rather
+	// than emit a broken one.
+	ListenerErrors map[IngressListenerKey]string
 }
 
 func (c *configSnapshotIngressGateway) IsEmpty() bool {
@@ -324,6 +625,7 @@ func (c *configSnapshotIngressGateway) IsEmpty() bool {
 		return true
 	}
 	return len(c.Upstreams) == 0 &&
+		len(c.ListenerLeaves) == 0 &&
 		len(c.DiscoveryChain) == 0 &&
 		len(c.WatchedUpstreams) == 0 &&
 		len(c.WatchedUpstreamEndpoints) == 0
@@ -353,9 +655,21 @@ type ConfigSnapshot struct {
 	Datacenter            string
 	IntentionDefaultAllow bool
 
+	// Generation increases whenever the snapshot content changed since the
+	// last delivery, so consumers can tell a genuinely new snapshot from a
+	// redelivery after a blocked send and skip redundant rebuilds.
+	Generation uint64
+
 	ServerSNIFn ServerSNIFunc
 	Roots       *structs.IndexedCARoots
 
+	// WatchErrors records the most recent update error per watch correlation
+	// ID. A failing watch leaves its previously delivered data in place, so
+	// consumers can keep using the healthy sections and treat the listed ones
+	// as stale. Entries are removed once the watch delivers a good result
+	// again. Values are error strings so the snapshot stays deep-copyable.
+	WatchErrors map[string]string
+
 	// connect-proxy specific
 	ConnectProxy configSnapshotConnectProxy
 
@@ -402,6 +716,134 @@ func (s *ConfigSnapshot) Valid() bool {
 	}
 }
 
+// TransparentProxyReady reports whether a transparent-mode connect proxy has
+// everything it needs to correctly route its discovered upstreams: the
+// intention-upstreams list and the mesh config entry. Valid() deliberately
+// does not require the intention-upstreams watch so a transparent proxy can
+// be valid before it is fully operational; this closes that gap for callers
+// that care. It is always true outside transparent mode.
+func (s *ConfigSnapshot) TransparentProxyReady() bool {
+	if s.Kind != structs.ServiceKindConnectProxy || s.Proxy.Mode != structs.ProxyModeTransparent {
+		return true
+	}
+	return s.ConnectProxy.MeshConfigSet && s.ConnectProxy.IntentionUpstreamsSet
+}
+
+// Warm returns whether the snapshot is Valid and additionally every watched
+// upstream target has received an initial endpoint update. Valid only
+// requires the mandatory watches (roots, leaf, intentions) so a proxy
+// configured from a merely valid snapshot can route to empty clusters until
+// endpoints trickle in. Kinds without upstream watches are warm as soon as
+// they are valid. Like TransparentProxyReady this inspects watch bookkeeping
+// that Clone discards, so call it on the run loop's snapshot, not a
+// delivered copy.
+func (s *ConfigSnapshot) Warm() bool {
+	if !s.Valid() {
+		return false
+	}
+	switch s.Kind {
+	case structs.ServiceKindConnectProxy:
+		return s.ConnectProxy.warm()
+	case structs.ServiceKindIngressGateway:
+		return s.IngressGateway.warm()
+	default:
+		return true
+	}
+}
+
+// ValidReasons returns the prerequisites this snapshot is still missing, for
+// logging and debug output. It covers everything Valid checks plus
+// transparent proxy readiness, so the result can be non-empty even when
+// Valid returns true.
+func (s *ConfigSnapshot) ValidReasons() []string {
+	var reasons []string
+	if s.Roots == nil {
+		reasons = append(reasons, "no CA roots")
+	}
+
+	switch s.Kind {
+	case structs.ServiceKindConnectProxy:
+		if s.ConnectProxy.Leaf == nil {
+			reasons = append(reasons, "no leaf certificate")
+		}
+		if !s.ConnectProxy.IntentionsSet {
+			reasons = append(reasons, "intentions not loaded")
+		}
+		if s.Proxy.Mode == structs.ProxyModeTransparent {
+			if !s.ConnectProxy.MeshConfigSet {
+				reasons = append(reasons, "transparent proxy: mesh config not loaded")
+			}
+			if !s.ConnectProxy.IntentionUpstreamsSet {
+				reasons = append(reasons, "transparent proxy: intention upstreams not loaded")
+			}
+		}
+
+	case structs.ServiceKindMeshGateway:
+		if s.ServiceMeta[structs.MetaWANFederationKey] == "1" && len(s.MeshGateway.ConsulServers) == 0 {
+			reasons = append(reasons, "no consul servers for WAN federation")
+		}
+		if !s.MeshGateway.WatchedServicesSet && len(s.MeshGateway.ServiceGroups) == 0 {
+			reasons = append(reasons, "service list not loaded")
+		}
+
+	case structs.ServiceKindIngressGateway:
+		if s.IngressGateway.Leaf == nil {
+			reasons = append(reasons, "no leaf certificate")
+		}
+		if !s.IngressGateway.TLSSet {
+			reasons = append(reasons, "gateway TLS config not loaded")
+		}
+		if !s.IngressGateway.HostsSet {
+			reasons = append(reasons, "gateway hosts not loaded")
+		}
+	}
+	return reasons
+}
+
+// snapshotSections records which top-level sections of the snapshot changed
+// since the last delivery. The roots are replaced wholesale by every kind
+// handler, so a roots-only change does not require re-cloning the (much
+// larger) kind-specific section.
+type snapshotSections struct {
+	roots bool
+	kind  bool
+}
+
+func (d *snapshotSections) markUpdate(correlationID string) {
+	if correlationID == rootsWatchID {
+		d.roots = true
+		return
+	}
+	d.kind = true
+}
+
+func (d snapshotSections) any() bool {
+	return d.roots || d.kind
+}
+
+// cloneReusing is Clone for the delivery path: sections that did not change
+// since prev was delivered are reused from it instead of deep-copied again.
+// Both the returned snapshot and prev are treated as read-only by consumers,
+// so sharing is safe. A nil prev or a changed kind section falls back to a
+// full Clone.
+func (s *ConfigSnapshot) cloneReusing(prev *ConfigSnapshot, dirty snapshotSections) (*ConfigSnapshot, error) {
+	switch {
+	case prev == nil, dirty.kind:
+		return s.Clone()
+	case !dirty.any():
+		// Redelivery with no changes: the previous clone is still accurate.
+		return prev, nil
+	default:
+		// Only the roots changed. They are replaced wholesale by handlers
+		// and never mutated in place, so share the pointer rather than
+		// deep-copying the rest of the snapshot again.
+		c := *prev
+		c.Roots = s.Roots
+		c.Generation = s.Generation
+		return &c, nil
+	}
+}
+
 // Clone makes a deep copy of the snapshot we can send to other goroutines
 // without worrying that they will racily read or mutate shared maps etc.
 func (s *ConfigSnapshot) Clone() (*ConfigSnapshot, error) {
@@ -417,6 +859,8 @@ func (s *ConfigSnapshot) Clone() (*ConfigSnapshot, error) {
 	case structs.ServiceKindConnectProxy:
 		snap.ConnectProxy.WatchedUpstreams = nil
 		snap.ConnectProxy.WatchedGateways = nil
+		snap.ConnectProxy.WatchedPreparedQueries = nil
+		snap.ConnectProxy.WatchedChainsByKey = nil
 	case structs.ServiceKindTerminatingGateway:
 		snap.TerminatingGateway.WatchedServices = nil
 		snap.TerminatingGateway.WatchedIntentions = nil
@@ -431,6 +875,8 @@ func (s *ConfigSnapshot) Clone() (*ConfigSnapshot, error) {
 		snap.IngressGateway.WatchedGateways = nil
 		snap.IngressGateway.WatchedDiscoveryChains = nil
 		snap.IngressGateway.LeafCertWatchCancel = nil
+		snap.IngressGateway.WatchedListenerLeaves = nil
+		snap.IngressGateway.WatchedListenerLeafHosts = nil
 	}
 
 	return snap, nil
@@ -6,20 +6,52 @@ import (
 	"fmt"
 	"net"
 	"reflect"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 
+	"github.com/armon/go-metrics"
+	"github.com/armon/go-metrics/prometheus"
+	bexpr "github.com/hashicorp/go-bexpr"
 	"github.com/hashicorp/go-hclog"
 	"github.com/mitchellh/copystructure"
+	"github.com/mitchellh/hashstructure"
 	"github.com/mitchellh/mapstructure"
 
 	"github.com/hashicorp/consul/agent/cache"
 	cachetype "github.com/hashicorp/consul/agent/cache-types"
 	"github.com/hashicorp/consul/agent/connect"
 	"github.com/hashicorp/consul/agent/structs"
+	"github.com/hashicorp/consul/api"
+	"github.com/hashicorp/consul/lib/decode"
+	"github.com/hashicorp/consul/lib/retry"
 	"github.com/hashicorp/consul/logging"
 )
 
+var StateCounters = []prometheus.CounterDefinition{
+	{
+		Name: []string{"proxycfg", "leaf", "watch_error"},
+		Help: "Increments whenever the leaf certificate watch for a proxy errors while the last-known leaf is still being served",
+	},
+	{
+		Name: []string{"proxycfg", "chain", "target_watches_exceeded"},
+		Help: "Increments whenever a discovery chain has more targets than the per-chain watch cap and excess failover targets are dropped",
+	},
+	{
+		Name: []string{"proxycfg", "snapshot", "coalesced_updates"},
+		Help: "Counts the watch updates that were coalesced into each delivered proxy config snapshot",
+	},
+}
+
+var StateSummaries = []prometheus.SummaryDefinition{
+	{
+		Name: []string{"proxycfg", "snapshot", "delivery_time"},
+		Help: "Measures the time between a watch update arriving and the resulting proxy config snapshot being delivered to watchers",
+	},
+}
+
 type CacheNotifier interface {
 	Notify(ctx context.Context, t string, r cache.Request,
 		correlationID string, ch chan<- cache.UpdateEvent) error
@@ -30,11 +62,30 @@ type Health interface {
 }
 
 const (
-	coalesceTimeout                    = 200 * time.Millisecond
+	// coalesceTimeout is the default window for batching watch updates into
+	// a single snapshot delivery for connect and ingress proxies, which
+	// want snappy updates.
+	coalesceTimeout = 200 * time.Millisecond
+
+	// gatewayCoalesceTimeout is the default window for mesh and
+	// terminating gateways, whose service-list driven updates arrive in
+	// large bursts and benefit from more aggressive batching.
+	gatewayCoalesceTimeout = 1 * time.Second
+
+	// maxChainTargetWatches bounds how many target watches a single
+	// discovery chain may create for one upstream. A pathological chain
+	// with many failover targets across many datacenters would otherwise
+	// fan out into an unbounded number of watches. Primary resolver
+	// targets are always kept; excess failovers are dropped
+	// deterministically.
+	maxChainTargetWatches = 64
+
 	rootsWatchID                       = "roots"
 	leafWatchID                        = "leaf"
 	intentionsWatchID                  = "intentions"
 	serviceListWatchID                 = "service-list"
+	connectKindServicesWatchID         = "connect-kind-services"
+	connectNativeServicesWatchID       = "connect-native-services"
 	federationStateListGatewaysWatchID = "federation-state-list-mesh-gateways"
 	consulServerListWatchID            = "consul-server-list"
 	datacentersWatchID                 = "datacenters"
@@ -43,14 +94,30 @@ const (
 	gatewayConfigWatchID               = "gateway-config"
 	externalServiceIDPrefix            = "external-service:"
 	serviceLeafIDPrefix                = "service-leaf:"
+	listenerLeafIDPrefix               = "listener-leaf:"
 	serviceConfigIDPrefix              = "service-config:"
 	serviceResolverIDPrefix            = "service-resolver:"
 	serviceIntentionsIDPrefix          = "service-intentions:"
+	serviceRouterIDPrefix              = "service-router:"
+	serviceSplitterIDPrefix            = "service-splitter:"
 	intentionUpstreamsID               = "intention-upstreams"
 	meshConfigEntryID                  = "mesh"
 	svcChecksWatchIDPrefix             = cachetype.ServiceHTTPChecksName + ":"
+	upstreamPeerWatchIDPrefix          = "upstream-peer:"
 	preparedQueryIDPrefix              = string(structs.UpstreamDestTypePreparedQuery) + ":"
 	defaultPreparedQueryPollInterval   = 30 * time.Second
+	minPreparedQueryPollInterval       = 1 * time.Second
+
+	// minEventChanBufferSize and maxEventChanBufferSize bound the buffer of
+	// the channel watch results are delivered on, which is otherwise sized
+	// from the number of configured upstreams.
+	minEventChanBufferSize = 10
+	maxEventChanBufferSize = 256
+
+	// failedDeliveryWarnThreshold is how many consecutive failed snapshot
+	// deliveries are tolerated before run escalates from a trace log to a
+	// warning about the stuck consumer.
+	failedDeliveryWarnThreshold = 5
 )
 
 type stateConfig struct {
@@ -61,6 +128,96 @@ type stateConfig struct {
 	dnsConfig             DNSConfig
 	serverSNIFn           ServerSNIFunc
 	intentionDefaultAllow bool
+
+	// coalesceTimeout overrides the per-kind default window for batching
+	// watch updates into a single snapshot delivery. Zero selects the
+	// default for the proxy's kind.
+	coalesceTimeout time.Duration
+
+	// snapshotBufferSize is the buffer size of the snapshot delivery channel
+	// returned from Watch. Zero selects the default of 1; larger buffers
+	// reduce redelivery retries under bursty updates with slow consumers.
+	snapshotBufferSize int
+
+	// notifyMaxRetries caps how many times a failed watch registration is
+	// retried with backoff before the error is surfaced. Zero selects the
+	// package default.
+	notifyMaxRetries int
+
+	// watchRateLimit caps how many watch registrations are started per
+	// watchRateInterval. Every registration can immediately kick off a
+	// blocking query against the servers, so a proxy with hundreds of
+	// upstreams registering its watches back-to-back spikes server load;
+	// throttling spreads the registrations out instead. Zero disables
+	// throttling.
+	watchRateLimit int
+
+	// watchRateInterval is the window watchRateLimit applies to. Zero
+	// selects the package default of one second.
+	watchRateInterval time.Duration
+
+	// onSnapshot, when set, is invoked synchronously from the run loop with
+	// each new snapshot just before it is offered on snapCh, at most once
+	// per generation. It runs on the run goroutine, so it must not block
+	// for long or snapshot delivery for the proxy stalls.
+	onSnapshot func(*ConfigSnapshot)
+
+	// strictUpstreamConfig enables a second, strict decode of each
+	// upstream's opaque config that warns about unknown keys, so typos like
+	// "conect_timeout_ms" surface instead of silently using defaults. The
+	// lenient decode still decides the effective config either way.
+	strictUpstreamConfig bool
+
+	// dedupEndpoints enables pointer-level sharing of identical
+	// CheckServiceNode entries across the snapshot's endpoint maps.
+	dedupEndpoints bool
+
+	// mergeUpstreamDefaults merges the wildcard upstream's opaque config
+	// into each explicit upstream's config before its discovery chain
+	// request is built, mirroring locally what centralized upstream
+	// defaults do server-side. Keys set on the upstream itself win.
+	mergeUpstreamDefaults bool
+
+	// defaultQueryOptions seeds the QueryOptions of every watch request the
+	// handlers generate; only AllowStale, MaxAge and StaleIfError are used.
+	// The state's token always overrides the Token field and watches that
+	// pick their own MaxAge (prepared query polls, the datacenter list)
+	// keep it.
+	defaultQueryOptions structs.QueryOptions
+
+	// waitForWarm delays the first snapshot delivery until the snapshot is
+	// Warm, i.e. every watched upstream target has received an initial
+	// endpoint update, not just until it is Valid. Only the first delivery
+	// is gated; after that updates flow as usual so a flapping upstream
+	// cannot stall reconfiguration.
+	waitForWarm bool
+
+	// initialSnapshot, when set, seeds the state with a previously
+	// persisted snapshot. A valid seed is delivered on the channel
+	// returned from Watch as soon as run starts, so a restarted agent can
+	// configure its proxy before the watches have re-fetched everything;
+	// the live snapshot replaces it once it becomes valid.
+	initialSnapshot *ConfigSnapshot
+
+	// endpointInterner holds the canonical entries when dedupEndpoints is
+	// set. It is created by newState and shared by all handlers of the state.
+	endpointInterner *csnInterner
+}
+
+// clock abstracts the timers state.run uses for the coalesce window so
+// tests can trigger delivery deterministically instead of sleeping.
+type clock interface {
+	Now() time.Time
+	AfterFunc(d time.Duration, f func()) *time.Timer
+}
+
+// realClock implements clock with the time package.
+type realClock struct{}
+
+func (realClock) Now() time.Time { return time.Now() }
+
+func (realClock) AfterFunc(d time.Duration, f func()) *time.Timer {
+	return time.AfterFunc(d, f)
 }
 
 // state holds all the state needed to maintain the config for a registered
@@ -75,9 +232,261 @@ type state struct {
 	// in Watch.
 	cancel func()
 
-	ch     chan cache.UpdateEvent
-	snapCh chan ConfigSnapshot
-	reqCh  chan chan *ConfigSnapshot
+	// watchCtx is the context all watches are registered against. It is a
+	// child of the context passed to run so that Rebuild can cancel every
+	// watch without stopping the run goroutine. Only the run goroutine may
+	// touch these after Watch has been called.
+	watchCtx    context.Context
+	watchCancel context.CancelFunc
+
+	// coalesceWindow is how long run waits after the first change before
+	// delivering a snapshot so further changes can be batched with it. It
+	// is resolved from the config override or the proxy kind at creation.
+	coalesceWindow time.Duration
+
+	// clock provides the coalesce timer; it is the real clock outside of
+	// tests.
+	clock clock
+
+	// watchStatuses tracks, per correlation ID, when each watch last
+	// delivered and at which raft index. Only the run goroutine may touch
+	// it; reads go through statusReqCh.
+	watchStatuses map[string]WatchStatus
+
+	// watchSources records the effective query source sent for each watch.
+	watchSources *watchSourceRecorder
+
+	// onSnapshot is copied from stateConfig; see the field there for the
+	// contract.
+	onSnapshot func(*ConfigSnapshot)
+
+	// waitForWarm is copied from stateConfig; see the field there for the
+	// contract.
+	waitForWarm bool
+
+	// initialSnap is copied from stateConfig.initialSnapshot; see the field
+	// there for the contract.
+	initialSnap *ConfigSnapshot
+
+	// generation is the value stamped on the next changed snapshot before it
+	// is sent. Only the run goroutine may touch it.
+	generation uint64
+
+	ch              chan cache.UpdateEvent
+	snapCh          chan ConfigSnapshot
+	reqCh           chan chan *ConfigSnapshot
+	rebuildCh       chan chan error
+	restartCh       chan *restartWatchesReq
+	resetUpstreamCh chan *resetUpstreamReq
+	pauseCh         chan *pauseReq
+	viewReqCh       chan *viewReq
+	statusReqCh     chan chan map[string]WatchStatus
+
+	// watchDiagCh is the request channel backing WatchDiagnostics, answered
+	// from the run loop like reqCh and statusReqCh.
+	watchDiagCh chan chan []WatchInfo
+}
+
+// WatchSource describes the query source information sent for a watch: the
+// datacenter the query executes in and the QuerySource used for
+// coordinate-based sorting of its results.
+type WatchSource struct {
+	Datacenter string
+	Source     structs.QuerySource
+}
+
+// watchSourceRecorder sits between the kind handlers and their notifiers and
+// records the effective WatchSource of every watch request, keyed by
+// correlation ID, for the debug watch dump.
+type watchSourceRecorder struct {
+	mu      sync.Mutex
+	sources map[string]WatchSource
+	types   map[string]string
+}
+
+func newWatchSourceRecorder() *watchSourceRecorder {
+	return &watchSourceRecorder{
+		sources: make(map[string]WatchSource),
+		types:   make(map[string]string),
+	}
+}
+
+func (r *watchSourceRecorder) record(correlationID, cacheType string, req cache.Request) {
+	var ws WatchSource
+	switch q := req.(type) {
+	case *structs.DCSpecificRequest:
+		ws = WatchSource{Datacenter: q.Datacenter, Source: q.Source}
+	case *structs.ServiceSpecificRequest:
+		ws = WatchSource{Datacenter: q.Datacenter, Source: q.Source}
+	case *structs.PreparedQueryExecuteRequest:
+		ws = WatchSource{Datacenter: q.Datacenter, Source: q.Source}
+	default:
+		if dcr, ok := req.(interface{ RequestDatacenter() string }); ok {
+			ws.Datacenter = dcr.RequestDatacenter()
+		}
+	}
+	r.mu.Lock()
+	r.sources[correlationID] = ws
+	r.types[correlationID] = cacheType
+	r.mu.Unlock()
+}
+
+func (r *watchSourceRecorder) dumpTypes() map[string]string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	types := make(map[string]string, len(r.types))
+	for id, t := range r.types {
+		types[id] = t
+	}
+	return types
+}
+
+func (r *watchSourceRecorder) dump() map[string]WatchSource {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	sources := make(map[string]WatchSource, len(r.sources))
+	for id, ws := range r.sources {
+		sources[id] = ws
+	}
+	return sources
+}
+
+type sourceRecordingCacheNotifier struct {
+	rec  *watchSourceRecorder
+	next CacheNotifier
+}
+
+func (n *sourceRecordingCacheNotifier) Notify(ctx context.Context, t string, r cache.Request, correlationID string, ch chan<- cache.UpdateEvent) error {
+	n.rec.record(correlationID, t, r)
+	return n.next.Notify(ctx, t, r, correlationID, ch)
+}
+
+// defaultNotifyMaxRetries is how many times a failed watch registration is
+// retried before the error is surfaced, unless overridden in stateConfig.
+const defaultNotifyMaxRetries = 5
+
+const (
+	notifyRetryMinWait = 100 * time.Millisecond
+	notifyRetryMaxWait = 2 * time.Second
+)
+
+// retryingCacheNotifier retries failed watch registrations with exponential
+// backoff so a transient cache error during agent startup does not
+// permanently kill a proxy's config watches. Retries respect ctx, so a
+// stopped state does not keep retrying.
+type retryingCacheNotifier struct {
+	next   CacheNotifier
+	logger hclog.Logger
+
+	// maxRetries caps how many times a failed registration is re-attempted.
+	// Zero selects defaultNotifyMaxRetries.
+	maxRetries int
+
+	// minWait and maxWait bound the backoff between attempts. Zero selects
+	// the package defaults; tests shrink them to keep backoff fast.
+	minWait, maxWait time.Duration
+}
+
+func (n *retryingCacheNotifier) Notify(ctx context.Context, t string, r cache.Request, correlationID string, ch chan<- cache.UpdateEvent) error {
+	maxRetries := n.maxRetries
+	if maxRetries == 0 {
+		maxRetries = defaultNotifyMaxRetries
+	}
+	minWait, maxWait := n.minWait, n.maxWait
+	if minWait == 0 {
+		minWait = notifyRetryMinWait
+	}
+	if maxWait == 0 {
+		maxWait = notifyRetryMaxWait
+	}
+	waiter := &retry.Waiter{MinWait: minWait, MaxWait: maxWait, Factor: minWait}
+
+	var err error
+	for attempt := 0; ; attempt++ {
+		if err = n.next.Notify(ctx, t, r, correlationID, ch); err == nil {
+			return nil
+		}
+		if attempt == maxRetries {
+			return err
+		}
+		n.logger.Warn("watch registration failed, retrying",
+			"id", correlationID, "attempt", attempt+1, "error", err,
+		)
+		if werr := waiter.Wait(ctx); werr != nil {
+			return werr
+		}
+	}
+}
+
+// defaultWatchRateInterval is the window watchRateLimit applies to unless
+// overridden in stateConfig.
+const defaultWatchRateInterval = time.Second
+
+// rateLimitingCacheNotifier bounds how many watch registrations are started
+// per interval so a proxy with many upstreams does not fire that many
+// blocking queries at the servers at once. Waiting respects ctx, so a
+// stopped state does not sit out the remainder of a window.
+type rateLimitingCacheNotifier struct {
+	next     CacheNotifier
+	limit    int
+	interval time.Duration
+
+	mu          sync.Mutex
+	windowStart time.Time
+	started     int
+}
+
+func (n *rateLimitingCacheNotifier) Notify(ctx context.Context, t string, r cache.Request, correlationID string, ch chan<- cache.UpdateEvent) error {
+	for {
+		n.mu.Lock()
+		now := time.Now()
+		if now.Sub(n.windowStart) >= n.interval {
+			n.windowStart = now
+			n.started = 0
+		}
+		if n.started < n.limit {
+			n.started++
+			n.mu.Unlock()
+			return n.next.Notify(ctx, t, r, correlationID, ch)
+		}
+		wait := n.interval - now.Sub(n.windowStart)
+		n.mu.Unlock()
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(wait):
+		}
+	}
+}
+
+type sourceRecordingHealth struct {
+	rec  *watchSourceRecorder
+	next Health
+}
+
+func (n *sourceRecordingHealth) Notify(ctx context.Context, req structs.ServiceSpecificRequest, correlationID string, ch chan<- cache.UpdateEvent) error {
+	n.rec.record(correlationID, cachetype.HealthServicesName, &req)
+	return n.next.Notify(ctx, req, correlationID, ch)
+}
+
+// WatchStatus records the time a watch last delivered a result and, when the
+// result carried blocking-query metadata, the raft index it was generated
+// at. Comparing the index against the server-side index for the same query
+// shows whether the proxy has caught up with the servers.
+type WatchStatus struct {
+	Index       uint64
+	LastUpdated time.Time
+}
+
+// WatchInfo describes one cache watch registered by a proxy state: the
+// correlation ID it was registered under, the cache type backing it, and
+// when it last delivered a result (zero if it has not yet). It is the unit
+// returned from WatchDiagnostics for debug endpoints.
+type WatchInfo struct {
+	CorrelationID string
+	Type          string
+	LastUpdated   time.Time
 }
 
 type DNSConfig struct {
@@ -96,7 +505,13 @@ type serviceInstance struct {
 	meta            map[string]string
 	taggedAddresses map[string]structs.ServiceAddress
 	proxyCfg        structs.ConnectProxyConfig
-	token           string
+
+	// proxyCfgHash is the content hash of proxyCfg computed at construction,
+	// used by Changed to avoid a deep comparison on every registration
+	// update. Zero means the config could not be hashed.
+	proxyCfgHash uint64
+
+	token string
 }
 
 func copyProxyConfig(ns *structs.NodeService) (structs.ConnectProxyConfig, error) {
@@ -136,20 +551,57 @@ func copyProxyConfig(ns *structs.NodeService) (structs.ConnectProxyConfig, error
 // The returned state needs its required dependencies to be set before Watch
 // can be called.
 func newState(ns *structs.NodeService, token string, config stateConfig) (*state, error) {
-	// 10 is fairly arbitrary here but allow for the 3 mandatory and a
-	// reasonable number of upstream watches to all deliver their initial
-	// messages in parallel without blocking the cache.Notify loops. It's not a
-	// huge deal if we do for a short period so we don't need to be more
-	// conservative to handle larger numbers of upstreams correctly but gives
-	// some head room for normal operation to be non-blocking in most typical
-	// cases.
-	ch := make(chan cache.UpdateEvent, 10)
-
 	s, err := newServiceInstanceFromNodeService(ns, token)
 	if err != nil {
 		return nil, err
 	}
 
+	// 10 allows the 3 mandatory and a reasonable number of upstream watches
+	// to all deliver their initial messages in parallel without blocking the
+	// cache.Notify loops. Proxies with many upstreams get a proportionally
+	// larger buffer so the initial flood of watch results doesn't block
+	// either, capped so a pathological registration can't pin an outsized
+	// allocation. It's not a huge deal if sends do block for a short period
+	// so we don't need to be exact here.
+	bufSize := len(s.proxyCfg.Upstreams)
+	if bufSize < minEventChanBufferSize {
+		bufSize = minEventChanBufferSize
+	}
+	if bufSize > maxEventChanBufferSize {
+		bufSize = maxEventChanBufferSize
+	}
+	ch := make(chan cache.UpdateEvent, bufSize)
+
+	// Record the effective query source of every watch the handlers
+	// register so it can be surfaced in the debug watch dump.
+	watchSources := newWatchSourceRecorder()
+	if config.cache != nil {
+		config.cache = &retryingCacheNotifier{
+			next:       config.cache,
+			logger:     config.logger,
+			maxRetries: config.notifyMaxRetries,
+		}
+		if config.watchRateLimit > 0 {
+			interval := config.watchRateInterval
+			if interval == 0 {
+				interval = defaultWatchRateInterval
+			}
+			config.cache = &rateLimitingCacheNotifier{
+				next:     config.cache,
+				limit:    config.watchRateLimit,
+				interval: interval,
+			}
+		}
+		config.cache = &sourceRecordingCacheNotifier{rec: watchSources, next: config.cache}
+	}
+	if config.health != nil {
+		config.health = &sourceRecordingHealth{rec: watchSources, next: config.health}
+	}
+
+	if config.dedupEndpoints {
+		config.endpointInterner = newCSNInterner()
+	}
+
 	var handler kindHandler
 	h := handlerState{stateConfig: config, serviceInstance: s, ch: ch}
 
@@ -165,16 +617,61 @@ func newState(ns *structs.NodeService, token string, config stateConfig) (*state
 	case structs.ServiceKindIngressGateway:
 		handler = &handlerIngressGateway{handlerState: h}
 	default:
+		// TODO: handle the api-gateway kind here once the service kind and
+		// its config entries (api-gateway, bound routes) exist in this tree.
 		return nil, errors.New("not a connect-proxy, terminating-gateway, mesh-gateway, or ingress-gateway")
 	}
 
+	if config.coalesceTimeout < 0 {
+		return nil, fmt.Errorf("invalid coalesce timeout: %v", config.coalesceTimeout)
+	}
+	if config.snapshotBufferSize < 0 {
+		return nil, fmt.Errorf("invalid snapshot buffer size: %d", config.snapshotBufferSize)
+	}
+	if config.watchRateLimit < 0 {
+		return nil, fmt.Errorf("invalid watch rate limit: %d", config.watchRateLimit)
+	}
+	if config.watchRateInterval < 0 {
+		return nil, fmt.Errorf("invalid watch rate interval: %v", config.watchRateInterval)
+	}
+	snapshotBufferSize := config.snapshotBufferSize
+	if snapshotBufferSize == 0 {
+		snapshotBufferSize = 1
+	}
+
+	// Gateways process large service-list driven bursts of updates so they
+	// batch more aggressively by default than connect and ingress proxies.
+	coalesceWindow := config.coalesceTimeout
+	if coalesceWindow == 0 {
+		switch ns.Kind {
+		case structs.ServiceKindMeshGateway, structs.ServiceKindTerminatingGateway:
+			coalesceWindow = gatewayCoalesceTimeout
+		default:
+			coalesceWindow = coalesceTimeout
+		}
+	}
+
 	return &state{
 		logger:          config.logger.With("proxy", s.proxyID, "kind", s.kind),
 		serviceInstance: s,
+		coalesceWindow:  coalesceWindow,
+		clock:           realClock{},
 		handler:         handler,
 		ch:              ch,
-		snapCh:          make(chan ConfigSnapshot, 1),
+		snapCh:          make(chan ConfigSnapshot, snapshotBufferSize),
 		reqCh:           make(chan chan *ConfigSnapshot, 1),
+		rebuildCh:       make(chan chan error, 1),
+		restartCh:       make(chan *restartWatchesReq, 1),
+		resetUpstreamCh: make(chan *resetUpstreamReq, 1),
+		pauseCh:         make(chan *pauseReq, 1),
+		viewReqCh:       make(chan *viewReq, 1),
+		watchStatuses:   make(map[string]WatchStatus),
+		watchSources:    watchSources,
+		statusReqCh:     make(chan chan map[string]WatchStatus, 1),
+		watchDiagCh:     make(chan chan []WatchInfo, 1),
+		onSnapshot:      config.onSnapshot,
+		waitForWarm:     config.waitForWarm,
+		initialSnap:     config.initialSnapshot,
 	}, nil
 }
 
@@ -203,13 +700,26 @@ func newServiceInstanceFromNodeService(ns *structs.NodeService, token string) (s
 		meta:            meta,
 		taggedAddresses: taggedAddresses,
 		proxyCfg:        proxyCfg,
+		proxyCfgHash:    hashProxyConfig(proxyCfg),
 		token:           token,
 	}, nil
 }
 
+// hashProxyConfig returns a content hash of the proxy config. Zero means the
+// config could not be hashed and comparisons must fall back to a deep
+// comparison.
+func hashProxyConfig(cfg structs.ConnectProxyConfig) uint64 {
+	h, err := hashstructure.Hash(cfg, nil)
+	if err != nil {
+		return 0
+	}
+	return h
+}
+
 type kindHandler interface {
 	initialize(ctx context.Context) (ConfigSnapshot, error)
 	handleUpdate(ctx context.Context, u cache.UpdateEvent, snap *ConfigSnapshot) error
+	setToken(token string)
 }
 
 // Watch initialized watches on all necessary cache data for the current proxy
@@ -219,8 +729,9 @@ type kindHandler interface {
 func (s *state) Watch() (<-chan ConfigSnapshot, error) {
 	var ctx context.Context
 	ctx, s.cancel = context.WithCancel(context.Background())
+	s.watchCtx, s.watchCancel = context.WithCancel(ctx)
 
-	snap, err := s.handler.initialize(ctx)
+	snap, err := s.handler.initialize(s.watchCtx)
 	if err != nil {
 		s.cancel()
 		return nil, err
@@ -245,8 +756,39 @@ type handlerState struct {
 	ch              chan cache.UpdateEvent
 }
 
+// watchQueryOptions builds the QueryOptions for a generated watch request:
+// the staleness tuning from defaultQueryOptions with the state's token
+// applied. Call sites layer request-specific fields like Filter or a
+// tighter MaxAge on top.
+func (s *handlerState) watchQueryOptions() structs.QueryOptions {
+	d := s.stateConfig.defaultQueryOptions
+	return structs.QueryOptions{
+		Token:        s.serviceInstance.token,
+		AllowStale:   d.AllowStale,
+		MaxAge:       d.MaxAge,
+		StaleIfError: d.StaleIfError,
+	}
+}
+
+// setToken swaps the ACL token used by every watch the handler registers.
+// It must only be called from the run goroutine between watch generations,
+// i.e. after the old watches were cancelled and before initialize runs again.
+func (s *handlerState) setToken(token string) {
+	s.serviceInstance.token = token
+}
+
 type handlerMeshGateway struct {
 	handlerState
+
+	// serviceFilter restricts which catalog services get a connect-service
+	// watch. It is parsed from the gateway's proxy config during initialize
+	// and is nil when no filter is configured.
+	serviceFilter *bexpr.Filter
+
+	// allowedNamespaces restricts connect-service watches to services in
+	// these namespaces. It is parsed from the gateway's proxy config during
+	// initialize and is nil when no restriction is configured.
+	allowedNamespaces map[string]struct{}
 }
 
 type handlerTerminatingGateway struct {
@@ -264,12 +806,12 @@ type handlerIngressGateway struct {
 func (s *handlerUpstreams) watchMeshGateway(ctx context.Context, dc string, upstreamID string) error {
 	return s.cache.Notify(ctx, cachetype.InternalServiceDumpName, &structs.ServiceDumpRequest{
 		Datacenter:     dc,
-		QueryOptions:   structs.QueryOptions{Token: s.token},
+		QueryOptions:   s.watchQueryOptions(),
 		ServiceKind:    structs.ServiceKindMeshGateway,
 		UseServiceKind: true,
 		Source:         *s.source,
 		EnterpriseMeta: *structs.DefaultEnterpriseMeta(),
-	}, "mesh-gateway:"+dc+":"+upstreamID, s.ch)
+	}, makeColonID("mesh-gateway:", dc, upstreamID), s.ch)
 }
 
 type handlerUpstreams struct {
@@ -277,12 +819,11 @@ type handlerUpstreams struct {
 }
 
 func (s *handlerUpstreams) watchConnectProxyService(ctx context.Context, correlationId string, target *structs.DiscoveryTarget) error {
+	qOpts := s.watchQueryOptions()
+	qOpts.Filter = target.Subset.Filter
 	return s.stateConfig.cache.Notify(ctx, cachetype.HealthServicesName, &structs.ServiceSpecificRequest{
-		Datacenter: target.Datacenter,
-		QueryOptions: structs.QueryOptions{
-			Token:  s.serviceInstance.token,
-			Filter: target.Subset.Filter,
-		},
+		Datacenter:   target.Datacenter,
+		QueryOptions: qOpts,
 		ServiceName: target.Service,
 		Connect:     true,
 		// Note that Identifier doesn't type-prefix for service any more as it's
@@ -299,19 +840,26 @@ func (s *handlerConnectProxy) initialize(ctx context.Context) (ConfigSnapshot, e
 	snap := newConfigSnapshotFromServiceInstance(s.serviceInstance, s.stateConfig)
 	snap.ConnectProxy.DiscoveryChain = make(map[string]*structs.CompiledDiscoveryChain)
 	snap.ConnectProxy.WatchedDiscoveryChains = make(map[string]context.CancelFunc)
+	snap.ConnectProxy.ChainWatchKeys = make(map[string]string)
+	snap.ConnectProxy.WatchedChainsByKey = make(map[string]*sharedChainWatch)
 	snap.ConnectProxy.WatchedUpstreams = make(map[string]map[string]context.CancelFunc)
 	snap.ConnectProxy.WatchedUpstreamEndpoints = make(map[string]map[string]structs.CheckServiceNodes)
 	snap.ConnectProxy.WatchedGateways = make(map[string]map[string]context.CancelFunc)
 	snap.ConnectProxy.WatchedGatewayEndpoints = make(map[string]map[string]structs.CheckServiceNodes)
 	snap.ConnectProxy.WatchedServiceChecks = make(map[structs.ServiceID][]structs.CheckType)
+	snap.ConnectProxy.WatchedPreparedQueries = make(map[string]context.CancelFunc)
 	snap.ConnectProxy.PreparedQueryEndpoints = make(map[string]structs.CheckServiceNodes)
+	snap.ConnectProxy.PeerUpstreamEndpoints = make(map[string]structs.CheckServiceNodes)
 	snap.ConnectProxy.UpstreamConfig = make(map[string]*structs.Upstream)
+	snap.ConnectProxy.UpstreamLimits = make(map[string]*structs.UpstreamLimits)
 	snap.ConnectProxy.PassthroughUpstreams = make(map[string]ServicePassthroughAddrs)
+	snap.ConnectProxy.PassthroughContributions = make(map[string]map[string]map[string]struct{})
+	snap.ConnectProxy.RoutingConfigVersions = make(map[string]uint64)
 
 	// Watch for root changes
 	err := s.cache.Notify(ctx, cachetype.ConnectCARootName, &structs.DCSpecificRequest{
 		Datacenter:   s.source.Datacenter,
-		QueryOptions: structs.QueryOptions{Token: s.token},
+		QueryOptions: s.watchQueryOptions(),
 		Source:       *s.source,
 	}, rootsWatchID, s.ch)
 	if err != nil {
@@ -332,7 +880,7 @@ func (s *handlerConnectProxy) initialize(ctx context.Context) (ConfigSnapshot, e
 	// Watch for intention updates
 	err = s.cache.Notify(ctx, cachetype.IntentionMatchName, &structs.IntentionQueryRequest{
 		Datacenter:   s.source.Datacenter,
-		QueryOptions: structs.QueryOptions{Token: s.token},
+		QueryOptions: s.watchQueryOptions(),
 		Match: &structs.IntentionQueryMatch{
 			Type: structs.IntentionMatchDestination,
 			Entries: []structs.IntentionMatchEntry{
@@ -363,23 +911,39 @@ func (s *handlerConnectProxy) initialize(ctx context.Context) (ConfigSnapshot, e
 		// When in transparent proxy we will infer upstreams from intentions with this source
 		err := s.cache.Notify(ctx, cachetype.IntentionUpstreamsName, &structs.ServiceSpecificRequest{
 			Datacenter:     s.source.Datacenter,
-			QueryOptions:   structs.QueryOptions{Token: s.token},
+			QueryOptions:   s.watchQueryOptions(),
 			ServiceName:    s.proxyCfg.DestinationServiceName,
 			EnterpriseMeta: structs.NewEnterpriseMeta(s.proxyID.NamespaceOrEmpty()),
 		}, intentionUpstreamsID, s.ch)
 		if err != nil {
 			return snap, err
 		}
+	}
 
-		err = s.cache.Notify(ctx, cachetype.ConfigEntryName, &structs.ConfigEntryQuery{
-			Kind:           structs.MeshConfig,
-			Name:           structs.MeshConfigMesh,
-			Datacenter:     s.source.Datacenter,
-			QueryOptions:   structs.QueryOptions{Token: s.token},
-			EnterpriseMeta: *structs.DefaultEnterpriseMeta(),
-		}, meshConfigEntryID, s.ch)
-		if err != nil {
-			return snap, err
+	// Watch the mesh config entry in all modes. Mesh-wide settings such as
+	// TransparentProxy.MeshDestinationsOnly affect direct proxies too, so
+	// downstream code decides what to use from it. Only transparent mode
+	// blocks snapshot delivery on the first result.
+	err = s.cache.Notify(ctx, cachetype.ConfigEntryName, &structs.ConfigEntryQuery{
+		Kind:           structs.MeshConfig,
+		Name:           structs.MeshConfigMesh,
+		Datacenter:     s.source.Datacenter,
+		QueryOptions:   s.watchQueryOptions(),
+		EnterpriseMeta: *structs.DefaultEnterpriseMeta(),
+	}, meshConfigEntryID, s.ch)
+	if err != nil {
+		return snap, err
+	}
+
+	// When enabled, the wildcard upstream's opaque config acts as a local
+	// fallback for every explicit upstream below.
+	var wildcardDefaults map[string]interface{}
+	if s.mergeUpstreamDefaults {
+		for i := range s.proxyCfg.Upstreams {
+			if s.proxyCfg.Upstreams[i].DestinationName == structs.WildcardSpecifier {
+				wildcardDefaults = s.proxyCfg.Upstreams[i].Config
+				break
+			}
 		}
 	}
 
@@ -404,6 +968,32 @@ func (s *handlerConnectProxy) initialize(ctx context.Context) (ConfigSnapshot, e
 		if u.Datacenter != "" {
 			dc = u.Datacenter
 		}
+
+		// Peered upstream instances are imported from the remote cluster, so
+		// there is no local discovery chain to compile; watch the imported
+		// service's health directly. The intention upstreams watch used in
+		// transparent mode only covers local services, so peered upstreams
+		// are watched here regardless of mode.
+		if u.DestinationPeer != "" {
+			ns := currentNamespace
+			if u.DestinationNamespace != "" {
+				ns = u.DestinationNamespace
+			}
+			err := s.health.Notify(ctx, structs.ServiceSpecificRequest{
+				PeerName:       u.DestinationPeer,
+				Datacenter:     dc,
+				QueryOptions:   s.watchQueryOptions(),
+				ServiceName:    u.DestinationName,
+				Connect:        true,
+				EnterpriseMeta: structs.NewEnterpriseMeta(ns),
+				Source:         *s.source,
+			}, upstreamPeerWatchIDPrefix+u.Identifier(), s.ch)
+			if err != nil {
+				return snap, fmt.Errorf("failed to watch peer health for %s: %v", u.Identifier(), err)
+			}
+			continue
+		}
+
 		if s.proxyCfg.Mode == structs.ProxyModeTransparent && (dc == "" || dc == s.source.Datacenter) {
 			// In transparent proxy mode, watches for upstreams in the local DC are handled by the IntentionUpstreams watch.
 			continue
@@ -414,7 +1004,12 @@ func (s *handlerConnectProxy) initialize(ctx context.Context) (ConfigSnapshot, e
 			ns = u.DestinationNamespace
 		}
 
-		cfg, err := parseReducedUpstreamConfig(u.Config)
+		uCfgMap := u.Config
+		if wildcardDefaults != nil {
+			uCfgMap = mergeUpstreamConfigMaps(wildcardDefaults, u.Config)
+		}
+
+		cfg, err := parseReducedUpstreamConfig(uCfgMap)
 		if err != nil {
 			// Don't hard fail on a config typo, just warn. We'll fall back on
 			// the plain discovery chain if there is an error so it's safe to
@@ -424,54 +1019,179 @@ func (s *handlerConnectProxy) initialize(ctx context.Context) (ConfigSnapshot, e
 				"error", err,
 			)
 		}
+		if s.strictUpstreamConfig {
+			warnUnusedUpstreamConfigKeys(s.logger, u.Config, u.Identifier())
+		}
 
 		switch u.DestinationType {
 		case structs.UpstreamDestTypePreparedQuery:
-			err = s.cache.Notify(ctx, cachetype.PreparedQueryName, &structs.PreparedQueryExecuteRequest{
+			pollInterval := defaultPreparedQueryPollInterval
+			if cfg.PreparedQueryPollInterval > 0 {
+				if cfg.PreparedQueryPollInterval < minPreparedQueryPollInterval {
+					s.logger.Warn("prepared query poll interval too low, clamping",
+						"upstream", u.Identifier(),
+						"configured", cfg.PreparedQueryPollInterval,
+						"minimum", minPreparedQueryPollInterval,
+					)
+					cfg.PreparedQueryPollInterval = minPreparedQueryPollInterval
+				}
+				pollInterval = cfg.PreparedQueryPollInterval
+			}
+
+			// Watch with a cancellable child context so the poll can be
+			// stopped if the upstream is later removed.
+			pqCtx, cancel := context.WithCancel(ctx)
+			pqOpts := s.watchQueryOptions()
+			pqOpts.MaxAge = pollInterval
+			err = s.cache.Notify(pqCtx, cachetype.PreparedQueryName, &structs.PreparedQueryExecuteRequest{
 				Datacenter:    dc,
-				QueryOptions:  structs.QueryOptions{Token: s.token, MaxAge: defaultPreparedQueryPollInterval},
+				QueryOptions:  pqOpts,
 				QueryIDOrName: u.DestinationName,
 				Connect:       true,
 				Source:        *s.source,
 			}, "upstream:"+u.Identifier(), s.ch)
 			if err != nil {
+				cancel()
 				return snap, err
 			}
+			snap.ConnectProxy.WatchedPreparedQueries[u.Identifier()] = cancel
+
+			// Cross-DC prepared queries can route through mesh gateways the
+			// same way service upstreams do, so watch the gateway endpoints
+			// for the effective mode and let xDS pick them up.
+			if dc != "" && dc != s.source.Datacenter {
+				var gwDC string
+				switch s.proxyCfg.MeshGateway.OverlayWith(u.MeshGateway).Mode {
+				case structs.MeshGatewayModeRemote:
+					gwDC = dc
+				case structs.MeshGatewayModeLocal:
+					gwDC = s.source.Datacenter
+				}
+				if gwDC != "" {
+					up := &handlerUpstreams{handlerState: s.handlerState}
+					gwCtx, gwCancel := context.WithCancel(ctx)
+					if err := up.watchMeshGateway(gwCtx, gwDC, u.Identifier()); err != nil {
+						gwCancel()
+						return snap, err
+					}
+					if snap.ConnectProxy.WatchedGateways[u.Identifier()] == nil {
+						snap.ConnectProxy.WatchedGateways[u.Identifier()] = make(map[string]context.CancelFunc)
+					}
+					snap.ConnectProxy.WatchedGateways[u.Identifier()][gwDC] = gwCancel
+					snap.ConnectProxy.recomputeWatchCounts()
+				}
+			}
 
 		case structs.UpstreamDestTypeService:
 			fallthrough
 
 		case "": // Treat unset as the default Service type
 			err = s.cache.Notify(ctx, cachetype.CompiledDiscoveryChainName, &structs.DiscoveryChainRequest{
-				Datacenter:             s.source.Datacenter,
-				QueryOptions:           structs.QueryOptions{Token: s.token},
-				Name:                   u.DestinationName,
-				EvaluateInDatacenter:   dc,
-				EvaluateInNamespace:    ns,
-				OverrideMeshGateway:    s.proxyCfg.MeshGateway.OverlayWith(u.MeshGateway),
-				OverrideProtocol:       cfg.Protocol,
-				OverrideConnectTimeout: cfg.ConnectTimeout(),
+				Datacenter:                 s.source.Datacenter,
+				QueryOptions:               s.watchQueryOptions(),
+				Name:                       u.DestinationName,
+				EvaluateInDatacenter:       dc,
+				EvaluateInNamespace:        ns,
+				OverrideMeshGateway:        s.proxyCfg.MeshGateway.OverlayWith(u.MeshGateway),
+				OverrideProtocol:           cfg.Protocol,
+				OverrideConnectTimeout:     cfg.ConnectTimeout(),
+				OverrideLimits:             cfg.Limits,
+				OverridePassiveHealthCheck: cfg.PassiveHealthCheck,
 			}, "discovery-chain:"+u.Identifier(), s.ch)
 			if err != nil {
 				return snap, fmt.Errorf("failed to watch discovery chain for %s: %v", u.Identifier(), err)
 			}
 
+			// Also watch the raw routing entries so operators can correlate
+			// route changes with the config entry that triggered them.
+			for _, kind := range []string{structs.ServiceRouter, structs.ServiceSplitter} {
+				err = s.cache.Notify(ctx, cachetype.ConfigEntryName, &structs.ConfigEntryQuery{
+					Kind:           kind,
+					Name:           u.DestinationName,
+					Datacenter:     s.source.Datacenter,
+					QueryOptions:   s.watchQueryOptions(),
+					EnterpriseMeta: structs.NewEnterpriseMeta(ns),
+				}, kind+":"+u.DestinationName, s.ch)
+				if err != nil {
+					return snap, fmt.Errorf("failed to watch %s for %s: %v", kind, u.Identifier(), err)
+				}
+			}
+
 		default:
 			return snap, fmt.Errorf("unknown upstream type: %q", u.DestinationType)
 		}
 	}
 
+	// Resolve the typed limits now that both the wildcard defaults and all
+	// per-upstream configs are known.
+	for id, u := range snap.ConnectProxy.UpstreamConfig {
+		if u.DestinationName == structs.WildcardSpecifier {
+			continue
+		}
+		if limits := resolveUpstreamLimits(s.logger, snap.ConnectProxy.UpstreamConfig, id); limits != nil {
+			snap.ConnectProxy.UpstreamLimits[id] = limits
+		}
+	}
+
 	return snap, nil
 }
 
+// resolveUpstreamLimits returns the typed limits for the given upstream by
+// layering its own "limits" config over the wildcard defaults, if any.
+// Fields set on the upstream win; unset fields fall back to the default.
+func resolveUpstreamLimits(logger hclog.Logger, upstreamConfig map[string]*structs.Upstream, id string) *structs.UpstreamLimits {
+	parse := func(u *structs.Upstream) *structs.UpstreamLimits {
+		if u == nil {
+			return nil
+		}
+		cfg, err := structs.ParseUpstreamConfigNoDefaults(u.Config)
+		if err != nil {
+			// Don't hard fail on a config typo, just warn. The upstream
+			// simply ends up without typed limits.
+			logger.Warn("failed to parse upstream limits",
+				"upstream", id,
+				"error", err,
+			)
+			return nil
+		}
+		return cfg.Limits.Clone()
+	}
+
+	wildcardSID := structs.NewServiceID(structs.WildcardSpecifier, structs.WildcardEnterpriseMeta())
+	merged := parse(upstreamConfig[wildcardSID.String()])
+	override := parse(upstreamConfig[id])
+	if override == nil {
+		return merged
+	}
+	if merged == nil {
+		return override
+	}
+	if override.MaxConnections != nil {
+		merged.MaxConnections = override.MaxConnections
+	}
+	if override.MaxPendingRequests != nil {
+		merged.MaxPendingRequests = override.MaxPendingRequests
+	}
+	if override.MaxConcurrentRequests != nil {
+		merged.MaxConcurrentRequests = override.MaxConcurrentRequests
+	}
+	return merged
+}
+
 // reducedUpstreamConfig represents the basic opaque config values that are now
 // managed with the discovery chain but for backwards compatibility reasons
 // should still affect how the proxy is configured.
 //
 // The full-blown config is agent/xds.UpstreamConfig
 type reducedUpstreamConfig struct {
-	Protocol         string `mapstructure:"protocol"`
-	ConnectTimeoutMs int    `mapstructure:"connect_timeout_ms"`
+	Protocol           string                      `mapstructure:"protocol"`
+	ConnectTimeoutMs   int                         `mapstructure:"connect_timeout_ms"`
+	Limits             *structs.UpstreamLimits     `mapstructure:"limits"`
+	PassiveHealthCheck *structs.PassiveHealthCheck `mapstructure:"passive_health_check"`
+
+	// PreparedQueryPollInterval overrides how often a prepared-query
+	// upstream re-executes its query. Zero means the default.
+	PreparedQueryPollInterval time.Duration `mapstructure:"prepared_query_poll_interval"`
 }
 
 func (c *reducedUpstreamConfig) ConnectTimeout() time.Duration {
@@ -480,6 +1200,86 @@ func (c *reducedUpstreamConfig) ConnectTimeout() time.Duration {
 
 func parseReducedUpstreamConfig(m map[string]interface{}) (reducedUpstreamConfig, error) {
 	var cfg reducedUpstreamConfig
+	config := &mapstructure.DecoderConfig{
+		// The alias tags on the nested structs.UpstreamLimits and
+		// structs.PassiveHealthCheck fields only apply through the
+		// translation hook.
+		DecodeHook: mapstructure.ComposeDecodeHookFunc(
+			decode.HookTranslateKeys,
+			mapstructure.StringToTimeDurationHookFunc(),
+		),
+		Result:           &cfg,
+		WeaklyTypedInput: true,
+	}
+	decoder, err := mapstructure.NewDecoder(config)
+	if err != nil {
+		return cfg, err
+	}
+	err = decoder.Decode(m)
+	return cfg, err
+}
+
+// mergeUpstreamConfigMaps overlays an upstream's own opaque config on top of
+// the wildcard defaults; keys the upstream sets itself win.
+func mergeUpstreamConfigMaps(defaults, overrides map[string]interface{}) map[string]interface{} {
+	merged := make(map[string]interface{}, len(defaults)+len(overrides))
+	for k, v := range defaults {
+		merged[k] = v
+	}
+	for k, v := range overrides {
+		merged[k] = v
+	}
+	return merged
+}
+
+// warnUnusedUpstreamConfigKeys strictly decodes an upstream's opaque config
+// against the full structs.UpstreamConfig and warns about any keys left
+// over. It never affects the effective config; parseReducedUpstreamConfig's
+// lenient decode already ran by the time this is called.
+func warnUnusedUpstreamConfigKeys(logger hclog.Logger, m map[string]interface{}, upstreamID string) {
+	var cfg structs.UpstreamConfig
+	config := &mapstructure.DecoderConfig{
+		DecodeHook: mapstructure.ComposeDecodeHookFunc(
+			decode.HookWeakDecodeFromSlice,
+			decode.HookTranslateKeys,
+			mapstructure.StringToTimeDurationHookFunc(),
+		),
+		Result:           &cfg,
+		WeaklyTypedInput: true,
+		ErrorUnused:      true,
+	}
+	decoder, err := mapstructure.NewDecoder(config)
+	if err != nil {
+		return
+	}
+	if err := decoder.Decode(m); err != nil {
+		logger.Warn("upstream config contains unknown keys",
+			"upstream", upstreamID,
+			"error", err,
+		)
+	}
+}
+
+// meshGatewayProxyConfig is the subset of a mesh gateway's opaque proxy
+// config understood by proxycfg.
+type meshGatewayProxyConfig struct {
+	// ConnectServicesOnly restricts connect-service watches to services that
+	// are known to have connect proxy instances, instead of every service in
+	// the catalog.
+	ConnectServicesOnly bool `mapstructure:"mesh_gateway_connect_services_only"`
+
+	// ServiceFilter is a go-bexpr expression evaluated against each
+	// structs.ServiceName from the catalog list; only matching services get
+	// a connect-service watch.
+	ServiceFilter string `mapstructure:"mesh_gateway_service_filter"`
+
+	// AllowedNamespaces restricts connect-service watches to services in the
+	// listed namespaces. Empty means every namespace is exported.
+	AllowedNamespaces []string `mapstructure:"mesh_gateway_allowed_namespaces"`
+}
+
+func parseMeshGatewayConfig(m map[string]interface{}) (meshGatewayProxyConfig, error) {
+	var cfg meshGatewayProxyConfig
 	err := mapstructure.WeakDecode(m, &cfg)
 	return cfg, err
 }
@@ -487,10 +1287,29 @@ func parseReducedUpstreamConfig(m map[string]interface{}) (reducedUpstreamConfig
 // initWatchesTerminatingGateway sets up the initial watches needed based on the terminating-gateway registration
 func (s *handlerTerminatingGateway) initialize(ctx context.Context) (ConfigSnapshot, error) {
 	snap := newConfigSnapshotFromServiceInstance(s.serviceInstance, s.stateConfig)
+
+	// Initialize the maps before any watch registration so a snapshot from
+	// a partially failed initialize is still consistent: a retry or an
+	// inspecting caller must not trip over nil maps.
+	snap.TerminatingGateway.WatchedServices = make(map[structs.ServiceName]context.CancelFunc)
+	snap.TerminatingGateway.WatchedIntentions = make(map[structs.ServiceName]context.CancelFunc)
+	snap.TerminatingGateway.Intentions = make(map[structs.ServiceName]structs.Intentions)
+	snap.TerminatingGateway.WatchedLeaves = make(map[structs.ServiceName]context.CancelFunc)
+	snap.TerminatingGateway.ServiceLeaves = make(map[structs.ServiceName]*structs.IssuedCert)
+	snap.TerminatingGateway.WatchedConfigs = make(map[structs.ServiceName]context.CancelFunc)
+	snap.TerminatingGateway.ServiceConfigs = make(map[structs.ServiceName]*structs.ServiceConfigResponse)
+	snap.TerminatingGateway.WatchedResolvers = make(map[structs.ServiceName]context.CancelFunc)
+	snap.TerminatingGateway.ServiceResolvers = make(map[structs.ServiceName]*structs.ServiceResolverConfigEntry)
+	snap.TerminatingGateway.ServiceResolversSet = make(map[structs.ServiceName]bool)
+	snap.TerminatingGateway.ServiceGroups = make(map[structs.ServiceName]structs.CheckServiceNodes)
+	snap.TerminatingGateway.ServiceGroupLastUpdated = make(map[structs.ServiceName]time.Time)
+	snap.TerminatingGateway.GatewayServices = make(map[structs.ServiceName]structs.GatewayService)
+	snap.TerminatingGateway.HostnameServices = make(map[structs.ServiceName]structs.CheckServiceNodes)
+
 	// Watch for root changes
 	err := s.cache.Notify(ctx, cachetype.ConnectCARootName, &structs.DCSpecificRequest{
 		Datacenter:   s.source.Datacenter,
-		QueryOptions: structs.QueryOptions{Token: s.token},
+		QueryOptions: s.watchQueryOptions(),
 		Source:       *s.source,
 	}, rootsWatchID, s.ch)
 	if err != nil {
@@ -501,7 +1320,7 @@ func (s *handlerTerminatingGateway) initialize(ctx context.Context) (ConfigSnaps
 	// Watch for the terminating-gateway's linked services
 	err = s.cache.Notify(ctx, cachetype.GatewayServicesName, &structs.ServiceSpecificRequest{
 		Datacenter:     s.source.Datacenter,
-		QueryOptions:   structs.QueryOptions{Token: s.token},
+		QueryOptions:   s.watchQueryOptions(),
 		ServiceName:    s.service,
 		EnterpriseMeta: s.proxyID.EnterpriseMeta,
 	}, gatewayServicesWatchID, s.ch)
@@ -510,29 +1329,29 @@ func (s *handlerTerminatingGateway) initialize(ctx context.Context) (ConfigSnaps
 		return snap, err
 	}
 
-	snap.TerminatingGateway.WatchedServices = make(map[structs.ServiceName]context.CancelFunc)
-	snap.TerminatingGateway.WatchedIntentions = make(map[structs.ServiceName]context.CancelFunc)
-	snap.TerminatingGateway.Intentions = make(map[structs.ServiceName]structs.Intentions)
-	snap.TerminatingGateway.WatchedLeaves = make(map[structs.ServiceName]context.CancelFunc)
-	snap.TerminatingGateway.ServiceLeaves = make(map[structs.ServiceName]*structs.IssuedCert)
-	snap.TerminatingGateway.WatchedConfigs = make(map[structs.ServiceName]context.CancelFunc)
-	snap.TerminatingGateway.ServiceConfigs = make(map[structs.ServiceName]*structs.ServiceConfigResponse)
-	snap.TerminatingGateway.WatchedResolvers = make(map[structs.ServiceName]context.CancelFunc)
-	snap.TerminatingGateway.ServiceResolvers = make(map[structs.ServiceName]*structs.ServiceResolverConfigEntry)
-	snap.TerminatingGateway.ServiceResolversSet = make(map[structs.ServiceName]bool)
-	snap.TerminatingGateway.ServiceGroups = make(map[structs.ServiceName]structs.CheckServiceNodes)
-	snap.TerminatingGateway.GatewayServices = make(map[structs.ServiceName]structs.GatewayService)
-	snap.TerminatingGateway.HostnameServices = make(map[structs.ServiceName]structs.CheckServiceNodes)
 	return snap, nil
 }
 
 // initWatchesMeshGateway sets up the watches needed based on the current mesh gateway registration
 func (s *handlerMeshGateway) initialize(ctx context.Context) (ConfigSnapshot, error) {
 	snap := newConfigSnapshotFromServiceInstance(s.serviceInstance, s.stateConfig)
+
+	// Initialize the maps before any watch registration so a snapshot from
+	// a partially failed initialize has no nil maps; see the terminating
+	// gateway handler for the rationale.
+	snap.MeshGateway.WatchedServices = make(map[structs.ServiceName]context.CancelFunc)
+	snap.MeshGateway.WatchedDatacenters = make(map[string]context.CancelFunc)
+	snap.MeshGateway.ServiceGroups = make(map[structs.ServiceName]structs.CheckServiceNodes)
+	snap.MeshGateway.ServiceGroupLastUpdated = make(map[structs.ServiceName]time.Time)
+	snap.MeshGateway.GatewayGroups = make(map[string]structs.CheckServiceNodes)
+	snap.MeshGateway.GatewayGroupLastUpdated = make(map[string]time.Time)
+	snap.MeshGateway.ServiceResolvers = make(map[structs.ServiceName]*structs.ServiceResolverConfigEntry)
+	snap.MeshGateway.HostnameDatacenters = make(map[string]structs.CheckServiceNodes)
+
 	// Watch for root changes
 	err := s.cache.Notify(ctx, cachetype.ConnectCARootName, &structs.DCSpecificRequest{
 		Datacenter:   s.source.Datacenter,
-		QueryOptions: structs.QueryOptions{Token: s.token},
+		QueryOptions: s.watchQueryOptions(),
 		Source:       *s.source,
 	}, rootsWatchID, s.ch)
 	if err != nil {
@@ -542,7 +1361,7 @@ func (s *handlerMeshGateway) initialize(ctx context.Context) (ConfigSnapshot, er
 	// Watch for all services
 	err = s.cache.Notify(ctx, cachetype.CatalogServiceListName, &structs.DCSpecificRequest{
 		Datacenter:     s.source.Datacenter,
-		QueryOptions:   structs.QueryOptions{Token: s.token},
+		QueryOptions:   s.watchQueryOptions(),
 		Source:         *s.source,
 		EnterpriseMeta: *structs.WildcardEnterpriseMeta(),
 	}, serviceListWatchID, s.ch)
@@ -551,13 +1370,69 @@ func (s *handlerMeshGateway) initialize(ctx context.Context) (ConfigSnapshot, er
 		return snap, err
 	}
 
+	gwCfg, err := parseMeshGatewayConfig(s.proxyCfg.Config)
+	if err != nil {
+		// Don't hard fail on a config typo, just warn and fall back on
+		// watching every catalog service.
+		s.logger.Named(logging.MeshGateway).
+			Warn("failed to parse mesh gateway config", "error", err)
+	}
+	if gwCfg.ServiceFilter != "" {
+		filter, err := bexpr.CreateFilter(gwCfg.ServiceFilter, nil, []structs.ServiceName{})
+		if err != nil {
+			// An unparseable filter falls back on exporting everything, the
+			// same stance taken on other config typos above.
+			s.logger.Named(logging.MeshGateway).
+				Warn("failed to parse mesh gateway service filter", "error", err)
+		} else {
+			s.serviceFilter = filter
+		}
+	}
+	if len(gwCfg.AllowedNamespaces) > 0 {
+		s.allowedNamespaces = make(map[string]struct{}, len(gwCfg.AllowedNamespaces))
+		for _, ns := range gwCfg.AllowedNamespaces {
+			s.allowedNamespaces[ns] = struct{}{}
+		}
+	}
+	if gwCfg.ConnectServicesOnly {
+		// Track which services actually have connect proxy instances so the
+		// per-service watches can be limited to them. A non-nil (even empty)
+		// set turns the filter on.
+		snap.MeshGateway.ConnectServices = make(map[structs.ServiceName]struct{})
+		err = s.cache.Notify(ctx, cachetype.InternalServiceDumpName, &structs.ServiceDumpRequest{
+			Datacenter:     s.source.Datacenter,
+			QueryOptions:   s.watchQueryOptions(),
+			ServiceKind:    structs.ServiceKindConnectProxy,
+			UseServiceKind: true,
+			Source:         *s.source,
+			EnterpriseMeta: *structs.WildcardEnterpriseMeta(),
+		}, connectKindServicesWatchID, s.ch)
+		if err != nil {
+			return snap, err
+		}
+
+		// Connect-native services have no proxy instance to show up in the
+		// dump above, so watch the full dump as well and pick out instances
+		// flagged as native.
+		snap.MeshGateway.ConnectNativeServices = make(map[structs.ServiceName]struct{})
+		err = s.cache.Notify(ctx, cachetype.InternalServiceDumpName, &structs.ServiceDumpRequest{
+			Datacenter:     s.source.Datacenter,
+			QueryOptions:   s.watchQueryOptions(),
+			Source:         *s.source,
+			EnterpriseMeta: *structs.WildcardEnterpriseMeta(),
+		}, connectNativeServicesWatchID, s.ch)
+		if err != nil {
+			return snap, err
+		}
+	}
+
 	if s.meta[structs.MetaWANFederationKey] == "1" {
 		// Conveniently we can just use this service meta attribute in one
 		// place here to set the machinery in motion and leave the conditional
 		// behavior out of the rest of the package.
 		err = s.cache.Notify(ctx, cachetype.FederationStateListMeshGatewaysName, &structs.DCSpecificRequest{
 			Datacenter:   s.source.Datacenter,
-			QueryOptions: structs.QueryOptions{Token: s.token},
+			QueryOptions: s.watchQueryOptions(),
 			Source:       *s.source,
 		}, federationStateListGatewaysWatchID, s.ch)
 		if err != nil {
@@ -566,7 +1441,7 @@ func (s *handlerMeshGateway) initialize(ctx context.Context) (ConfigSnapshot, er
 
 		err = s.health.Notify(ctx, structs.ServiceSpecificRequest{
 			Datacenter:   s.source.Datacenter,
-			QueryOptions: structs.QueryOptions{Token: s.token},
+			QueryOptions: s.watchQueryOptions(),
 			ServiceName:  structs.ConsulServiceName,
 		}, consulServerListWatchID, s.ch)
 		if err != nil {
@@ -579,11 +1454,14 @@ func (s *handlerMeshGateway) initialize(ctx context.Context) (ConfigSnapshot, er
 	// cannot setup those watches until we know what the services are. from the service list
 	// watch above
 
-	err = s.cache.Notify(ctx, cachetype.CatalogDatacentersName, &structs.DatacentersRequest{
-		QueryOptions: structs.QueryOptions{Token: s.token, MaxAge: 30 * time.Second},
-	}, datacentersWatchID, s.ch)
-	if err != nil {
-		return snap, err
+	// Cross-DC gateway discovery is driven by the datacenter list watch. A
+	// single-DC deployment with no WAN federation has nothing to discover,
+	// so the watch only starts when something needs it: federation here, or
+	// a service-resolver pointing at a remote datacenter in handleUpdate.
+	if s.meta[structs.MetaWANFederationKey] == "1" {
+		if err := s.watchDatacenters(ctx, &snap); err != nil {
+			return snap, err
+		}
 	}
 
 	// Once we start getting notified about the datacenters we will setup watches on the
@@ -593,7 +1471,7 @@ func (s *handlerMeshGateway) initialize(ctx context.Context) (ConfigSnapshot, er
 	// Watch service-resolvers so we can setup service subset clusters
 	err = s.cache.Notify(ctx, cachetype.ConfigEntriesName, &structs.ConfigEntryQuery{
 		Datacenter:     s.source.Datacenter,
-		QueryOptions:   structs.QueryOptions{Token: s.token},
+		QueryOptions:   s.watchQueryOptions(),
 		Kind:           structs.ServiceResolver,
 		EnterpriseMeta: *structs.WildcardEnterpriseMeta(),
 	}, serviceResolversWatchID, s.ch)
@@ -603,12 +1481,6 @@ func (s *handlerMeshGateway) initialize(ctx context.Context) (ConfigSnapshot, er
 		return snap, err
 	}
 
-	snap.MeshGateway.WatchedServices = make(map[structs.ServiceName]context.CancelFunc)
-	snap.MeshGateway.WatchedDatacenters = make(map[string]context.CancelFunc)
-	snap.MeshGateway.ServiceGroups = make(map[structs.ServiceName]structs.CheckServiceNodes)
-	snap.MeshGateway.GatewayGroups = make(map[string]structs.CheckServiceNodes)
-	snap.MeshGateway.ServiceResolvers = make(map[structs.ServiceName]*structs.ServiceResolverConfigEntry)
-	snap.MeshGateway.HostnameDatacenters = make(map[string]structs.CheckServiceNodes)
 	// there is no need to initialize the map of service resolvers as we
 	// fully rebuild it every time we get updates
 	return snap, err
@@ -616,10 +1488,24 @@ func (s *handlerMeshGateway) initialize(ctx context.Context) (ConfigSnapshot, er
 
 func (s *handlerIngressGateway) initialize(ctx context.Context) (ConfigSnapshot, error) {
 	snap := newConfigSnapshotFromServiceInstance(s.serviceInstance, s.stateConfig)
+
+	// Initialize the maps before any watch registration so a snapshot from
+	// a partially failed initialize has no nil maps; see the terminating
+	// gateway handler for the rationale.
+	snap.IngressGateway.WatchedDiscoveryChains = make(map[string]context.CancelFunc)
+	snap.IngressGateway.DiscoveryChain = make(map[string]*structs.CompiledDiscoveryChain)
+	snap.IngressGateway.WatchedUpstreams = make(map[string]map[string]context.CancelFunc)
+	snap.IngressGateway.WatchedUpstreamEndpoints = make(map[string]map[string]structs.CheckServiceNodes)
+	snap.IngressGateway.WatchedGateways = make(map[string]map[string]context.CancelFunc)
+	snap.IngressGateway.WatchedGatewayEndpoints = make(map[string]map[string]structs.CheckServiceNodes)
+	snap.IngressGateway.ListenerLeaves = make(map[IngressListenerKey]*structs.IssuedCert)
+	snap.IngressGateway.WatchedListenerLeaves = make(map[IngressListenerKey]context.CancelFunc)
+	snap.IngressGateway.WatchedListenerLeafHosts = make(map[IngressListenerKey][]string)
+
 	// Watch for root changes
 	err := s.cache.Notify(ctx, cachetype.ConnectCARootName, &structs.DCSpecificRequest{
 		Datacenter:   s.source.Datacenter,
-		QueryOptions: structs.QueryOptions{Token: s.token},
+		QueryOptions: s.watchQueryOptions(),
 		Source:       *s.source,
 	}, rootsWatchID, s.ch)
 	if err != nil {
@@ -631,7 +1517,7 @@ func (s *handlerIngressGateway) initialize(ctx context.Context) (ConfigSnapshot,
 		Kind:           structs.IngressGateway,
 		Name:           s.service,
 		Datacenter:     s.source.Datacenter,
-		QueryOptions:   structs.QueryOptions{Token: s.token},
+		QueryOptions:   s.watchQueryOptions(),
 		EnterpriseMeta: s.proxyID.EnterpriseMeta,
 	}, gatewayConfigWatchID, s.ch)
 	if err != nil {
@@ -641,7 +1527,7 @@ func (s *handlerIngressGateway) initialize(ctx context.Context) (ConfigSnapshot,
 	// Watch the ingress-gateway's list of upstreams
 	err = s.cache.Notify(ctx, cachetype.GatewayServicesName, &structs.ServiceSpecificRequest{
 		Datacenter:     s.source.Datacenter,
-		QueryOptions:   structs.QueryOptions{Token: s.token},
+		QueryOptions:   s.watchQueryOptions(),
 		ServiceName:    s.service,
 		EnterpriseMeta: s.proxyID.EnterpriseMeta,
 	}, gatewayServicesWatchID, s.ch)
@@ -649,12 +1535,6 @@ func (s *handlerIngressGateway) initialize(ctx context.Context) (ConfigSnapshot,
 		return snap, err
 	}
 
-	snap.IngressGateway.WatchedDiscoveryChains = make(map[string]context.CancelFunc)
-	snap.IngressGateway.DiscoveryChain = make(map[string]*structs.CompiledDiscoveryChain)
-	snap.IngressGateway.WatchedUpstreams = make(map[string]map[string]context.CancelFunc)
-	snap.IngressGateway.WatchedUpstreamEndpoints = make(map[string]map[string]structs.CheckServiceNodes)
-	snap.IngressGateway.WatchedGateways = make(map[string]map[string]context.CancelFunc)
-	snap.IngressGateway.WatchedGatewayEndpoints = make(map[string]map[string]structs.CheckServiceNodes)
 	return snap, nil
 }
 
@@ -689,34 +1569,161 @@ func (s *state) run(ctx context.Context, snap *ConfigSnapshot) {
 	sendCh := make(chan struct{})
 	var coalesceTimer *time.Timer
 
+	// Track how long updates wait before they are delivered as a snapshot and
+	// how many of them coalesce into a single delivery.
+	var batchStart time.Time
+	var batchedUpdates int
+
+	// lastHookGeneration is the generation last passed to the onSnapshot
+	// hook, so redelivery attempts do not invoke it again.
+	var lastHookGeneration uint64
+
+	// snapDirty records whether any updates were incorporated into snap since
+	// its generation was last stamped, so redeliveries of unchanged content
+	// keep their generation.
+	var snapDirty bool
+
+	// dirtySections and lastDelivered let the delivery path skip re-cloning
+	// sections of the snapshot that did not change since the last delivery.
+	var dirtySections snapshotSections
+	var lastDelivered *ConfigSnapshot
+
+	// paused suppresses deliveries while updates keep folding into snap;
+	// see Pause.
+	var paused bool
+
+	// failedDeliveries counts consecutive failed sends on snapCh so a
+	// persistently stuck consumer gets surfaced; see the sendCh case.
+	var failedDeliveries int
+	deliveryLabels := []metrics.Label{
+		{Name: "kind", Value: string(s.serviceInstance.kind)},
+		{Name: "proxy", Value: s.serviceInstance.proxyID.String()},
+	}
+
+	// Tests may run this goroutine directly without going through Watch.
+	if s.watchCtx == nil {
+		s.watchCtx, s.watchCancel = context.WithCancel(ctx)
+	}
+
+	// A seeded snapshot goes out before any watch has delivered so a
+	// restarted agent does not starve its proxy while the caches refill.
+	// The watches keep refreshing in the background and the live snapshot
+	// replaces the seed once it is valid.
+	if s.initialSnap != nil && s.initialSnap.Valid() {
+		seeded, err := s.initialSnap.Clone()
+		if err != nil {
+			s.logger.Error("Failed to copy seeded config snapshot for proxy", "error", err)
+		} else {
+			select {
+			case s.snapCh <- *seeded:
+				s.logger.Debug("Delivered seeded config snapshot to proxy config watchers")
+			default:
+			}
+		}
+	}
+
 	for {
 		select {
 		case <-ctx.Done():
+			// Stop any pending coalesce timer so its callback does not
+			// launch once nothing drains sendCh anymore.
+			if coalesceTimer != nil {
+				coalesceTimer.Stop()
+			}
 			return
 		case u := <-s.ch:
 			s.logger.Trace("A blocking query returned; handling snapshot update")
 
-			if err := s.handler.handleUpdate(ctx, u, snap); err != nil {
+			if u.Err == nil {
+				status := WatchStatus{LastUpdated: time.Now()}
+				if meta, ok := u.Result.(interface{ GetIndex() uint64 }); ok {
+					status.Index = meta.GetIndex()
+				}
+				s.watchStatuses[u.CorrelationID] = status
+			}
+
+			if err := s.handler.handleUpdate(s.watchCtx, u, snap); err != nil {
 				s.logger.Error("Failed to handle update from watch",
 					"id", u.CorrelationID, "error", err,
 				)
+
+				// Record the failure on the snapshot so consumers can tell the
+				// failing watch's data is stale while still using the healthy
+				// sections.
+				if snap.WatchErrors == nil {
+					snap.WatchErrors = make(map[string]string)
+				}
+				snap.WatchErrors[u.CorrelationID] = err.Error()
+				if batchedUpdates == 0 {
+					batchStart = s.clock.Now()
+				}
+				batchedUpdates++
+				snapDirty = true
+				// WatchErrors lives outside the roots section, so even a
+				// failing roots watch needs the full clone on delivery.
+				dirtySections.kind = true
 				continue
 			}
+			delete(snap.WatchErrors, u.CorrelationID)
+
+			if batchedUpdates == 0 {
+				batchStart = s.clock.Now()
+			}
+			batchedUpdates++
+			snapDirty = true
+			dirtySections.markUpdate(u.CorrelationID)
 
 		case <-sendCh:
+			if paused {
+				// A timer armed before Pause was handled; drop the send and
+				// let Resume re-arm delivery.
+				coalesceTimer = nil
+				continue
+			}
+
+			if snapDirty {
+				s.generation++
+				snap.Generation = s.generation
+				snapDirty = false
+			}
+
 			// Make a deep copy of snap so we don't mutate any of the embedded structs
-			// etc on future updates.
-			snapCopy, err := snap.Clone()
+			// etc on future updates. Sections unchanged since the last
+			// delivery are reused from it rather than copied again.
+			snapCopy, err := snap.cloneReusing(lastDelivered, dirtySections)
 			if err != nil {
 				s.logger.Error("Failed to copy config snapshot for proxy", "error", err)
 				continue
 			}
 
+			// Only the first send attempt for a generation runs the hook, so
+			// a blocked snapCh retried later does not replay it.
+			if s.onSnapshot != nil && snapCopy.Generation != lastHookGeneration {
+				s.onSnapshot(snapCopy)
+				lastHookGeneration = snapCopy.Generation
+			}
+
 			select {
 			// Try to send
 			case s.snapCh <- *snapCopy:
 				s.logger.Trace("Delivered new snapshot to proxy config watchers")
 
+				lastDelivered = snapCopy
+				dirtySections = snapshotSections{}
+
+				if failedDeliveries > 0 {
+					failedDeliveries = 0
+					metrics.SetGaugeWithLabels([]string{"proxycfg", "snapshot", "pending_retries"}, 0, deliveryLabels)
+				}
+
+				// A redelivery retry may fire without any new updates having
+				// arrived, in which case there is no latency to record.
+				if batchedUpdates > 0 {
+					metrics.MeasureSinceWithLabels([]string{"proxycfg", "snapshot", "delivery_time"}, batchStart, deliveryLabels)
+					metrics.IncrCounterWithLabels([]string{"proxycfg", "snapshot", "coalesced_updates"}, float32(batchedUpdates), deliveryLabels)
+					batchedUpdates = 0
+				}
+
 				// Allow the next change to trigger a send
 				coalesceTimer = nil
 
@@ -729,13 +1736,28 @@ func (s *state) run(ctx context.Context, snap *ConfigSnapshot) {
 			default:
 				s.logger.Trace("Failed to deliver new snapshot to proxy config watchers")
 
-				// Reset the timer to retry later. This is to ensure we attempt to redeliver the updated snapshot shortly.
-				if coalesceTimer == nil {
-					coalesceTimer = time.AfterFunc(coalesceTimeout, func() {
-						sendCh <- struct{}{}
-					})
+				failedDeliveries++
+				metrics.SetGaugeWithLabels([]string{"proxycfg", "snapshot", "pending_retries"}, float32(failedDeliveries), deliveryLabels)
+				if failedDeliveries >= failedDeliveryWarnThreshold {
+					s.logger.Warn("snapshot delivery to proxy config watchers is persistently failing; the consumer may be stuck",
+						"proxy", s.serviceInstance.proxyID.String(),
+						"failed_attempts", failedDeliveries,
+					)
 				}
 
+				// Reset the timer to retry later. This is to ensure we attempt
+				// to redeliver the updated snapshot shortly. The fired timer
+				// is still referenced by coalesceTimer, so replace it
+				// unconditionally or no retry would ever be scheduled.
+				coalesceTimer = s.clock.AfterFunc(s.coalesceWindow, func() {
+					// Nothing drains sendCh once the loop has returned, so
+					// give up on cancellation instead of leaking.
+					select {
+					case sendCh <- struct{}{}:
+					case <-ctx.Done():
+					}
+				})
+
 				// Do not reset coalesceTimer since we just queued a timer-based refresh
 				continue
 			}
@@ -762,19 +1784,115 @@ func (s *state) run(ctx context.Context, snap *ConfigSnapshot) {
 			// Skip rest of loop - there is nothing to send since nothing changed on
 			// this iteration
 			continue
+
+		case replyCh := <-s.statusReqCh:
+			statuses := make(map[string]WatchStatus, len(s.watchStatuses))
+			for id, status := range s.watchStatuses {
+				statuses[id] = status
+			}
+			replyCh <- statuses
+			continue
+
+		case replyCh := <-s.watchDiagCh:
+			types := s.watchSources.dumpTypes()
+			infos := make([]WatchInfo, 0, len(types))
+			for id, cacheType := range types {
+				infos = append(infos, WatchInfo{
+					CorrelationID: id,
+					Type:          cacheType,
+					LastUpdated:   s.watchStatuses[id].LastUpdated,
+				})
+			}
+			sort.Slice(infos, func(i, j int) bool {
+				return infos[i].CorrelationID < infos[j].CorrelationID
+			})
+			replyCh <- infos
+			continue
+
+		case errCh := <-s.rebuildCh:
+			s.logger.Debug("Rebuilding all watches for proxy")
+
+			// Cancel every watch registered so far and start over against the
+			// current registration. snapCh is untouched so watchers keep
+			// their subscription across the rebuild.
+			s.watchCancel()
+			s.watchCtx, s.watchCancel = context.WithCancel(ctx)
+
+			newSnap, err := s.handler.initialize(s.watchCtx)
+			if err != nil {
+				errCh <- err
+				continue
+			}
+			*snap = newSnap
+			errCh <- nil
+
+		case req := <-s.restartCh:
+			s.logger.Debug("Restarting all watches for proxy with a new token")
+
+			// Cancel every watch registered so far and start over with the
+			// new token. snapCh is untouched so watchers keep their
+			// subscription across the restart.
+			s.watchCancel()
+			s.watchCtx, s.watchCancel = context.WithCancel(ctx)
+
+			s.serviceInstance.token = req.token
+			s.handler.setToken(req.token)
+
+			newSnap, err := s.handler.initialize(s.watchCtx)
+			if err != nil {
+				req.errCh <- err
+				continue
+			}
+
+			// The roots are not ACL-scoped and are replaced wholesale by
+			// their watch, so carrying them over keeps the snapshot valid
+			// while the new watches warm up. Everything else may be
+			// token-dependent and is rebuilt from the new watches.
+			newSnap.Roots = snap.Roots
+			*snap = newSnap
+			req.errCh <- nil
+
+		case req := <-s.resetUpstreamCh:
+			err := s.resetUpstreamWatches(snap, req.id)
+			if err == nil {
+				snapDirty = true
+				dirtySections.kind = true
+			}
+			req.errCh <- err
+
+		case req := <-s.pauseCh:
+			paused = req.pause
+			close(req.doneCh)
+
+		case req := <-s.viewReqCh:
+			// The callback runs on this goroutine so its reads of the live
+			// snapshot are race-free; see CurrentSnapshotView.
+			req.fn(snap)
+			close(req.doneCh)
+			continue
 		}
 
 		// Check if snap is complete enough to be a valid config to deliver to a
 		// proxy yet.
-		if snap.Valid() {
+		deliverable := snap.Valid() && !paused
+		if deliverable && s.waitForWarm && lastDelivered == nil {
+			// Hold only the very first delivery back until every watched
+			// upstream target has reported endpoints as well.
+			deliverable = snap.Warm()
+		}
+		if deliverable {
 			// Don't send it right away, set a short timer that will wait for updates
 			// from any of the other cache values and deliver them all together.
 			if coalesceTimer == nil {
-				coalesceTimer = time.AfterFunc(coalesceTimeout, func() {
+				coalesceTimer = s.clock.AfterFunc(s.coalesceWindow, func() {
 					// This runs in another goroutine so we can't just do the send
 					// directly here as access to snap is racy. Instead, signal the main
-					// loop above.
-					sendCh <- struct{}{}
+					// loop above. Bail out on cancellation so a timer that fires
+					// after the loop returned does not leak this goroutine.
+					select {
+					case sendCh <- struct{}{}:
+					case <-ctx.Done():
+					}
 				})
 			}
 		}
@@ -783,6 +1901,10 @@ func (s *state) run(ctx context.Context, snap *ConfigSnapshot) {
 
 func (s *handlerConnectProxy) handleUpdate(ctx context.Context, u cache.UpdateEvent, snap *ConfigSnapshot) error {
 	if u.Err != nil {
+		if u.CorrelationID == leafWatchID &&
+			(*handlerUpstreams)(s).markLeafCertStale(u, &snap.ConnectProxy.ConfigSnapshotUpstreams) {
+			return nil
+		}
 		return fmt.Errorf("error filling agent cache: %v", u.Err)
 	}
 
@@ -804,6 +1926,7 @@ func (s *handlerConnectProxy) handleUpdate(ctx context.Context, u cache.UpdateEv
 			// the one result set up.
 			snap.ConnectProxy.Intentions = resp.Matches[0]
 		}
+		snap.ConnectProxy.InboundPermissions = inboundPermissionsFromIntentions(snap.ConnectProxy.Intentions)
 		snap.ConnectProxy.IntentionsSet = true
 
 	case u.CorrelationID == intentionUpstreamsID:
@@ -843,6 +1966,13 @@ func (s *handlerConnectProxy) handleUpdate(ctx context.Context, u cache.UpdateEv
 					"error", err,
 				)
 			}
+			if s.strictUpstreamConfig {
+				warnUnusedUpstreamConfigKeys(s.logger, cfgMap, svc.String())
+			}
+
+			if limits := resolveUpstreamLimits(s.logger, snap.ConnectProxy.UpstreamConfig, svc.String()); limits != nil {
+				snap.ConnectProxy.UpstreamLimits[svc.String()] = limits
+			}
 
 			meshGateway := s.proxyCfg.MeshGateway
 			if u != nil {
@@ -904,8 +2034,24 @@ func (s *handlerConnectProxy) handleUpdate(ctx context.Context, u cache.UpdateEv
 				cancelFn()
 				delete(snap.ConnectProxy.WatchedDiscoveryChains, sn)
 				delete(snap.ConnectProxy.DiscoveryChain, sn)
+				delete(snap.ConnectProxy.UpstreamLimits, sn)
+			}
+		}
+
+		// Prepared-query upstream watches are registered during initialize
+		// rather than driven by intentions, but the same cleanup pass cancels
+		// any whose upstream has since been removed so repeatedly
+		// reconfigured proxies do not accumulate dead pollers.
+		for pq, cancelFn := range snap.ConnectProxy.WatchedPreparedQueries {
+			if _, ok := snap.ConnectProxy.UpstreamConfig[pq]; ok {
+				continue
 			}
+			cancelFn()
+			delete(snap.ConnectProxy.WatchedPreparedQueries, pq)
+			delete(snap.ConnectProxy.PreparedQueryEndpoints, pq)
 		}
+		snap.ConnectProxy.recomputeWatchCounts()
+		snap.ConnectProxy.IntentionUpstreamsSet = true
 
 	case strings.HasPrefix(u.CorrelationID, "upstream:"+preparedQueryIDPrefix):
 		resp, ok := u.Result.(*structs.PreparedQueryExecuteResponse)
@@ -915,6 +2061,14 @@ func (s *handlerConnectProxy) handleUpdate(ctx context.Context, u cache.UpdateEv
 		pq := strings.TrimPrefix(u.CorrelationID, "upstream:")
 		snap.ConnectProxy.PreparedQueryEndpoints[pq] = resp.Nodes
 
+	case strings.HasPrefix(u.CorrelationID, upstreamPeerWatchIDPrefix):
+		resp, ok := u.Result.(*structs.IndexedCheckServiceNodes)
+		if !ok {
+			return fmt.Errorf("invalid type for response: %T", u.Result)
+		}
+		uid := strings.TrimPrefix(u.CorrelationID, upstreamPeerWatchIDPrefix)
+		snap.ConnectProxy.PeerUpstreamEndpoints[uid] = resp.Nodes
+
 	case strings.HasPrefix(u.CorrelationID, svcChecksWatchIDPrefix):
 		resp, ok := u.Result.([]structs.CheckType)
 		if !ok {
@@ -940,12 +2094,44 @@ func (s *handlerConnectProxy) handleUpdate(ctx context.Context, u cache.UpdateEv
 		}
 		snap.ConnectProxy.MeshConfigSet = true
 
+	case strings.HasPrefix(u.CorrelationID, serviceRouterIDPrefix),
+		strings.HasPrefix(u.CorrelationID, serviceSplitterIDPrefix):
+		resp, ok := u.Result.(*structs.ConfigEntryResponse)
+		if !ok {
+			return fmt.Errorf("invalid type for response: %T", u.Result)
+		}
+		// "service-router:web" -> "service-router/web" to match the
+		// <kind>/<name> keying of RoutingConfigVersions.
+		key := strings.Replace(u.CorrelationID, ":", "/", 1)
+		if resp.Entry == nil {
+			delete(snap.ConnectProxy.RoutingConfigVersions, key)
+		} else {
+			snap.ConnectProxy.RoutingConfigVersions[key] = resp.Entry.GetRaftIndex().ModifyIndex
+		}
+
 	default:
 		return (*handlerUpstreams)(s).handleUpdateUpstreams(ctx, u, snap)
 	}
 	return nil
 }
 
+// markLeafCertStale absorbs an error from the leaf certificate watch when we
+// already hold a leaf: rather than tearing down proxy config while the CA is
+// unable to sign, we keep serving the last-known leaf and flag the snapshot
+// as stale. It reports whether the error was absorbed; with no prior leaf the
+// caller should surface the error as usual.
+func (s *handlerUpstreams) markLeafCertStale(u cache.UpdateEvent, upstreamsSnapshot *ConfigSnapshotUpstreams) bool {
+	if upstreamsSnapshot.Leaf == nil {
+		return false
+	}
+	upstreamsSnapshot.LeafCertStale = true
+	metrics.IncrCounter([]string{"proxycfg", "leaf", "watch_error"}, 1)
+	s.logger.Warn("leaf certificate watch errored; continuing to serve last-known leaf",
+		"error", u.Err,
+	)
+	return true
+}
+
 func (s *handlerUpstreams) handleUpdateUpstreams(ctx context.Context, u cache.UpdateEvent, snap *ConfigSnapshot) error {
 	if u.Err != nil {
 		return fmt.Errorf("error filling agent cache: %v", u.Err)
@@ -963,17 +2149,75 @@ func (s *handlerUpstreams) handleUpdateUpstreams(ctx context.Context, u cache.Up
 			return fmt.Errorf("invalid type for response: %T", u.Result)
 		}
 		upstreamsSnapshot.Leaf = leaf
+		upstreamsSnapshot.LeafCertStale = false
 
 	case strings.HasPrefix(u.CorrelationID, "discovery-chain:"):
 		resp, ok := u.Result.(*structs.DiscoveryChainResponse)
 		if !ok {
 			return fmt.Errorf("invalid type for response: %T", u.Result)
 		}
-		svc := strings.TrimPrefix(u.CorrelationID, "discovery-chain:")
-		upstreamsSnapshot.DiscoveryChain[svc] = resp.Chain
+		primary := strings.TrimPrefix(u.CorrelationID, "discovery-chain:")
+
+		// A shared chain watch delivers under its primary upstream's
+		// correlation ID; fan the result out to every upstream that
+		// references it.
+		ids := []string{primary}
+		if s.kind == structs.ServiceKindConnectProxy {
+			if shared := snap.ConnectProxy.sharedChainWatchFor(primary); shared != nil {
+				ids = make([]string, 0, len(shared.Refs))
+				for id := range shared.Refs {
+					ids = append(ids, id)
+				}
+				sort.Strings(ids)
+			}
+		}
 
-		if err := s.resetWatchesFromChain(ctx, svc, resp.Chain, upstreamsSnapshot); err != nil {
-			return err
+		if resp.Chain == nil {
+			// A nil chain means compilation failed upstream of us. Keep the
+			// prior good chain and endpoints for the affected upstreams and
+			// record the failure instead of failing the whole update.
+			for _, svc := range ids {
+				s.logger.Warn("discovery chain could not be compiled for upstream",
+					"upstream", svc,
+				)
+				if upstreamsSnapshot.ChainCompileErrors == nil {
+					upstreamsSnapshot.ChainCompileErrors = make(map[string]string)
+				}
+				upstreamsSnapshot.ChainCompileErrors[svc] = "discovery chain failed to compile"
+			}
+			return nil
+		}
+
+		for _, svc := range ids {
+			upstreamsSnapshot.DiscoveryChain[svc] = resp.Chain
+			delete(upstreamsSnapshot.ChainCompileErrors, svc)
+
+			// Surface a disagreement between the configured protocol override and
+			// the protocol of the compiled chain. The override keeps its
+			// documented precedence; this only makes the conflict visible.
+			conflict := false
+			if upstream, ok := upstreamsSnapshot.UpstreamConfig[svc]; ok && resp.Chain != nil {
+				cfg, err := parseReducedUpstreamConfig(upstream.Config)
+				if err == nil && cfg.Protocol != "" && resp.Chain.Protocol != "" && cfg.Protocol != resp.Chain.Protocol {
+					conflict = true
+					s.logger.Warn("upstream protocol override does not match discovery chain protocol",
+						"upstream", svc,
+						"override", cfg.Protocol,
+						"chain", resp.Chain.Protocol,
+					)
+					if upstreamsSnapshot.UpstreamProtocolConflicts == nil {
+						upstreamsSnapshot.UpstreamProtocolConflicts = make(map[string]string)
+					}
+					upstreamsSnapshot.UpstreamProtocolConflicts[svc] = resp.Chain.Protocol
+				}
+			}
+			if !conflict {
+				delete(upstreamsSnapshot.UpstreamProtocolConflicts, svc)
+			}
+
+			if err := s.resetWatchesFromChain(ctx, svc, resp.Chain, upstreamsSnapshot); err != nil {
+				return err
+			}
 		}
 
 	case strings.HasPrefix(u.CorrelationID, "upstream-target:"):
@@ -990,16 +2234,41 @@ func (s *handlerUpstreams) handleUpdateUpstreams(ctx context.Context, u cache.Up
 		if _, ok := upstreamsSnapshot.WatchedUpstreamEndpoints[svc]; !ok {
 			upstreamsSnapshot.WatchedUpstreamEndpoints[svc] = make(map[string]structs.CheckServiceNodes)
 		}
-		upstreamsSnapshot.WatchedUpstreamEndpoints[svc][targetID] = resp.Nodes
 
-		var passthroughAddrs map[string]ServicePassthroughAddrs
+		// Count real endpoint changes per target so operators can spot
+		// flapping services; blocking-query redeliveries of identical
+		// results don't increment it.
+		if prev, ok := upstreamsSnapshot.WatchedUpstreamEndpoints[svc][targetID]; !ok || !reflect.DeepEqual(prev, resp.Nodes) {
+			metrics.IncrCounterWithLabels([]string{"proxycfg", "upstream", "endpoint_changes"}, 1, []metrics.Label{
+				{Name: "upstream", Value: svc},
+				{Name: "target", Value: targetID},
+			})
+		}
+		upstreamsSnapshot.WatchedUpstreamEndpoints[svc][targetID] = s.internEndpoints(resp.Nodes)
+
+		// Refresh the upstream's health summary from the current endpoints
+		// of every target so readiness checks don't walk the endpoint maps.
+		summary := UpstreamHealthSummary{}
+		for _, nodes := range upstreamsSnapshot.WatchedUpstreamEndpoints[svc] {
+			for _, node := range nodes {
+				summary.Total++
+				if hostnameEndpointHealthTier(node) < 2 {
+					summary.Healthy++
+				}
+			}
+		}
+		if upstreamsSnapshot.UpstreamEndpointHealth == nil {
+			upstreamsSnapshot.UpstreamEndpointHealth = make(map[string]UpstreamHealthSummary)
+		}
+		upstreamsSnapshot.UpstreamEndpointHealth[svc] = summary
+
+		// Rebuild this watch's contribution to the passthrough address sets
+		// so addresses for nodes that went away are pruned instead of
+		// accumulating forever.
+		contributed := make(map[string]map[string]struct{})
 
 		for _, node := range resp.Nodes {
 			if snap.Proxy.Mode == structs.ProxyModeTransparent && node.Service.Proxy.TransparentProxy.DialedDirectly {
-				if passthroughAddrs == nil {
-					passthroughAddrs = make(map[string]ServicePassthroughAddrs)
-				}
-
 				svc := node.Service.CompoundServiceName()
 
 				// Overwrite the name if it's a connect proxy (as opposed to Connect native).
@@ -1027,11 +2296,50 @@ func (s *handlerUpstreams) handleUpdateUpstreams(ctx context.Context, u cache.Up
 
 						// Stored in a set because it's possible for these to be duplicated
 						// when the upstream-target is targeted by multiple discovery chains.
-						Addrs: make(map[string]struct{}),
+						Addrs:       make(map[string]struct{}),
+						AddrWeights: make(map[string]int),
 					}
 				}
 				addr, _ := node.BestAddress(false)
 				upstreamsSnapshot.PassthroughUpstreams[svc.String()].Addrs[addr] = struct{}{}
+
+				weight := 1
+				if node.Service.Weights != nil && node.Service.Weights.Passing > 0 {
+					weight = node.Service.Weights.Passing
+				}
+				upstreamsSnapshot.PassthroughUpstreams[svc.String()].AddrWeights[addr] = weight
+
+				if contributed[svc.String()] == nil {
+					contributed[svc.String()] = make(map[string]struct{})
+				}
+				contributed[svc.String()][addr] = struct{}{}
+			}
+		}
+
+		watchKey := targetID + ":" + svc
+		if upstreamsSnapshot.PassthroughContributions == nil {
+			upstreamsSnapshot.PassthroughContributions = make(map[string]map[string]map[string]struct{})
+		}
+		prev := upstreamsSnapshot.PassthroughContributions[watchKey]
+		if len(contributed) > 0 {
+			upstreamsSnapshot.PassthroughContributions[watchKey] = contributed
+		} else {
+			delete(upstreamsSnapshot.PassthroughContributions, watchKey)
+		}
+
+		for dst, addrs := range prev {
+			for addr := range addrs {
+				if _, ok := contributed[dst][addr]; ok {
+					continue
+				}
+				if passthroughAddrStillContributed(upstreamsSnapshot, dst, addr) {
+					continue
+				}
+				delete(upstreamsSnapshot.PassthroughUpstreams[dst].Addrs, addr)
+				delete(upstreamsSnapshot.PassthroughUpstreams[dst].AddrWeights, addr)
+			}
+			if pa, ok := upstreamsSnapshot.PassthroughUpstreams[dst]; ok && len(pa.Addrs) == 0 {
+				delete(upstreamsSnapshot.PassthroughUpstreams, dst)
 			}
 		}
 
@@ -1048,19 +2356,81 @@ func (s *handlerUpstreams) handleUpdateUpstreams(ctx context.Context, u cache.Up
 		if _, ok = upstreamsSnapshot.WatchedGatewayEndpoints[svc]; !ok {
 			upstreamsSnapshot.WatchedGatewayEndpoints[svc] = make(map[string]structs.CheckServiceNodes)
 		}
-		upstreamsSnapshot.WatchedGatewayEndpoints[svc][dc] = resp.Nodes
+		upstreamsSnapshot.WatchedGatewayEndpoints[svc][dc] = s.internEndpoints(resp.Nodes)
 	default:
 		return fmt.Errorf("unknown correlation ID: %s", u.CorrelationID)
 	}
 	return nil
 }
 
+// passthroughAddrStillContributed reports whether any upstream-target watch
+// still supplies addr for the given destination service's passthrough set.
+func passthroughAddrStillContributed(snap *ConfigSnapshotUpstreams, dst, addr string) bool {
+	for _, byDst := range snap.PassthroughContributions {
+		if _, ok := byDst[dst][addr]; ok {
+			return true
+		}
+	}
+	return false
+}
+
+// internEndpoints deduplicates identical entries across the snapshot's
+// endpoint maps when endpoint deduplication is enabled. With it disabled the
+// nodes are stored as delivered.
+func (s *handlerUpstreams) internEndpoints(nodes structs.CheckServiceNodes) structs.CheckServiceNodes {
+	if !s.dedupEndpoints {
+		return nodes
+	}
+	return s.endpointInterner.intern(nodes)
+}
+
+// makeColonID joins correlation-ID components onto a prefix with colons,
+// escaping colons inside the components so removeColonPrefix can split the
+// ID again even when a service name or filter contains one.
+func makeColonID(prefix string, parts ...string) string {
+	escaped := make([]string, len(parts))
+	for i, p := range parts {
+		escaped[i] = escapeColons(p)
+	}
+	return prefix + strings.Join(escaped, ":")
+}
+
+// escapeColons backslash-escapes colons, and the escape character itself,
+// in a correlation-ID component.
+func escapeColons(s string) string {
+	s = strings.ReplaceAll(s, `\`, `\\`)
+	return strings.ReplaceAll(s, ":", `\:`)
+}
+
+// unescapeColons undoes escapeColons. Components without escapes pass
+// through unchanged.
+func unescapeColons(s string) string {
+	if !strings.Contains(s, `\`) {
+		return s
+	}
+	var b strings.Builder
+	b.Grow(len(s))
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' && i+1 < len(s) {
+			i++
+		}
+		b.WriteByte(s[i])
+	}
+	return b.String()
+}
+
+// removeColonPrefix splits a correlation ID built by makeColonID at its
+// first unescaped colon and returns the two unescaped components.
 func removeColonPrefix(s string) (string, string, bool) {
-	idx := strings.Index(s, ":")
-	if idx == -1 {
-		return "", "", false
+	for i := 0; i < len(s); i++ {
+		switch s[i] {
+		case '\\':
+			i++
+		case ':':
+			return unescapeColons(s[:i]), unescapeColons(s[i+1:]), true
+		}
 	}
-	return s[0:idx], s[idx+1:], true
+	return "", "", false
 }
 
 func (s *handlerUpstreams) resetWatchesFromChain(
@@ -1109,8 +2479,41 @@ func (s *handlerUpstreams) resetWatchesFromChain(
 		needGateways          = make(map[string]struct{})
 	)
 
-	chainID := chain.ID()
+	// Order the targets deterministically with primary resolver targets
+	// first so that when a pathological chain exceeds the watch cap the
+	// same failover targets are dropped on every pass.
+	primary := make(map[string]struct{})
+	for _, node := range chain.Nodes {
+		if node.Type == structs.DiscoveryGraphNodeTypeResolver {
+			primary[node.Resolver.Target] = struct{}{}
+		}
+	}
+	targets := make([]*structs.DiscoveryTarget, 0, len(chain.Targets))
 	for _, target := range chain.Targets {
+		targets = append(targets, target)
+	}
+	sort.Slice(targets, func(i, j int) bool {
+		_, pi := primary[targets[i].ID]
+		_, pj := primary[targets[j].ID]
+		if pi != pj {
+			return pi
+		}
+		return targets[i].ID < targets[j].ID
+	})
+
+	if len(targets) > maxChainTargetWatches {
+		s.logger.Warn("discovery chain has too many targets, dropping excess failover targets",
+			"upstream", id,
+			"chain", chain.ServiceName,
+			"targets", len(targets),
+			"limit", maxChainTargetWatches,
+		)
+		metrics.IncrCounter([]string{"proxycfg", "chain", "target_watches_exceeded"}, 1)
+		targets = targets[:maxChainTargetWatches]
+	}
+
+	chainID := chain.ID()
+	for _, target := range targets {
 		if target.ID == chainID {
 			watchedChainEndpoints = true
 		}
@@ -1198,6 +2601,7 @@ func (s *handlerUpstreams) resetWatchesFromChain(
 		cancelFn()
 	}
 
+	snap.recomputeWatchCounts()
 	return nil
 }
 
@@ -1220,15 +2624,14 @@ func (s *handlerUpstreams) watchUpstreamTarget(ctx context.Context, snap *Config
 	var finalMeta structs.EnterpriseMeta
 	finalMeta.Merge(opts.entMeta)
 
-	correlationID := "upstream-target:" + opts.chainID + ":" + opts.upstreamID
+	correlationID := makeColonID("upstream-target:", opts.chainID, opts.upstreamID)
 
 	ctx, cancel := context.WithCancel(ctx)
+	qOpts := s.watchQueryOptions()
+	qOpts.Filter = opts.filter
 	err := s.health.Notify(ctx, structs.ServiceSpecificRequest{
-		Datacenter: opts.datacenter,
-		QueryOptions: structs.QueryOptions{
-			Token:  s.token,
-			Filter: opts.filter,
-		},
+		Datacenter:   opts.datacenter,
+		QueryOptions: qOpts,
 		ServiceName: opts.service,
 		Connect:     true,
 		// Note that Identifier doesn't type-prefix for service any more as it's
@@ -1268,8 +2671,18 @@ func (s *handlerTerminatingGateway) handleUpdate(ctx context.Context, u cache.Up
 			return fmt.Errorf("invalid type for response: %T", u.Result)
 		}
 
+		cfg := parseTerminatingGatewayConfig(s.logger, s.proxyCfg.Config)
+
 		svcMap := make(map[structs.ServiceName]struct{})
 		for _, svc := range services.Services {
+			// Leaving a filtered service out of this map makes the
+			// cancellation loops below tear down any watches set up before
+			// the filter excluded it.
+			if !cfg.allowsLinkedService(svc.Service) {
+				logger.Debug("linked service excluded by filter", "service", svc.Service.String())
+				continue
+			}
+
 			// Make sure to add every service to this map, we use it to cancel watches below.
 			svcMap[svc.Service] = struct{}{}
 
@@ -1281,7 +2694,7 @@ func (s *handlerTerminatingGateway) handleUpdate(ctx context.Context, u cache.Up
 				ctx, cancel := context.WithCancel(ctx)
 				err := s.health.Notify(ctx, structs.ServiceSpecificRequest{
 					Datacenter:     s.source.Datacenter,
-					QueryOptions:   structs.QueryOptions{Token: s.token},
+					QueryOptions:   s.watchQueryOptions(),
 					ServiceName:    svc.Service.Name,
 					EnterpriseMeta: svc.Service.EnterpriseMeta,
 
@@ -1306,7 +2719,7 @@ func (s *handlerTerminatingGateway) handleUpdate(ctx context.Context, u cache.Up
 				ctx, cancel := context.WithCancel(ctx)
 				err := s.cache.Notify(ctx, cachetype.IntentionMatchName, &structs.IntentionQueryRequest{
 					Datacenter:   s.source.Datacenter,
-					QueryOptions: structs.QueryOptions{Token: s.token},
+					QueryOptions: s.watchQueryOptions(),
 					Match: &structs.IntentionQueryMatch{
 						Type: structs.IntentionMatchDestination,
 						Entries: []structs.IntentionMatchEntry{
@@ -1357,7 +2770,7 @@ func (s *handlerTerminatingGateway) handleUpdate(ctx context.Context, u cache.Up
 				ctx, cancel := context.WithCancel(ctx)
 				err := s.cache.Notify(ctx, cachetype.ResolvedServiceConfigName, &structs.ServiceConfigRequest{
 					Datacenter:     s.source.Datacenter,
-					QueryOptions:   structs.QueryOptions{Token: s.token},
+					QueryOptions:   s.watchQueryOptions(),
 					Name:           svc.Service.Name,
 					EnterpriseMeta: svc.Service.EnterpriseMeta,
 				}, serviceConfigIDPrefix+svc.Service.String(), s.ch)
@@ -1379,7 +2792,7 @@ func (s *handlerTerminatingGateway) handleUpdate(ctx context.Context, u cache.Up
 				ctx, cancel := context.WithCancel(ctx)
 				err := s.cache.Notify(ctx, cachetype.ConfigEntriesName, &structs.ConfigEntryQuery{
 					Datacenter:     s.source.Datacenter,
-					QueryOptions:   structs.QueryOptions{Token: s.token},
+					QueryOptions:   s.watchQueryOptions(),
 					Kind:           structs.ServiceResolver,
 					Name:           svc.Service.Name,
 					EnterpriseMeta: svc.Service.EnterpriseMeta,
@@ -1417,6 +2830,7 @@ func (s *handlerTerminatingGateway) handleUpdate(ctx context.Context, u cache.Up
 				logger.Debug("canceling watch for service", "service", sn.String())
 				delete(snap.TerminatingGateway.WatchedServices, sn)
 				delete(snap.TerminatingGateway.ServiceGroups, sn)
+				delete(snap.TerminatingGateway.ServiceGroupLastUpdated, sn)
 				cancelFn()
 			}
 		}
@@ -1475,8 +2889,10 @@ func (s *handlerTerminatingGateway) handleUpdate(ctx context.Context, u cache.Up
 		if len(resp.Nodes) > 0 {
 			snap.TerminatingGateway.ServiceGroups[sn] = resp.Nodes
 			snap.TerminatingGateway.HostnameServices[sn] = hostnameEndpoints(
-				s.logger, snap.Datacenter, resp.Nodes)
+				s.logger, snap.Datacenter, resp.Nodes,
+				parseHostnameEndpointsConfig(s.logger, s.proxyCfg.Config))
 		}
+		snap.TerminatingGateway.ServiceGroupLastUpdated[sn] = time.Now()
 
 	// Store leaf cert for watched service
 	case strings.HasPrefix(u.CorrelationID, serviceLeafIDPrefix):
@@ -1533,6 +2949,135 @@ func (s *handlerTerminatingGateway) handleUpdate(ctx context.Context, u cache.Up
 	return nil
 }
 
+// reconcileServiceWatches lines the per-service connect-service watches up
+// with the current catalog service list, filtered down to connect-capable
+// services when that filter is configured. It runs whenever either input
+// changes.
+func (s *handlerMeshGateway) reconcileServiceWatches(ctx context.Context, snap *ConfigSnapshot) error {
+	meshLogger := s.logger.Named(logging.MeshGateway)
+
+	services := snap.MeshGateway.ServiceList
+	if s.serviceFilter != nil {
+		raw, err := s.serviceFilter.Execute(services)
+		if err != nil {
+			return fmt.Errorf("failed to apply mesh gateway service filter: %v", err)
+		}
+		services = raw.([]structs.ServiceName)
+	}
+
+	svcMap := make(map[structs.ServiceName]struct{})
+	for _, svc := range services {
+		if !snap.MeshGateway.connectCapable(svc) {
+			continue
+		}
+		if s.allowedNamespaces != nil {
+			if _, ok := s.allowedNamespaces[svc.NamespaceOrDefault()]; !ok {
+				continue
+			}
+		}
+		// Make sure to add every service to this map, we use it to cancel
+		// watches below.
+		svcMap[svc] = struct{}{}
+
+		if _, ok := snap.MeshGateway.WatchedServices[svc]; !ok {
+			ctx, cancel := context.WithCancel(ctx)
+			err := s.health.Notify(ctx, structs.ServiceSpecificRequest{
+				Datacenter:     s.source.Datacenter,
+				QueryOptions:   s.watchQueryOptions(),
+				ServiceName:    svc.Name,
+				Connect:        true,
+				EnterpriseMeta: svc.EnterpriseMeta,
+			}, fmt.Sprintf("connect-service:%s", svc.String()), s.ch)
+
+			if err != nil {
+				meshLogger.Error("failed to register watch for connect-service",
+					"service", svc.String(),
+					"error", err,
+				)
+				cancel()
+				return err
+			}
+			snap.MeshGateway.WatchedServices[svc] = cancel
+		}
+	}
+
+	for sid, cancelFn := range snap.MeshGateway.WatchedServices {
+		if _, ok := svcMap[sid]; !ok {
+			meshLogger.Debug("canceling watch for service", "service", sid.String())
+			// TODO (gateways) Should the sid also be deleted from snap.MeshGateway.ServiceGroups?
+			//                 Do those endpoints get cleaned up some other way?
+			delete(snap.MeshGateway.WatchedServices, sid)
+			delete(snap.MeshGateway.ServiceGroupLastUpdated, sid)
+			cancelFn()
+		}
+	}
+	return nil
+}
+
+// watchDatacenters starts the watch on the catalog datacenter list that
+// drives cross-DC mesh-gateway discovery. It is a no-op if the watch is
+// already running.
+func (s *handlerMeshGateway) watchDatacenters(ctx context.Context, snap *ConfigSnapshot) error {
+	if snap.MeshGateway.WatchedDatacentersCancel != nil {
+		return nil
+	}
+
+	wctx, cancel := context.WithCancel(ctx)
+	qOpts := s.watchQueryOptions()
+	qOpts.MaxAge = 30 * time.Second
+	err := s.cache.Notify(wctx, cachetype.CatalogDatacentersName, &structs.DatacentersRequest{
+		QueryOptions: qOpts,
+	}, datacentersWatchID, s.ch)
+	if err != nil {
+		cancel()
+		return err
+	}
+	snap.MeshGateway.WatchedDatacentersCancel = cancel
+	return nil
+}
+
+// stopDatacentersWatch cancels the datacenter list watch along with every
+// per-datacenter gateway watch it spawned and drops the remote gateway data.
+func (s *handlerMeshGateway) stopDatacentersWatch(snap *ConfigSnapshot) {
+	if snap.MeshGateway.WatchedDatacentersCancel == nil {
+		return
+	}
+	snap.MeshGateway.WatchedDatacentersCancel()
+	snap.MeshGateway.WatchedDatacentersCancel = nil
+
+	for dc, cancelFn := range snap.MeshGateway.WatchedDatacenters {
+		delete(snap.MeshGateway.WatchedDatacenters, dc)
+		delete(snap.MeshGateway.GatewayGroups, dc)
+		delete(snap.MeshGateway.HostnameDatacenters, dc)
+		cancelFn()
+	}
+	snap.MeshGateway.recomputeGatewayEndpointSources()
+}
+
+// crossDCDiscoveryNeeded reports whether this gateway has any reason to
+// discover gateways in other datacenters: WAN federation, or a
+// service-resolver redirecting or failing over to a remote datacenter.
+func (s *handlerMeshGateway) crossDCDiscoveryNeeded(snap *ConfigSnapshot) bool {
+	if s.meta[structs.MetaWANFederationKey] == "1" {
+		return true
+	}
+	for _, resolver := range snap.MeshGateway.ServiceResolvers {
+		if resolver.Redirect != nil &&
+			resolver.Redirect.Datacenter != "" &&
+			resolver.Redirect.Datacenter != s.source.Datacenter {
+			return true
+		}
+		for _, failover := range resolver.Failover {
+			for _, dc := range failover.Datacenters {
+				if dc != s.source.Datacenter {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
+
 func (s *handlerMeshGateway) handleUpdate(ctx context.Context, u cache.UpdateEvent, snap *ConfigSnapshot) error {
 	if u.Err != nil {
 		return fmt.Errorf("error filling agent cache: %v", u.Err)
@@ -1555,68 +3100,94 @@ func (s *handlerMeshGateway) handleUpdate(ctx context.Context, u cache.UpdateEve
 		snap.MeshGateway.FedStateGateways = dcIndexedNodes.DatacenterNodes
 
 		for dc, nodes := range dcIndexedNodes.DatacenterNodes {
+			// The live gateway dump takes precedence over federation state
+			// for any datacenter present in both sources.
+			if _, ok := snap.MeshGateway.GatewayGroups[dc]; ok {
+				continue
+			}
 			snap.MeshGateway.HostnameDatacenters[dc] = hostnameEndpoints(
-				s.logger.Named(logging.MeshGateway), snap.Datacenter, nodes)
+				s.logger.Named(logging.MeshGateway), snap.Datacenter, nodes,
+				parseHostnameEndpointsConfig(s.logger, s.proxyCfg.Config))
 		}
 
 		for dc := range snap.MeshGateway.HostnameDatacenters {
+			if _, ok := snap.MeshGateway.GatewayGroups[dc]; ok {
+				continue
+			}
 			if _, ok := dcIndexedNodes.DatacenterNodes[dc]; !ok {
 				delete(snap.MeshGateway.HostnameDatacenters, dc)
 			}
 		}
 
+		snap.MeshGateway.recomputeGatewayEndpointSources()
+
 	case serviceListWatchID:
 		services, ok := u.Result.(*structs.IndexedServiceList)
 		if !ok {
 			return fmt.Errorf("invalid type for response: %T", u.Result)
 		}
 
-		svcMap := make(map[structs.ServiceName]struct{})
-		for _, svc := range services.Services {
-			// Make sure to add every service to this map, we use it to cancel
-			// watches below.
-			svcMap[svc] = struct{}{}
-
-			if _, ok := snap.MeshGateway.WatchedServices[svc]; !ok {
-				ctx, cancel := context.WithCancel(ctx)
-				err := s.health.Notify(ctx, structs.ServiceSpecificRequest{
-					Datacenter:     s.source.Datacenter,
-					QueryOptions:   structs.QueryOptions{Token: s.token},
-					ServiceName:    svc.Name,
-					Connect:        true,
-					EnterpriseMeta: svc.EnterpriseMeta,
-				}, fmt.Sprintf("connect-service:%s", svc.String()), s.ch)
-
-				if err != nil {
-					meshLogger.Error("failed to register watch for connect-service",
-						"service", svc.String(),
-						"error", err,
-					)
-					cancel()
-					return err
-				}
-				snap.MeshGateway.WatchedServices[svc] = cancel
-			}
+		snap.MeshGateway.ServiceList = services.Services
+		if err := s.reconcileServiceWatches(ctx, snap); err != nil {
+			return err
 		}
 
-		for sid, cancelFn := range snap.MeshGateway.WatchedServices {
-			if _, ok := svcMap[sid]; !ok {
-				meshLogger.Debug("canceling watch for service", "service", sid.String())
-				// TODO (gateways) Should the sid also be deleted from snap.MeshGateway.ServiceGroups?
-				//                 Do those endpoints get cleaned up some other way?
-				delete(snap.MeshGateway.WatchedServices, sid)
-				cancelFn()
-			}
+		snap.MeshGateway.WatchedServicesSet = true
+	case connectKindServicesWatchID:
+		resp, ok := u.Result.(*structs.IndexedNodesWithGateways)
+		if !ok {
+			return fmt.Errorf("invalid type for response: %T", u.Result)
 		}
 
-		snap.MeshGateway.WatchedServicesSet = true
+		// The dump contains the connect proxy instances; the services they
+		// front are the ones a gateway can actually route to. Connect-native
+		// services have no proxy instance here and are tracked separately by
+		// the connect-native-services watch.
+		connectServices := make(map[structs.ServiceName]struct{}, len(resp.Nodes))
+		for _, csn := range resp.Nodes {
+			name := csn.Service.Proxy.DestinationServiceName
+			if name == "" {
+				name = csn.Service.Proxy.DestinationServiceID
+			}
+			if name == "" {
+				continue
+			}
+			connectServices[structs.NewServiceName(name, &csn.Service.EnterpriseMeta)] = struct{}{}
+		}
+		snap.MeshGateway.ConnectServices = connectServices
+
+		if err := s.reconcileServiceWatches(ctx, snap); err != nil {
+			return err
+		}
+	case connectNativeServicesWatchID:
+		resp, ok := u.Result.(*structs.IndexedNodesWithGateways)
+		if !ok {
+			return fmt.Errorf("invalid type for response: %T", u.Result)
+		}
+
+		nativeServices := make(map[structs.ServiceName]struct{})
+		for _, csn := range resp.Nodes {
+			if !csn.Service.Connect.Native {
+				continue
+			}
+			nativeServices[csn.Service.CompoundServiceName()] = struct{}{}
+		}
+		snap.MeshGateway.ConnectNativeServices = nativeServices
+
+		if err := s.reconcileServiceWatches(ctx, snap); err != nil {
+			return err
+		}
 	case datacentersWatchID:
 		datacentersRaw, ok := u.Result.(*[]string)
 		if !ok {
 			return fmt.Errorf("invalid type for response: %T", u.Result)
 		}
 		if datacentersRaw == nil {
-			return fmt.Errorf("invalid response with a nil datacenter list")
+			// A transient nil list (e.g. during a leadership change) means
+			// "no remote datacenters known right now"; keep the existing
+			// watches rather than failing the whole update.
+			meshLogger.Debug("ignoring nil datacenter list")
+			return nil
 		}
 
 		datacenters := *datacentersRaw
@@ -1630,7 +3201,7 @@ func (s *handlerMeshGateway) handleUpdate(ctx context.Context, u cache.UpdateEve
 				ctx, cancel := context.WithCancel(ctx)
 				err := s.cache.Notify(ctx, cachetype.InternalServiceDumpName, &structs.ServiceDumpRequest{
 					Datacenter:     dc,
-					QueryOptions:   structs.QueryOptions{Token: s.token},
+					QueryOptions:   s.watchQueryOptions(),
 					ServiceKind:    structs.ServiceKindMeshGateway,
 					UseServiceKind: true,
 					Source:         *s.source,
@@ -1659,6 +3230,12 @@ func (s *handlerMeshGateway) handleUpdate(ctx context.Context, u cache.UpdateEve
 				}
 			}
 
+			// Self-heal any stale watch that ended up pointed at our own
+			// datacenter; we never gateway to ourselves.
+			if dc == s.source.Datacenter {
+				found = false
+			}
+
 			if !found {
 				delete(snap.MeshGateway.WatchedDatacenters, dc)
 				cancelFn()
@@ -1678,6 +3255,17 @@ func (s *handlerMeshGateway) handleUpdate(ctx context.Context, u cache.UpdateEve
 		}
 		snap.MeshGateway.ServiceResolvers = resolvers
 
+		// Resolvers pointing at remote datacenters are the only reason
+		// beyond WAN federation to discover remote gateways, so start or
+		// stop the datacenter list watch to match.
+		if s.crossDCDiscoveryNeeded(snap) {
+			if err := s.watchDatacenters(ctx, snap); err != nil {
+				return err
+			}
+		} else {
+			s.stopDatacentersWatch(snap)
+		}
+
 	case consulServerListWatchID:
 		resp, ok := u.Result.(*structs.IndexedCheckServiceNodes)
 		if !ok {
@@ -1713,6 +3301,7 @@ func (s *handlerMeshGateway) handleUpdate(ctx context.Context, u cache.UpdateEve
 			} else if _, ok := snap.MeshGateway.ServiceGroups[sn]; ok {
 				delete(snap.MeshGateway.ServiceGroups, sn)
 			}
+			snap.MeshGateway.ServiceGroupLastUpdated[sn] = time.Now()
 		case strings.HasPrefix(u.CorrelationID, "mesh-gateway:"):
 			resp, ok := u.Result.(*structs.IndexedNodesWithGateways)
 			if !ok {
@@ -1726,8 +3315,17 @@ func (s *handlerMeshGateway) handleUpdate(ctx context.Context, u cache.UpdateEve
 			if len(resp.Nodes) > 0 {
 				snap.MeshGateway.GatewayGroups[dc] = resp.Nodes
 				snap.MeshGateway.HostnameDatacenters[dc] = hostnameEndpoints(
-					s.logger.Named(logging.MeshGateway), snap.Datacenter, resp.Nodes)
+					s.logger.Named(logging.MeshGateway), snap.Datacenter, resp.Nodes,
+					parseHostnameEndpointsConfig(s.logger, s.proxyCfg.Config))
+			} else if nodes := snap.MeshGateway.FedStateGateways[dc]; len(nodes) > 0 {
+				// With the dump gone the federation state is back in
+				// charge of this datacenter.
+				snap.MeshGateway.HostnameDatacenters[dc] = hostnameEndpoints(
+					s.logger.Named(logging.MeshGateway), snap.Datacenter, nodes,
+					parseHostnameEndpointsConfig(s.logger, s.proxyCfg.Config))
 			}
+			snap.MeshGateway.GatewayGroupLastUpdated[dc] = time.Now()
+			snap.MeshGateway.recomputeGatewayEndpointSources()
 		default:
 			// do nothing for now
 		}
@@ -1738,6 +3336,10 @@ func (s *handlerMeshGateway) handleUpdate(ctx context.Context, u cache.UpdateEve
 
 func (s *handlerIngressGateway) handleUpdate(ctx context.Context, u cache.UpdateEvent, snap *ConfigSnapshot) error {
 	if u.Err != nil {
+		if u.CorrelationID == leafWatchID &&
+			(*handlerUpstreams)(s).markLeafCertStale(u, &snap.IngressGateway.ConfigSnapshotUpstreams) {
+			return nil
+		}
 		return fmt.Errorf("error filling agent cache: %v", u.Err)
 	}
 
@@ -1764,6 +3366,20 @@ func (s *handlerIngressGateway) handleUpdate(ctx context.Context, u cache.Update
 		if err := s.watchIngressLeafCert(ctx, snap); err != nil {
 			return err
 		}
+		if err := s.watchIngressListenerLeafCerts(ctx, snap); err != nil {
+			return err
+		}
+
+	case strings.HasPrefix(u.CorrelationID, listenerLeafIDPrefix):
+		leaf, ok := u.Result.(*structs.IssuedCert)
+		if !ok {
+			return fmt.Errorf("invalid type for response: %T", u.Result)
+		}
+		key, ok := parseIngressListenerLeafID(u.CorrelationID)
+		if !ok {
+			return fmt.Errorf("invalid correlation id %q", u.CorrelationID)
+		}
+		snap.IngressGateway.ListenerLeaves[key] = leaf
 
 	case u.CorrelationID == gatewayServicesWatchID:
 		services, ok := u.Result.(*structs.IndexedGatewayServices)
@@ -1775,6 +3391,7 @@ func (s *handlerIngressGateway) handleUpdate(ctx context.Context, u cache.Update
 		var hosts []string
 		watchedSvcs := make(map[string]struct{})
 		upstreamsMap := make(map[IngressListenerKey]structs.Upstreams)
+		listenerHosts := make(map[IngressListenerKey][]string)
 		for _, service := range services.Services {
 			u := makeUpstream(service)
 
@@ -1795,9 +3412,41 @@ func (s *handlerIngressGateway) handleUpdate(ctx context.Context, u cache.Update
 
 			id := IngressListenerKey{Protocol: service.Protocol, Port: service.Port}
 			upstreamsMap[id] = append(upstreamsMap[id], u)
+			listenerHosts[id] = append(listenerHosts[id], service.Hosts...)
+		}
+
+		// Two listeners declaring different protocols on the same port
+		// cannot both be honored; record the problem per listener rather
+		// than silently producing a broken config.
+		protocolsByPort := make(map[int]map[string]struct{})
+		for key := range upstreamsMap {
+			if protocolsByPort[key.Port] == nil {
+				protocolsByPort[key.Port] = make(map[string]struct{})
+			}
+			protocolsByPort[key.Port][key.Protocol] = struct{}{}
+		}
+		listenerErrors := make(map[IngressListenerKey]string)
+		for key := range upstreamsMap {
+			if len(protocolsByPort[key.Port]) > 1 {
+				protocols := make([]string, 0, len(protocolsByPort[key.Port]))
+				for p := range protocolsByPort[key.Port] {
+					protocols = append(protocols, p)
+				}
+				sort.Strings(protocols)
+				listenerErrors[key] = fmt.Sprintf(
+					"conflicting protocols for port %d: %s",
+					key.Port, strings.Join(protocols, ", "),
+				)
+				s.logger.Error("ingress listeners declare conflicting protocols on the same port",
+					"port", key.Port,
+					"protocols", protocols,
+				)
+			}
 		}
 
 		snap.IngressGateway.Upstreams = upstreamsMap
+		snap.IngressGateway.ListenerHosts = listenerHosts
+		snap.IngressGateway.ListenerErrors = listenerErrors
 		snap.IngressGateway.Hosts = hosts
 		snap.IngressGateway.HostsSet = true
 
@@ -1811,6 +3460,9 @@ func (s *handlerIngressGateway) handleUpdate(ctx context.Context, u cache.Update
 		if err := s.watchIngressLeafCert(ctx, snap); err != nil {
 			return err
 		}
+		if err := s.watchIngressListenerLeafCerts(ctx, snap); err != nil {
+			return err
+		}
 
 	default:
 		return (*handlerUpstreams)(s).handleUpdateUpstreams(ctx, u, snap)
@@ -1851,17 +3503,35 @@ func (s *handlerUpstreams) watchDiscoveryChain(ctx context.Context, snap *Config
 		return nil
 	}
 
+	req := &structs.DiscoveryChainRequest{
+		Datacenter:                 s.source.Datacenter,
+		QueryOptions:               s.watchQueryOptions(),
+		Name:                       opts.name,
+		EvaluateInDatacenter:       opts.datacenter,
+		EvaluateInNamespace:        opts.namespace,
+		OverrideProtocol:           opts.cfg.Protocol,
+		OverrideConnectTimeout:     opts.cfg.ConnectTimeout(),
+		OverrideLimits:             opts.cfg.Limits,
+		OverridePassiveHealthCheck: opts.cfg.PassiveHealthCheck,
+		OverrideMeshGateway:        opts.meshGateway,
+	}
+
+	// Upstreams whose requests hash to the same cache key would compile to
+	// the same chain, so they share one underlying watch. The key is empty
+	// when hashing failed, which opts out of sharing.
+	var key string
+	if s.kind == structs.ServiceKindConnectProxy {
+		key = req.CacheInfo().Key
+		if shared, ok := snap.ConnectProxy.WatchedChainsByKey[key]; ok && key != "" {
+			shared.Refs[opts.id] = struct{}{}
+			snap.ConnectProxy.ChainWatchKeys[opts.id] = key
+			snap.ConnectProxy.WatchedDiscoveryChains[opts.id] = s.releaseChainWatchFn(snap, opts.id, key)
+			return nil
+		}
+	}
+
 	ctx, cancel := context.WithCancel(ctx)
-	err := s.cache.Notify(ctx, cachetype.CompiledDiscoveryChainName, &structs.DiscoveryChainRequest{
-		Datacenter:             s.source.Datacenter,
-		QueryOptions:           structs.QueryOptions{Token: s.token},
-		Name:                   opts.name,
-		EvaluateInDatacenter:   opts.datacenter,
-		EvaluateInNamespace:    opts.namespace,
-		OverrideProtocol:       opts.cfg.Protocol,
-		OverrideConnectTimeout: opts.cfg.ConnectTimeout(),
-		OverrideMeshGateway:    opts.meshGateway,
-	}, "discovery-chain:"+opts.id, s.ch)
+	err := s.cache.Notify(ctx, cachetype.CompiledDiscoveryChainName, req, "discovery-chain:"+opts.id, s.ch)
 	if err != nil {
 		cancel()
 		return err
@@ -1871,7 +3541,17 @@ func (s *handlerUpstreams) watchDiscoveryChain(ctx context.Context, snap *Config
 	case structs.ServiceKindIngressGateway:
 		snap.IngressGateway.WatchedDiscoveryChains[opts.id] = cancel
 	case structs.ServiceKindConnectProxy:
-		snap.ConnectProxy.WatchedDiscoveryChains[opts.id] = cancel
+		if key != "" {
+			snap.ConnectProxy.WatchedChainsByKey[key] = &sharedChainWatch{
+				Primary: opts.id,
+				Refs:    map[string]struct{}{opts.id: {}},
+				Cancel:  cancel,
+			}
+			snap.ConnectProxy.ChainWatchKeys[opts.id] = key
+			snap.ConnectProxy.WatchedDiscoveryChains[opts.id] = s.releaseChainWatchFn(snap, opts.id, key)
+		} else {
+			snap.ConnectProxy.WatchedDiscoveryChains[opts.id] = cancel
+		}
 	default:
 		cancel()
 		return fmt.Errorf("unsupported kind %s", s.kind)
@@ -1880,6 +3560,24 @@ func (s *handlerUpstreams) watchDiscoveryChain(ctx context.Context, snap *Config
 	return nil
 }
 
+// releaseChainWatchFn returns the cancel func stored per upstream for a
+// shared chain watch: it drops the upstream's reference and only cancels
+// the underlying watch once the last reference is gone.
+func (s *handlerUpstreams) releaseChainWatchFn(snap *ConfigSnapshot, id, key string) context.CancelFunc {
+	return func() {
+		shared, ok := snap.ConnectProxy.WatchedChainsByKey[key]
+		if !ok {
+			return
+		}
+		delete(shared.Refs, id)
+		delete(snap.ConnectProxy.ChainWatchKeys, id)
+		if len(shared.Refs) == 0 {
+			shared.Cancel()
+			delete(snap.ConnectProxy.WatchedChainsByKey, key)
+		}
+	}
+}
+
 func (s *handlerIngressGateway) generateIngressDNSSANs(snap *ConfigSnapshot) []string {
 	// Update our leaf cert watch with wildcard entries for our DNS domains as well as any
 	// configured custom hostnames from the service.
@@ -1943,17 +3641,424 @@ func (s *handlerIngressGateway) watchIngressLeafCert(ctx context.Context, snap *
 	return nil
 }
 
+func ingressListenerLeafID(key IngressListenerKey) string {
+	return fmt.Sprintf("%s%s:%d", listenerLeafIDPrefix, key.Protocol, key.Port)
+}
+
+func parseIngressListenerLeafID(correlationID string) (IngressListenerKey, bool) {
+	suffix := strings.TrimPrefix(correlationID, listenerLeafIDPrefix)
+	idx := strings.LastIndex(suffix, ":")
+	if idx < 0 {
+		return IngressListenerKey{}, false
+	}
+	port, err := strconv.Atoi(suffix[idx+1:])
+	if err != nil {
+		return IngressListenerKey{}, false
+	}
+	return IngressListenerKey{Protocol: suffix[:idx], Port: port}, true
+}
+
+// watchIngressListenerLeafCerts maintains a leaf cert watch per listener that
+// has its own custom hosts, so each such listener can present a certificate
+// with listener-specific SANs instead of the gateway-wide cert from
+// watchIngressLeafCert. Watches for removed listeners are torn down.
+func (s *handlerIngressGateway) watchIngressListenerLeafCerts(ctx context.Context, snap *ConfigSnapshot) error {
+	if !snap.IngressGateway.TLSSet || !snap.IngressGateway.HostsSet {
+		return nil
+	}
+
+	desired := make(map[IngressListenerKey][]string)
+	if snap.IngressGateway.TLSEnabled {
+		for key, hosts := range snap.IngressGateway.ListenerHosts {
+			if len(hosts) > 0 {
+				desired[key] = hosts
+			}
+		}
+	}
+
+	// Only tear down watches for listeners that went away or whose host
+	// set changed; restarting an unchanged watch would needlessly
+	// redeliver its leaf on every unrelated gateway config change.
+	for key, cancelFn := range snap.IngressGateway.WatchedListenerLeaves {
+		hosts, ok := desired[key]
+		if ok && reflect.DeepEqual(hosts, snap.IngressGateway.WatchedListenerLeafHosts[key]) {
+			continue
+		}
+		cancelFn()
+		delete(snap.IngressGateway.WatchedListenerLeaves, key)
+		delete(snap.IngressGateway.WatchedListenerLeafHosts, key)
+	}
+
+	for key, hosts := range desired {
+		if _, ok := snap.IngressGateway.WatchedListenerLeaves[key]; ok {
+			continue
+		}
+		ctx, cancel := context.WithCancel(ctx)
+		err := s.cache.Notify(ctx, cachetype.ConnectCALeafName, &cachetype.ConnectCALeafRequest{
+			Datacenter:     s.source.Datacenter,
+			Token:          s.token,
+			Service:        s.service,
+			DNSSAN:         hosts,
+			EnterpriseMeta: s.proxyID.EnterpriseMeta,
+		}, ingressListenerLeafID(key), s.ch)
+		if err != nil {
+			cancel()
+			return err
+		}
+		snap.IngressGateway.WatchedListenerLeaves[key] = cancel
+		snap.IngressGateway.WatchedListenerLeafHosts[key] = hosts
+	}
+
+	for key := range snap.IngressGateway.ListenerLeaves {
+		if _, ok := desired[key]; !ok {
+			delete(snap.IngressGateway.ListenerLeaves, key)
+		}
+	}
+
+	return nil
+}
+
 // CurrentSnapshot synchronously returns the current ConfigSnapshot if there is
 // one ready. If we don't have one yet because not all necessary parts have been
 // returned (i.e. both roots and leaf cert), nil is returned.
 func (s *state) CurrentSnapshot() *ConfigSnapshot {
+	snap, _ := s.CurrentSnapshotContext(context.Background())
+	return snap
+}
+
+// CurrentSnapshotContext is CurrentSnapshot with a bounded wait: if ctx is
+// done before the run loop replies, the context error is returned instead of
+// blocking forever on a wedged or shutting-down state.
+func (s *state) CurrentSnapshotContext(ctx context.Context) (*ConfigSnapshot, error) {
 	// Make a chan for the response to be sent on
 	ch := make(chan *ConfigSnapshot, 1)
-	s.reqCh <- ch
+	select {
+	case s.reqCh <- ch:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
 	// Wait for the response
+	select {
+	case snap := <-ch:
+		return snap, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// WatchSources returns the effective query source sent for each of this
+// proxy's watches, keyed by correlation ID. It explains why results for a
+// given watch are sorted the way they are.
+func (s *state) WatchSources() map[string]WatchSource {
+	return s.watchSources.dump()
+}
+
+// WatchStatuses returns the per-correlation-ID status of this proxy's
+// watches. The map is copied out of the run goroutine so the read is
+// race-free.
+func (s *state) WatchStatuses() map[string]WatchStatus {
+	ch := make(chan map[string]WatchStatus, 1)
+	s.statusReqCh <- ch
+	return <-ch
+}
+
+// WatchDiagnostics returns a description of every watch this proxy has
+// registered, sorted by correlation ID. Watches cancelled since registration
+// may still be listed; the data is meant for debug endpoints, not for
+// driving logic.
+func (s *state) WatchDiagnostics() []WatchInfo {
+	ch := make(chan []WatchInfo, 1)
+	s.watchDiagCh <- ch
 	return <-ch
 }
 
+// Rebuild cancels all of the state's watches and re-runs initialize against
+// the current service registration. It is handled from within the run
+// goroutine so the snapshot channel returned from Watch stays subscribed
+// across the rebuild. It blocks until the new watches are established.
+func (s *state) Rebuild() error {
+	errCh := make(chan error, 1)
+	s.rebuildCh <- errCh
+	return <-errCh
+}
+
+// restartWatchesReq asks the run goroutine to re-register all watches with a
+// different ACL token; see RestartWatches.
+type restartWatchesReq struct {
+	token string
+	errCh chan error
+}
+
+// resetUpstreamReq asks the run goroutine to tear down a single upstream's
+// watches; see ResetUpstream.
+type resetUpstreamReq struct {
+	id    string
+	errCh chan error
+}
+
+// pauseReq asks the run goroutine to suppress or resume snapshot delivery;
+// see Pause and Resume.
+type pauseReq struct {
+	pause  bool
+	doneCh chan struct{}
+}
+
+// Pause stops snapshot delivery on the channel returned from Watch while the
+// run goroutine keeps folding watch updates into its snapshot. It is meant
+// for quiescing an agent without disturbing connected proxies: their last
+// config stays in effect and no partial updates reach them. It blocks until
+// the run goroutine has handled the request.
+func (s *state) Pause() {
+	s.sendPauseReq(true)
+}
+
+// Resume re-enables snapshot delivery after Pause. Everything that changed
+// while paused is delivered as a single coalesced snapshot.
+func (s *state) Resume() {
+	s.sendPauseReq(false)
+}
+
+func (s *state) sendPauseReq(pause bool) {
+	req := &pauseReq{pause: pause, doneCh: make(chan struct{})}
+	s.pauseCh <- req
+	<-req.doneCh
+}
+
+// viewReq asks the run goroutine to invoke a callback with the live
+// snapshot; see CurrentSnapshotView.
+type viewReq struct {
+	fn     func(*ConfigSnapshot)
+	doneCh chan struct{}
+}
+
+// CurrentSnapshotView invokes fn on the run goroutine with the live
+// snapshot, without the deep copy CurrentSnapshot pays. It is meant for
+// read-only consumers that only need a few fields, such as metrics or
+// health checks. The callback must not mutate the snapshot or retain the
+// pointer past its return: the run goroutine keeps updating the snapshot
+// afterwards. It blocks until the callback has run.
+func (s *state) CurrentSnapshotView(fn func(*ConfigSnapshot)) {
+	req := &viewReq{fn: fn, doneCh: make(chan struct{})}
+	s.viewReqCh <- req
+	<-req.doneCh
+}
+
+// ResetUpstream cancels the target and gateway watches of the given upstream
+// and drops its cached endpoints, without touching any other upstream or the
+// discovery chain watch itself. The next discovery chain update re-registers
+// the watches from scratch. It is meant for operators debugging a stuck
+// upstream; it blocks until the run goroutine has handled the request.
+func (s *state) ResetUpstream(upstreamID string) error {
+	req := &resetUpstreamReq{id: upstreamID, errCh: make(chan error, 1)}
+	s.resetUpstreamCh <- req
+	return <-req.errCh
+}
+
+// resetUpstreamWatches implements ResetUpstream. Only the run goroutine may
+// call it since it mutates the live snapshot.
+func (s *state) resetUpstreamWatches(snap *ConfigSnapshot, id string) error {
+	var upstreams *ConfigSnapshotUpstreams
+	switch snap.Kind {
+	case structs.ServiceKindConnectProxy:
+		upstreams = &snap.ConnectProxy.ConfigSnapshotUpstreams
+	case structs.ServiceKindIngressGateway:
+		upstreams = &snap.IngressGateway.ConfigSnapshotUpstreams
+	default:
+		return fmt.Errorf("proxy kind %q has no upstream watches", snap.Kind)
+	}
+
+	targets, ok := upstreams.WatchedUpstreams[id]
+	if !ok {
+		return fmt.Errorf("unknown upstream %q", id)
+	}
+
+	for targetID, cancelFn := range targets {
+		s.logger.Trace("stopping watch of target for upstream reset",
+			"upstream", id,
+			"target", targetID,
+		)
+		cancelFn()
+	}
+	delete(upstreams.WatchedUpstreams, id)
+	delete(upstreams.WatchedUpstreamEndpoints, id)
+
+	for dc, cancelFn := range upstreams.WatchedGateways[id] {
+		s.logger.Trace("stopping watch of mesh gateway for upstream reset",
+			"upstream", id,
+			"datacenter", dc,
+		)
+		cancelFn()
+	}
+	delete(upstreams.WatchedGateways, id)
+	delete(upstreams.WatchedGatewayEndpoints, id)
+
+	upstreams.recomputeWatchCounts()
+	return nil
+}
+
+// RestartWatches cancels all of the state's watches and re-registers them
+// using the given ACL token, so a token rotation does not have to discard
+// the whole state and lose the warm cache. The snapshot channel returned
+// from Watch stays subscribed across the restart and the CA roots are
+// carried over; token-dependent data is rebuilt from the new watches. It
+// blocks until the new watches are established or ctx is cancelled.
+func (s *state) RestartWatches(ctx context.Context, newToken string) error {
+	req := &restartWatchesReq{token: newToken, errCh: make(chan error, 1)}
+	select {
+	case s.restartCh <- req:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	select {
+	case err := <-req.errCh:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// UpstreamSummary is a census of a connect proxy's upstreams broken down by
+// where they came from. The counts can legitimately differ from the
+// registration since wildcard entries only carry defaults and transparent
+// proxies discover upstreams from intentions at runtime.
+type UpstreamSummary struct {
+	// Explicit is the number of upstreams listed in the proxy registration.
+	Explicit int
+
+	// CentrallyConfigured is the number of synthetic upstreams injected
+	// from centralized upstream config.
+	CentrallyConfigured int
+
+	// IntentionDiscovered is the number of upstreams currently discovered
+	// from intentions in transparent proxy mode.
+	IntentionDiscovered int
+
+	// Active is the number of upstreams the proxy is actually routing to:
+	// those with a compiled discovery chain plus prepared-query upstreams.
+	Active int
+}
+
+// UpstreamSummary returns the current UpstreamSummary for a connect proxy.
+// The snapshot is requested from the run goroutine so the read is race-free.
+func (s *state) UpstreamSummary() UpstreamSummary {
+	var sum UpstreamSummary
+	for i := range s.serviceInstance.proxyCfg.Upstreams {
+		u := &s.serviceInstance.proxyCfg.Upstreams[i]
+		switch {
+		case u.DestinationName == structs.WildcardSpecifier:
+			// carries defaults only, never routed to directly
+		case u.CentrallyConfigured:
+			sum.CentrallyConfigured++
+		default:
+			sum.Explicit++
+		}
+	}
+
+	snap := s.CurrentSnapshot()
+	if snap == nil || snap.Kind != structs.ServiceKindConnectProxy {
+		return sum
+	}
+	sum.IntentionDiscovered = len(snap.ConnectProxy.WatchedDiscoveryChains)
+	sum.Active = len(snap.ConnectProxy.DiscoveryChain)
+	for _, u := range snap.ConnectProxy.UpstreamConfig {
+		if u.DestinationType == structs.UpstreamDestTypePreparedQuery {
+			sum.Active++
+		}
+	}
+	return sum
+}
+
+// UpstreamsWithoutChain returns the identifiers of upstreams that are known
+// to the proxy but have not received a "discovery-chain:" update, which
+// usually means the target service does not exist. Wildcard and
+// prepared-query upstreams are skipped since they never receive a chain. The
+// snapshot is requested from the run goroutine so the read is race-free.
+func (s *state) UpstreamsWithoutChain() []string {
+	snap := s.CurrentSnapshot()
+	if snap == nil {
+		return nil
+	}
+
+	upstreams := snap.ConnectProxy.ConfigSnapshotUpstreams
+	if snap.Kind == structs.ServiceKindIngressGateway {
+		upstreams = snap.IngressGateway.ConfigSnapshotUpstreams
+	}
+	return upstreamsWithoutChain(upstreams)
+}
+
+func upstreamsWithoutChain(upstreams ConfigSnapshotUpstreams) []string {
+	missing := make(map[string]struct{})
+	for id, u := range upstreams.UpstreamConfig {
+		if u.DestinationType == structs.UpstreamDestTypePreparedQuery {
+			continue
+		}
+		if u.DestinationName == structs.WildcardSpecifier {
+			continue
+		}
+		if _, ok := upstreams.DiscoveryChain[id]; !ok {
+			missing[id] = struct{}{}
+		}
+	}
+	for id := range upstreams.WatchedDiscoveryChains {
+		if _, ok := upstreams.DiscoveryChain[id]; !ok {
+			missing[id] = struct{}{}
+		}
+	}
+
+	if len(missing) == 0 {
+		return nil
+	}
+	out := make([]string, 0, len(missing))
+	for id := range missing {
+		out = append(out, id)
+	}
+	sort.Strings(out)
+	return out
+}
+
+// GatewayServiceEndpointTimes returns, per linked service, the last time the
+// gateway received a successful endpoint update for it. Services that have
+// never received an update are absent from the result. The snapshot is
+// requested from the run goroutine so the read is race-free.
+func (s *state) GatewayServiceEndpointTimes() map[structs.ServiceName]time.Time {
+	snap := s.CurrentSnapshot()
+	if snap == nil {
+		return nil
+	}
+
+	switch snap.Kind {
+	case structs.ServiceKindTerminatingGateway:
+		return snap.TerminatingGateway.ServiceGroupLastUpdated
+	case structs.ServiceKindMeshGateway:
+		return snap.MeshGateway.ServiceGroupLastUpdated
+	default:
+		return nil
+	}
+}
+
+// HostnameGatewayDatacenters returns the sorted set of datacenters whose
+// mesh gateway endpoints are hostnames rather than IPs and so depend on DNS
+// resolution from Envoy. The snapshot is requested from the run goroutine so
+// the read is race-free.
+func (s *state) HostnameGatewayDatacenters() []string {
+	snap := s.CurrentSnapshot()
+	if snap == nil {
+		return nil
+	}
+
+	dcs := make([]string, 0, len(snap.MeshGateway.HostnameDatacenters))
+	for dc, nodes := range snap.MeshGateway.HostnameDatacenters {
+		// Datacenters whose endpoints were all IPs leave an empty entry
+		// behind and are not DNS dependent.
+		if len(nodes) == 0 {
+			continue
+		}
+		dcs = append(dcs, dc)
+	}
+	sort.Strings(dcs)
+	return dcs
+}
+
 // Changed returns whether or not the passed NodeService has had any of the
 // fields we care about for config state watching changed or a different token.
 func (s *state) Changed(ns *structs.NodeService, token string) bool {
@@ -1971,37 +4076,221 @@ func (s *state) Changed(ns *structs.NodeService, token string) bool {
 		i.proxyID != ns.CompoundServiceID() ||
 		i.address != ns.Address ||
 		i.port != ns.Port ||
-		!reflect.DeepEqual(i.proxyCfg, proxyCfg) ||
+		!taggedAddressMapEqual(i.taggedAddresses, ns.TaggedAddresses) ||
+		!stringMapEqual(i.meta, ns.Meta) ||
+		i.proxyCfgChanged(proxyCfg) ||
 		i.token != token
 }
 
+// proxyCfgChanged reports whether the given proxy config differs from the
+// stored one. Comparing the precomputed content hashes rules out a difference
+// without walking the whole config, which matters on the agent's hot path for
+// proxies with large upstream lists; a deep comparison only confirms equal
+// hashes since they may collide.
+func (i *serviceInstance) proxyCfgChanged(proxyCfg structs.ConnectProxyConfig) bool {
+	if i.proxyCfgHash != 0 {
+		if newHash := hashProxyConfig(proxyCfg); newHash != 0 && newHash != i.proxyCfgHash {
+			return true
+		}
+	}
+	return !reflect.DeepEqual(i.proxyCfg, proxyCfg)
+}
+
+// stringMapEqual compares two string maps treating nil and empty as equal,
+// since the serviceInstance copies always allocate while the NodeService may
+// leave them nil.
+func stringMapEqual(a, b map[string]string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for k, v := range a {
+		if bv, ok := b[k]; !ok || bv != v {
+			return false
+		}
+	}
+	return true
+}
+
+// taggedAddressMapEqual is stringMapEqual for tagged service addresses.
+func taggedAddressMapEqual(a, b map[string]structs.ServiceAddress) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for k, v := range a {
+		if bv, ok := b[k]; !ok || bv != v {
+			return false
+		}
+	}
+	return true
+}
+
+// inboundPermissionsFromIntentions converts raw intention matches into the
+// typed inbound permission set stored on the snapshot, so that the xDS layer
+// does not need to re-derive them from the raw matches. Intentions are
+// sorted by precedence so consumers can evaluate entries first-match-wins;
+// the default-allow/deny fallback comes from the snapshot's
+// IntentionDefaultAllow field.
+func inboundPermissionsFromIntentions(intentions structs.Intentions) []InboundPermission {
+	if len(intentions) == 0 {
+		return nil
+	}
+
+	sorted := make(structs.Intentions, len(intentions))
+	copy(sorted, intentions)
+	sort.Sort(structs.IntentionPrecedenceSorter(sorted))
+
+	perms := make([]InboundPermission, 0, len(sorted))
+	for _, ixn := range sorted {
+		perm := InboundPermission{
+			Source: ixn.SourceServiceName(),
+			Action: ixn.Action,
+		}
+		if len(ixn.Permissions) > 0 {
+			perm.Permissions = make([]*structs.IntentionPermission, 0, len(ixn.Permissions))
+			for _, p := range ixn.Permissions {
+				perm.Permissions = append(perm.Permissions, p.Clone())
+			}
+		}
+		perms = append(perms, perm)
+	}
+	return perms
+}
+
+// parseEndpointIP classifies addr as an IP address, tolerating the bracketed
+// ("[2001:db8::1]") and zoned ("fe80::1%eth0") IPv6 literal forms that
+// net.ParseIP rejects but can show up in catalog addresses.
+func parseEndpointIP(addr string) net.IP {
+	if strings.HasPrefix(addr, "[") && strings.HasSuffix(addr, "]") {
+		addr = addr[1 : len(addr)-1]
+	}
+	if idx := strings.IndexByte(addr, '%'); idx >= 0 {
+		addr = addr[:idx]
+	}
+	return net.ParseIP(addr)
+}
+
+// hostnameEndpointsConfig is the subset of a gateway's opaque proxy config
+// that controls hostname endpoint selection.
+type hostnameEndpointsConfig struct {
+	// PreferIPEndpoints inverts the mixed-address behavior of
+	// hostnameEndpoints: IP endpoints are kept for EDS and hostname
+	// endpoints are dropped instead.
+	PreferIPEndpoints bool `mapstructure:"prefer_ip_endpoints"`
+
+	// DropCriticalHostnameEndpoints drops hostname endpoints whose checks
+	// are critical instead of handing them to Envoy for DNS resolution.
+	DropCriticalHostnameEndpoints bool `mapstructure:"drop_critical_hostname_endpoints"`
+}
+
+func parseHostnameEndpointsConfig(logger hclog.Logger, m map[string]interface{}) hostnameEndpointsConfig {
+	var cfg hostnameEndpointsConfig
+	if err := mapstructure.WeakDecode(m, &cfg); err != nil {
+		logger.Warn("failed to parse proxy config for hostname endpoint selection", "error", err)
+	}
+	return cfg
+}
+
+// terminatingGatewayConfig is the subset of a terminating gateway's opaque
+// proxy config used by the proxycfg state.
+type terminatingGatewayConfig struct {
+	// LinkedServiceFilter restricts which linked services get watches set
+	// up. Entries match a service's name or its namespace-qualified form.
+	// Empty means every linked service is watched.
+	LinkedServiceFilter []string `mapstructure:"linked_service_filter"`
+}
+
+func parseTerminatingGatewayConfig(logger hclog.Logger, m map[string]interface{}) terminatingGatewayConfig {
+	var cfg terminatingGatewayConfig
+	if err := mapstructure.WeakDecode(m, &cfg); err != nil {
+		logger.Warn("failed to parse terminating gateway proxy config", "error", err)
+	}
+	return cfg
+}
+
+// allowsLinkedService reports whether the filter permits watches for the
+// given linked service. An empty filter allows everything.
+func (c terminatingGatewayConfig) allowsLinkedService(sn structs.ServiceName) bool {
+	if len(c.LinkedServiceFilter) == 0 {
+		return true
+	}
+	for _, entry := range c.LinkedServiceFilter {
+		if entry == sn.Name || entry == sn.String() {
+			return true
+		}
+	}
+	return false
+}
+
+// hostnameEndpointHealthTier ranks a node's aggregated check status for
+// ordering hostname endpoints: 0 passing, 1 warning, 2 critical.
+func hostnameEndpointHealthTier(n structs.CheckServiceNode) int {
+	tier := 0
+	for _, chk := range n.Checks {
+		switch chk.Status {
+		case api.HealthCritical, api.HealthMaint:
+			return 2
+		case api.HealthWarning:
+			tier = 1
+		}
+	}
+	return tier
+}
+
 // hostnameEndpoints returns all CheckServiceNodes that have hostnames instead of IPs as the address.
 // Envoy cannot resolve hostnames provided through EDS, so we exclusively use CDS for these clusters.
 // If there is a mix of hostnames and addresses we exclusively use the hostnames, since clusters cannot discover
-// services with both EDS and DNS.
-func hostnameEndpoints(logger hclog.Logger, localDC string, nodes structs.CheckServiceNodes) structs.CheckServiceNodes {
+// services with both EDS and DNS. Setting cfg.PreferIPEndpoints inverts that choice: the IP endpoints are
+// kept for EDS and any hostname endpoints are dropped.
+func hostnameEndpoints(logger hclog.Logger, localDC string, nodes structs.CheckServiceNodes, cfg hostnameEndpointsConfig) structs.CheckServiceNodes {
 	var (
-		hasIP       bool
-		hasHostname bool
-		resp        structs.CheckServiceNodes
+		ips       structs.CheckServiceNodes
+		hostnames structs.CheckServiceNodes
+		dropped   []string
 	)
 
 	for _, n := range nodes {
 		addr, _ := n.BestAddress(localDC != n.Node.Datacenter)
-		if net.ParseIP(addr) != nil {
-			hasIP = true
+		if parseEndpointIP(addr) != nil {
+			ips = append(ips, n)
 			continue
 		}
-		hasHostname = true
-		resp = append(resp, n)
+		hostnames = append(hostnames, n)
+		dropped = append(dropped, addr)
 	}
 
-	if hasHostname && hasIP {
+	if cfg.PreferIPEndpoints {
+		if len(hostnames) > 0 {
+			dc := nodes[0].Node.Datacenter
+			sn := nodes[0].Service.CompoundServiceName()
+
+			logger.Warn("dropping hostname endpoints since IP endpoints are preferred",
+				"dc", dc, "service", sn.String(), "hostnames", dropped)
+		}
+		return ips
+	}
+
+	if len(hostnames) > 0 && len(ips) > 0 {
 		dc := nodes[0].Node.Datacenter
 		sn := nodes[0].Service.CompoundServiceName()
 
 		logger.Warn("service contains instances with mix of hostnames and IP addresses; only hostnames will be passed to Envoy",
 			"dc", dc, "service", sn.String())
 	}
-	return resp
+
+	if cfg.DropCriticalHostnameEndpoints {
+		var kept structs.CheckServiceNodes
+		for _, n := range hostnames {
+			if hostnameEndpointHealthTier(n) < 2 {
+				kept = append(kept, n)
+			}
+		}
+		hostnames = kept
+	}
+
+	// Passing endpoints come first so Envoy's DNS cluster prefers healthy
+	// gateways; the order within a health tier is preserved.
+	sort.SliceStable(hostnames, func(i, j int) bool {
+		return hostnameEndpointHealthTier(hostnames[i]) < hostnameEndpointHealthTier(hostnames[j])
+	})
+	return hostnames
 }
@@ -1,12 +1,18 @@
 package proxycfg
 
 import (
+	"bytes"
 	"context"
+	"errors"
 	"fmt"
+	"runtime"
+	"strings"
 	"sync"
 	"testing"
 	"time"
 
+	"github.com/armon/go-metrics"
+	bexpr "github.com/hashicorp/go-bexpr"
 	"github.com/hashicorp/go-hclog"
 	"github.com/stretchr/testify/require"
 
@@ -16,7 +22,9 @@ import (
 	"github.com/hashicorp/consul/agent/consul/discoverychain"
 	"github.com/hashicorp/consul/agent/rpcclient/health"
 	"github.com/hashicorp/consul/agent/structs"
+	"github.com/hashicorp/consul/api"
 	"github.com/hashicorp/consul/sdk/testutil"
+	"github.com/hashicorp/consul/sdk/testutil/retry"
 )
 
 func TestStateChanged(t *testing.T) {
@@ -111,6 +119,28 @@ func TestStateChanged(t *testing.T) {
 			},
 			want: true,
 		},
+		{
+			name:  "different tagged addresses",
+			ns:    structs.TestNodeServiceProxy(t),
+			token: "foo",
+			mutate: func(ns structs.NodeService, token string) (*structs.NodeService, string) {
+				ns.TaggedAddresses = map[string]structs.ServiceAddress{
+					structs.TaggedAddressWAN: {Address: "198.51.100.1", Port: 8443},
+				}
+				return &ns, token
+			},
+			want: true,
+		},
+		{
+			name:  "different meta",
+			ns:    structs.TestNodeServiceProxy(t),
+			token: "foo",
+			mutate: func(ns structs.NodeService, token string) (*structs.NodeService, string) {
+				ns.Meta = map[string]string{"version": "2"}
+				return &ns, token
+			},
+			want: true,
+		},
 	}
 
 	for _, tt := range tests {
@@ -125,6 +155,7 @@ func TestStateChanged(t *testing.T) {
 }
 
 type testCacheNotifierRequest struct {
+	ctx       context.Context
 	cacheType string
 	request   cache.Request
 	ch        chan<- cache.UpdateEvent
@@ -143,7 +174,7 @@ func newTestCacheNotifier() *testCacheNotifier {
 
 func (cn *testCacheNotifier) Notify(ctx context.Context, t string, r cache.Request, correlationId string, ch chan<- cache.UpdateEvent) error {
 	cn.lock.Lock()
-	cn.notifiers[correlationId] = testCacheNotifierRequest{t, r, ch}
+	cn.notifiers[correlationId] = testCacheNotifierRequest{ctx, t, r, ch}
 	cn.lock.Unlock()
 	return nil
 }
@@ -177,6 +208,27 @@ func (cn *testCacheNotifier) verifyWatch(t testing.TB, correlationId string) (st
 	return req.cacheType, req.request
 }
 
+// newTestState builds a state for ns with a fresh testCacheNotifier wired
+// into both the cache and health watches, which is what nearly every handler
+// test needs. mutate, when non-nil, adjusts the stateConfig before the state
+// is built, e.g. to set a coalesce window or enable an optional feature.
+func newTestState(t testing.TB, ns *structs.NodeService, mutate func(*stateConfig)) (*state, *testCacheNotifier) {
+	t.Helper()
+	cn := newTestCacheNotifier()
+	config := stateConfig{
+		logger: testutil.Logger(t),
+		cache:  cn,
+		health: &health.Client{Cache: cn, CacheName: cachetype.HealthServicesName},
+		source: &structs.QuerySource{Datacenter: "dc1"},
+	}
+	if mutate != nil {
+		mutate(&config)
+	}
+	state, err := newState(ns, "", config)
+	require.NoError(t, err)
+	return state, cn
+}
+
 type verifyWatchRequest func(t testing.TB, cacheType string, request cache.Request)
 
 func genVerifyDCSpecificWatch(expectedCacheType string, expectedDatacenter string) verifyWatchRequest {
@@ -712,7 +764,6 @@ func TestState_WatchesAndUpdates(t *testing.T) {
 					requiredWatches: map[string]verifyWatchRequest{
 						rootsWatchID:       genVerifyRootsWatch("dc1"),
 						serviceListWatchID: genVerifyListServicesWatch("dc1"),
-						datacentersWatchID: verifyDatacentersWatch,
 					},
 					verifySnapshot: func(t testing.TB, snap *ConfigSnapshot) {
 						require.False(t, snap.Valid(), "gateway without root is not valid")
@@ -773,7 +824,6 @@ func TestState_WatchesAndUpdates(t *testing.T) {
 					requiredWatches: map[string]verifyWatchRequest{
 						rootsWatchID:       genVerifyRootsWatch("dc1"),
 						serviceListWatchID: genVerifyListServicesWatch("dc1"),
-						datacentersWatchID: verifyDatacentersWatch,
 					},
 					events: []cache.UpdateEvent{
 						rootWatchEvent(),
@@ -1141,6 +1191,113 @@ func TestState_WatchesAndUpdates(t *testing.T) {
 				},
 			},
 		},
+		"ingress-gateway-per-listener-leaf-certs": {
+			ns: structs.NodeService{
+				Kind:    structs.ServiceKindIngressGateway,
+				ID:      "ingress-gateway",
+				Service: "ingress-gateway",
+				Address: "10.0.1.1",
+			},
+			sourceDC: "dc1",
+			stages: []verificationStage{
+				{
+					requiredWatches: map[string]verifyWatchRequest{
+						rootsWatchID:           genVerifyRootsWatch("dc1"),
+						gatewayConfigWatchID:   genVerifyConfigEntryWatch(structs.IngressGateway, "ingress-gateway", "dc1"),
+						gatewayServicesWatchID: genVerifyGatewayServiceWatch("ingress-gateway", "dc1"),
+					},
+					events: []cache.UpdateEvent{
+						rootWatchEvent(),
+						ingressConfigWatchEvent(true),
+						{
+							CorrelationID: gatewayServicesWatchID,
+							Result: &structs.IndexedGatewayServices{
+								Services: structs.GatewayServices{
+									{
+										Gateway:  structs.NewServiceName("ingress-gateway", nil),
+										Service:  structs.NewServiceName("api", nil),
+										Hosts:    []string{"foo.example.com"},
+										Protocol: "http",
+										Port:     8080,
+									},
+									{
+										Gateway:  structs.NewServiceName("ingress-gateway", nil),
+										Service:  structs.NewServiceName("web", nil),
+										Hosts:    []string{"bar.example.com"},
+										Protocol: "http",
+										Port:     9090,
+									},
+								},
+							},
+							Err: nil,
+						},
+					},
+					verifySnapshot: func(t testing.TB, snap *ConfigSnapshot) {
+						require.Len(t, snap.IngressGateway.Upstreams, 2)
+						require.Len(t, snap.IngressGateway.WatchedListenerLeaves, 2)
+					},
+				},
+				{
+					requiredWatches: map[string]verifyWatchRequest{
+						ingressListenerLeafID(IngressListenerKey{Protocol: "http", Port: 8080}): genVerifyLeafWatchWithDNSSANs(
+							"ingress-gateway", "dc1", []string{"foo.example.com"}),
+						ingressListenerLeafID(IngressListenerKey{Protocol: "http", Port: 9090}): genVerifyLeafWatchWithDNSSANs(
+							"ingress-gateway", "dc1", []string{"bar.example.com"}),
+					},
+					events: []cache.UpdateEvent{
+						{
+							CorrelationID: leafWatchID,
+							Result:        issuedCert,
+							Err:           nil,
+						},
+						{
+							CorrelationID: ingressListenerLeafID(IngressListenerKey{Protocol: "http", Port: 8080}),
+							Result:        issuedCert,
+							Err:           nil,
+						},
+						{
+							CorrelationID: ingressListenerLeafID(IngressListenerKey{Protocol: "http", Port: 9090}),
+							Result:        issuedCert,
+							Err:           nil,
+						},
+					},
+					verifySnapshot: func(t testing.TB, snap *ConfigSnapshot) {
+						require.True(t, snap.Valid())
+						require.Len(t, snap.IngressGateway.ListenerLeaves, 2)
+						require.Contains(t, snap.IngressGateway.ListenerLeaves, IngressListenerKey{Protocol: "http", Port: 8080})
+						require.Contains(t, snap.IngressGateway.ListenerLeaves, IngressListenerKey{Protocol: "http", Port: 9090})
+					},
+				},
+				{
+					events: []cache.UpdateEvent{
+						{
+							CorrelationID: gatewayServicesWatchID,
+							Result: &structs.IndexedGatewayServices{
+								Services: structs.GatewayServices{
+									{
+										Gateway:  structs.NewServiceName("ingress-gateway", nil),
+										Service:  structs.NewServiceName("api", nil),
+										Hosts:    []string{"foo.example.com"},
+										Protocol: "http",
+										Port:     8080,
+									},
+								},
+							},
+							Err: nil,
+						},
+					},
+					verifySnapshot: func(t testing.TB, snap *ConfigSnapshot) {
+						require.Len(t, snap.IngressGateway.WatchedListenerLeaves, 1)
+						require.Contains(t, snap.IngressGateway.WatchedListenerLeaves, IngressListenerKey{Protocol: "http", Port: 8080})
+						require.NotContains(t, snap.IngressGateway.ListenerLeaves, IngressListenerKey{Protocol: "http", Port: 9090})
+						// the 8080 listener's hosts did not change, so its watch was kept
+						require.Equal(t, map[IngressListenerKey][]string{
+							{Protocol: "http", Port: 8080}: {"foo.example.com"},
+						}, snap.IngressGateway.WatchedListenerLeafHosts)
+					},
+				},
+			},
+		},
 		"terminating-gateway-initial": {
 			ns: structs.NodeService{
 				Kind:    structs.ServiceKindTerminatingGateway,
@@ -1872,6 +2029,10 @@ func TestState_WatchesAndUpdates(t *testing.T) {
 									"10.10.10.10": {},
 									"10.0.0.2":    {},
 								},
+								AddrWeights: map[string]int{
+									"10.10.10.10": 1,
+									"10.0.0.2":    1,
+								},
 							},
 						})
 					},
@@ -2126,22 +2287,15 @@ func TestState_WatchesAndUpdates(t *testing.T) {
 
 	for name, tc := range cases {
 		t.Run(name, func(t *testing.T) {
-			cn := newTestCacheNotifier()
-			state, err := newState(&tc.ns, "", stateConfig{
-				logger: testutil.Logger(t),
-				cache:  cn,
-				health: &health.Client{Cache: cn, CacheName: cachetype.HealthServicesName},
-				source: &structs.QuerySource{
-					Datacenter: tc.sourceDC,
-				},
-				dnsConfig: DNSConfig{
+			state, cn := newTestState(t, &tc.ns, func(config *stateConfig) {
+				config.source = &structs.QuerySource{Datacenter: tc.sourceDC}
+				config.dnsConfig = DNSConfig{
 					Domain:    "consul.",
 					AltDomain: "alt.consul.",
-				},
+				}
 			})
 
 			// verify building the initial state worked
-			require.NoError(t, err)
 			require.NotNil(t, state)
 
 			// setup the test logger to use the t.Log
@@ -2192,3 +2346,4170 @@ func TestState_WatchesAndUpdates(t *testing.T) {
 		})
 	}
 }
+
+func TestState_inboundPermissionsFromIntentions(t *testing.T) {
+	require.Nil(t, inboundPermissionsFromIntentions(nil))
+
+	l4 := structs.TestIntention(t)
+	l4.SourceName = structs.WildcardSpecifier
+	l4.Action = structs.IntentionActionDeny
+	l4.UpdatePrecedence()
+
+	l7 := structs.TestIntention(t)
+	l7.Action = ""
+	l7.Permissions = []*structs.IntentionPermission{
+		{
+			Action: structs.IntentionActionAllow,
+			HTTP: &structs.IntentionHTTPPermission{
+				PathPrefix: "/v1",
+				Methods:    []string{"GET", "POST"},
+			},
+		},
+	}
+	l7.UpdatePrecedence()
+
+	// Pass the lower precedence wildcard intention first to verify that the
+	// result is ordered by precedence rather than input order.
+	perms := inboundPermissionsFromIntentions(structs.Intentions{l4, l7})
+	require.Len(t, perms, 2)
+
+	require.Equal(t, "api", perms[0].Source.Name)
+	require.Empty(t, perms[0].Action)
+	require.Len(t, perms[0].Permissions, 1)
+	require.Equal(t, structs.IntentionActionAllow, perms[0].Permissions[0].Action)
+	require.Equal(t, "/v1", perms[0].Permissions[0].HTTP.PathPrefix)
+	require.Equal(t, []string{"GET", "POST"}, perms[0].Permissions[0].HTTP.Methods)
+
+	require.Equal(t, structs.WildcardSpecifier, perms[1].Source.Name)
+	require.Equal(t, structs.IntentionActionDeny, perms[1].Action)
+	require.Empty(t, perms[1].Permissions)
+}
+
+func TestState_upstreamsWithoutChain(t *testing.T) {
+	chain := discoverychain.TestCompileConfigEntries(t, "db", "default", "dc1", "trustdomain.consul", "dc1", nil)
+
+	upstreams := ConfigSnapshotUpstreams{
+		UpstreamConfig: map[string]*structs.Upstream{
+			"db":        {DestinationName: "db"},
+			"api":       {DestinationName: "api"},
+			"geo-cache": {DestinationType: structs.UpstreamDestTypePreparedQuery, DestinationName: "geo-cache"},
+			"*":         {DestinationName: structs.WildcardSpecifier},
+		},
+		WatchedDiscoveryChains: map[string]context.CancelFunc{
+			"db":  func() {},
+			"web": func() {},
+		},
+		DiscoveryChain: map[string]*structs.CompiledDiscoveryChain{
+			"db": chain,
+		},
+	}
+
+	// "api" and "web" never received a chain; "db" did. Prepared query and
+	// wildcard upstreams never get one and must not be reported.
+	require.Equal(t, []string{"api", "web"}, upstreamsWithoutChain(upstreams))
+
+	upstreams.DiscoveryChain["api"] = chain
+	upstreams.DiscoveryChain["web"] = chain
+	require.Nil(t, upstreamsWithoutChain(upstreams))
+}
+
+func TestState_upstreamProtocolConflict(t *testing.T) {
+	ns := structs.NodeService{
+		Kind:    structs.ServiceKindConnectProxy,
+		ID:      "web-sidecar-proxy",
+		Service: "web-sidecar-proxy",
+		Address: "10.0.1.1",
+		Port:    443,
+		Proxy: structs.ConnectProxyConfig{
+			DestinationServiceName: "web",
+			Upstreams: structs.Upstreams{
+				structs.Upstream{
+					DestinationType: structs.UpstreamDestTypeService,
+					DestinationName: "api",
+					LocalBindPort:   10002,
+					Config: map[string]interface{}{
+						"protocol": "grpc",
+					},
+				},
+			},
+		},
+	}
+
+	state, _ := newTestState(t, &ns, nil)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	state.cancel = cancel
+
+	snap, err := state.handler.initialize(ctx)
+	require.NoError(t, err)
+
+	// The compiled chain did not honor the override, so its protocol
+	// disagrees with the configured one and the conflict is recorded.
+	chain := discoverychain.TestCompileConfigEntries(t, "api", "default", "dc1", "trustdomain.consul", "dc1", nil)
+	require.NoError(t, state.handler.handleUpdate(ctx, cache.UpdateEvent{
+		CorrelationID: "discovery-chain:api",
+		Result:        &structs.DiscoveryChainResponse{Chain: chain},
+	}, &snap))
+	require.Equal(t, map[string]string{"api": "tcp"}, snap.ConnectProxy.UpstreamProtocolConflicts)
+
+	// A chain compiled with the override in effect clears the conflict.
+	chain = discoverychain.TestCompileConfigEntries(t, "api", "default", "dc1", "trustdomain.consul", "dc1",
+		func(req *discoverychain.CompileRequest) {
+			req.OverrideProtocol = "grpc"
+		})
+	require.NoError(t, state.handler.handleUpdate(ctx, cache.UpdateEvent{
+		CorrelationID: "discovery-chain:api",
+		Result:        &structs.DiscoveryChainResponse{Chain: chain},
+	}, &snap))
+	require.Empty(t, snap.ConnectProxy.UpstreamProtocolConflicts)
+}
+
+func TestState_HostnameGatewayDatacenters(t *testing.T) {
+	ns := structs.NodeService{
+		Kind:    structs.ServiceKindMeshGateway,
+		ID:      "mesh-gateway",
+		Service: "mesh-gateway",
+		Address: "10.0.1.1",
+		Port:    443,
+	}
+
+	state, _ := newTestState(t, &ns, nil)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	state.cancel = cancel
+
+	snap, err := state.handler.initialize(ctx)
+	require.NoError(t, err)
+
+	roots, _ := TestCerts(t)
+	events := []cache.UpdateEvent{
+		{CorrelationID: rootsWatchID, Result: roots},
+		{CorrelationID: serviceListWatchID, Result: &structs.IndexedServiceList{}},
+		// dc2 has IP based gateways, dc4 has hostname based ones
+		{CorrelationID: "mesh-gateway:dc2", Result: &structs.IndexedNodesWithGateways{Nodes: TestGatewayNodesDC2(t)}},
+		{CorrelationID: "mesh-gateway:dc4", Result: &structs.IndexedNodesWithGateways{Nodes: TestGatewayNodesDC4Hostname(t)}},
+	}
+	for _, event := range events {
+		require.NoError(t, state.handler.handleUpdate(ctx, event, &snap))
+	}
+
+	// Run the state so that the snapshot read is served race-free.
+	go state.run(ctx, &snap)
+
+	require.Equal(t, []string{"dc4"}, state.HostnameGatewayDatacenters())
+}
+
+func TestState_meshGatewayLocalDatacenterWatch(t *testing.T) {
+	ns := structs.NodeService{
+		Kind:    structs.ServiceKindMeshGateway,
+		ID:      "mesh-gateway",
+		Service: "mesh-gateway",
+		Address: "10.0.1.1",
+		Port:    443,
+	}
+
+	state, _ := newTestState(t, &ns, nil)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	state.cancel = cancel
+
+	snap, err := state.handler.initialize(ctx)
+	require.NoError(t, err)
+
+	// The local datacenter in the list must never result in a watch.
+	dcs := []string{"dc1", "dc2"}
+	require.NoError(t, state.handler.handleUpdate(ctx, cache.UpdateEvent{
+		CorrelationID: datacentersWatchID,
+		Result:        &dcs,
+	}, &snap))
+	require.NotContains(t, snap.MeshGateway.WatchedDatacenters, "dc1")
+	require.Contains(t, snap.MeshGateway.WatchedDatacenters, "dc2")
+
+	// A stale watch for the local datacenter is removed on the next update.
+	var canceled bool
+	snap.MeshGateway.WatchedDatacenters["dc1"] = func() { canceled = true }
+	require.NoError(t, state.handler.handleUpdate(ctx, cache.UpdateEvent{
+		CorrelationID: datacentersWatchID,
+		Result:        &dcs,
+	}, &snap))
+	require.NotContains(t, snap.MeshGateway.WatchedDatacenters, "dc1")
+	require.True(t, canceled)
+}
+
+func TestState_resolveUpstreamLimits(t *testing.T) {
+	one, five, ten := 1, 5, 10
+	upstreamConfig := map[string]*structs.Upstream{
+		"*": {
+			DestinationName: structs.WildcardSpecifier,
+			Config: map[string]interface{}{
+				"limits": map[string]interface{}{
+					"max_connections":      5,
+					"max_pending_requests": 5,
+				},
+			},
+		},
+		"api": {
+			DestinationName: "api",
+			Config: map[string]interface{}{
+				"limits": map[string]interface{}{
+					"max_connections":         10,
+					"max_concurrent_requests": 1,
+				},
+			},
+		},
+		"db": {DestinationName: "db"},
+	}
+
+	logger := testutil.Logger(t)
+
+	// Per-upstream settings win field by field over the wildcard defaults.
+	require.Equal(t, &structs.UpstreamLimits{
+		MaxConnections:        &ten,
+		MaxPendingRequests:    &five,
+		MaxConcurrentRequests: &one,
+	}, resolveUpstreamLimits(logger, upstreamConfig, "api"))
+
+	// Upstreams without their own limits inherit the defaults.
+	require.Equal(t, &structs.UpstreamLimits{
+		MaxConnections:     &five,
+		MaxPendingRequests: &five,
+	}, resolveUpstreamLimits(logger, upstreamConfig, "db"))
+
+	// No limits anywhere yields nil.
+	require.Nil(t, resolveUpstreamLimits(logger, map[string]*structs.Upstream{
+		"db": {DestinationName: "db"},
+	}, "db"))
+}
+
+func TestState_gatewayServiceEndpointTimes(t *testing.T) {
+	ns := structs.NodeService{
+		Kind:    structs.ServiceKindMeshGateway,
+		ID:      "mesh-gateway",
+		Service: "mesh-gateway",
+		Address: "10.0.1.1",
+		Port:    443,
+	}
+
+	state, _ := newTestState(t, &ns, nil)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	state.cancel = cancel
+
+	snap, err := state.handler.initialize(ctx)
+	require.NoError(t, err)
+
+	web := structs.NewServiceName("web", nil)
+	db := structs.NewServiceName("db", nil)
+
+	before := time.Now()
+	require.NoError(t, state.handler.handleUpdate(ctx, cache.UpdateEvent{
+		CorrelationID: "connect-service:web",
+		Result:        &structs.IndexedCheckServiceNodes{Nodes: TestUpstreamNodes(t)},
+	}, &snap))
+
+	// Only the service that received an update has a timestamp.
+	updated, ok := snap.MeshGateway.ServiceGroupLastUpdated[web]
+	require.True(t, ok)
+	require.False(t, updated.Before(before))
+	require.NotContains(t, snap.MeshGateway.ServiceGroupLastUpdated, db)
+}
+
+func TestState_leafWatchErrorKeepsLastLeaf(t *testing.T) {
+	ns := structs.NodeService{
+		Kind:    structs.ServiceKindConnectProxy,
+		ID:      "web-sidecar-proxy",
+		Service: "web-sidecar-proxy",
+		Address: "10.0.1.1",
+		Port:    443,
+		Proxy: structs.ConnectProxyConfig{
+			DestinationServiceName: "web",
+		},
+	}
+
+	state, _ := newTestState(t, &ns, nil)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	snap, err := state.handler.initialize(ctx)
+	require.NoError(t, err)
+
+	_, leaf := TestCerts(t)
+
+	// A good leaf arrives first.
+	require.NoError(t, state.handler.handleUpdate(ctx, cache.UpdateEvent{
+		CorrelationID: leafWatchID,
+		Result:        leaf,
+	}, &snap))
+	require.Equal(t, leaf, snap.ConnectProxy.Leaf)
+	require.False(t, snap.ConnectProxy.LeafCertStale)
+
+	// The watch starts erroring (e.g. CA signing is down). The last leaf is
+	// retained and the snapshot is flagged stale instead of surfacing the
+	// error.
+	require.NoError(t, state.handler.handleUpdate(ctx, cache.UpdateEvent{
+		CorrelationID: leafWatchID,
+		Err:           errors.New("ca unavailable"),
+	}, &snap))
+	require.Equal(t, leaf, snap.ConnectProxy.Leaf)
+	require.True(t, snap.ConnectProxy.LeafCertStale)
+
+	// With no prior leaf the error still surfaces.
+	emptySnap, err := state.handler.initialize(ctx)
+	require.NoError(t, err)
+	require.Error(t, state.handler.handleUpdate(ctx, cache.UpdateEvent{
+		CorrelationID: leafWatchID,
+		Err:           errors.New("ca unavailable"),
+	}, &emptySnap))
+
+	// The next successful update clears the flag.
+	_, newLeaf := TestCerts(t)
+	require.NoError(t, state.handler.handleUpdate(ctx, cache.UpdateEvent{
+		CorrelationID: leafWatchID,
+		Result:        newLeaf,
+	}, &snap))
+	require.Equal(t, newLeaf, snap.ConnectProxy.Leaf)
+	require.False(t, snap.ConnectProxy.LeafCertStale)
+}
+
+func TestState_routingConfigEntryWatches(t *testing.T) {
+	ns := structs.NodeService{
+		Kind:    structs.ServiceKindConnectProxy,
+		ID:      "web-sidecar-proxy",
+		Service: "web-sidecar-proxy",
+		Address: "10.0.1.1",
+		Port:    443,
+		Proxy: structs.ConnectProxyConfig{
+			DestinationServiceName: "web",
+			Upstreams: structs.Upstreams{
+				{
+					DestinationType: structs.UpstreamDestTypeService,
+					DestinationName: "api",
+					LocalBindPort:   10001,
+				},
+			},
+		},
+	}
+
+	state, cn := newTestState(t, &ns, nil)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	snap, err := state.handler.initialize(ctx)
+	require.NoError(t, err)
+
+	// router and splitter entries for the upstream are watched alongside
+	// its discovery chain
+	for _, id := range []string{"service-router:api", "service-splitter:api"} {
+		cacheType, request := cn.verifyWatch(t, id)
+		require.Equal(t, cachetype.ConfigEntryName, cacheType)
+		ceReq, ok := request.(*structs.ConfigEntryQuery)
+		require.True(t, ok)
+		require.Equal(t, "api", ceReq.Name)
+	}
+
+	// an existing entry records its version
+	require.NoError(t, state.handler.handleUpdate(ctx, cache.UpdateEvent{
+		CorrelationID: "service-router:api",
+		Result: &structs.ConfigEntryResponse{
+			Entry: &structs.ServiceRouterConfigEntry{
+				Kind:      structs.ServiceRouter,
+				Name:      "api",
+				RaftIndex: structs.RaftIndex{ModifyIndex: 12},
+			},
+		},
+	}, &snap))
+	require.Equal(t, map[string]uint64{"service-router/api": 12}, snap.ConnectProxy.RoutingConfigVersions)
+
+	// deleting the entry removes it again
+	require.NoError(t, state.handler.handleUpdate(ctx, cache.UpdateEvent{
+		CorrelationID: "service-router:api",
+		Result:        &structs.ConfigEntryResponse{},
+	}, &snap))
+	require.Empty(t, snap.ConnectProxy.RoutingConfigVersions)
+}
+
+func TestState_UpstreamSummary(t *testing.T) {
+	ns := structs.NodeService{
+		Kind:    structs.ServiceKindConnectProxy,
+		ID:      "web-sidecar-proxy",
+		Service: "web-sidecar-proxy",
+		Address: "10.0.1.1",
+		Port:    443,
+		Proxy: structs.ConnectProxyConfig{
+			DestinationServiceName: "web",
+			Mode:                   structs.ProxyModeTransparent,
+			Upstreams: structs.Upstreams{
+				{
+					// wildcard defaults are not routed to directly
+					DestinationName: structs.WildcardSpecifier,
+				},
+				{
+					DestinationType: structs.UpstreamDestTypeService,
+					DestinationName: "api",
+					LocalBindPort:   10001,
+				},
+				{
+					DestinationType:     structs.UpstreamDestTypeService,
+					DestinationName:     "cache",
+					CentrallyConfigured: true,
+				},
+				{
+					DestinationType: structs.UpstreamDestTypePreparedQuery,
+					DestinationName: "geo",
+					LocalBindPort:   10002,
+				},
+			},
+		},
+	}
+
+	state, _ := newTestState(t, &ns, nil)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	state.cancel = cancel
+
+	snap, err := state.handler.initialize(ctx)
+	require.NoError(t, err)
+
+	roots, leaf := TestCerts(t)
+	for _, event := range []cache.UpdateEvent{
+		{CorrelationID: rootsWatchID, Result: roots},
+		{CorrelationID: leafWatchID, Result: leaf},
+		{CorrelationID: intentionsWatchID, Result: &structs.IndexedIntentionMatches{}},
+		{CorrelationID: meshConfigEntryID, Result: &structs.ConfigEntryResponse{}},
+	} {
+		require.NoError(t, state.handler.handleUpdate(ctx, event, &snap))
+	}
+
+	// "db" is discovered from intentions and its chain compiles
+	require.NoError(t, state.handler.handleUpdate(ctx, cache.UpdateEvent{
+		CorrelationID: intentionUpstreamsID,
+		Result: &structs.IndexedServiceList{
+			Services: structs.ServiceList{structs.NewServiceName("db", nil)},
+		},
+	}, &snap))
+	chain := discoverychain.TestCompileConfigEntries(t, "db", "default", "dc1", "trustdomain.consul", "dc1", nil)
+	require.NoError(t, state.handler.handleUpdate(ctx, cache.UpdateEvent{
+		CorrelationID: "discovery-chain:db",
+		Result:        &structs.DiscoveryChainResponse{Chain: chain},
+	}, &snap))
+
+	// Run the state so that the snapshot read is served race-free.
+	go state.run(ctx, &snap)
+
+	sum := state.UpstreamSummary()
+	require.Equal(t, UpstreamSummary{
+		Explicit:            2, // api and geo
+		CentrallyConfigured: 1, // cache
+		IntentionDiscovered: 1, // db
+		Active:              2, // db via its chain plus the prepared query
+	}, sum)
+}
+
+func TestState_Rebuild(t *testing.T) {
+	ns := structs.NodeService{
+		Kind:    structs.ServiceKindConnectProxy,
+		ID:      "web-sidecar-proxy",
+		Service: "web-sidecar-proxy",
+		Address: "10.0.1.1",
+		Port:    443,
+		Proxy: structs.ConnectProxyConfig{
+			DestinationServiceName: "web",
+			Upstreams: structs.Upstreams{
+				{
+					DestinationType: structs.UpstreamDestTypeService,
+					DestinationName: "api",
+					LocalBindPort:   10001,
+				},
+			},
+		},
+	}
+
+	state, cn := newTestState(t, &ns, nil)
+
+	snapCh, err := state.Watch()
+	require.NoError(t, err)
+	defer state.Close()
+
+	oldWatch := cn.getNotifierRequest(t, rootsWatchID)
+	require.NoError(t, oldWatch.ctx.Err())
+
+	require.NoError(t, state.Rebuild())
+
+	// the old watch context was cancelled and a fresh watch registered in
+	// its place
+	require.Error(t, oldWatch.ctx.Err())
+	newWatch := cn.getNotifierRequest(t, rootsWatchID)
+	require.NoError(t, newWatch.ctx.Err())
+	require.NotSame(t, oldWatch.ctx, newWatch.ctx)
+
+	// the original snapshot channel still receives updates once the rebuilt
+	// watches produce a valid snapshot
+	roots, leaf := TestCerts(t)
+	cn.sendNotification(t, rootsWatchID, cache.UpdateEvent{CorrelationID: rootsWatchID, Result: roots})
+	cn.sendNotification(t, leafWatchID, cache.UpdateEvent{CorrelationID: leafWatchID, Result: leaf})
+	cn.sendNotification(t, intentionsWatchID, cache.UpdateEvent{
+		CorrelationID: intentionsWatchID,
+		Result:        &structs.IndexedIntentionMatches{},
+	})
+	chain := discoverychain.TestCompileConfigEntries(t, "api", "default", "dc1", "trustdomain.consul", "dc1", nil)
+	cn.sendNotification(t, "discovery-chain:api", cache.UpdateEvent{
+		CorrelationID: "discovery-chain:api",
+		Result:        &structs.DiscoveryChainResponse{Chain: chain},
+	})
+
+	select {
+	case snap := <-snapCh:
+		require.Equal(t, roots, snap.Roots)
+		require.Equal(t, leaf, snap.ConnectProxy.Leaf)
+	case <-time.After(time.Second):
+		t.Fatal("timed out waiting for snapshot after rebuild")
+	}
+}
+
+func TestState_WatchStatuses(t *testing.T) {
+	ns := structs.NodeService{
+		Kind:    structs.ServiceKindConnectProxy,
+		ID:      "web-sidecar-proxy",
+		Service: "web-sidecar-proxy",
+		Address: "10.0.1.1",
+		Port:    443,
+		Proxy: structs.ConnectProxyConfig{
+			DestinationServiceName: "web",
+		},
+	}
+
+	state, cn := newTestState(t, &ns, nil)
+
+	_, err := state.Watch()
+	require.NoError(t, err)
+	defer state.Close()
+
+	roots, _ := TestCerts(t)
+	roots.QueryMeta.Index = 5
+	cn.sendNotification(t, rootsWatchID, cache.UpdateEvent{CorrelationID: rootsWatchID, Result: roots})
+
+	retry.Run(t, func(r *retry.R) {
+		status, ok := state.WatchStatuses()[rootsWatchID]
+		if !ok {
+			r.Fatal("no status for roots watch yet")
+		}
+		if status.Index != 5 {
+			r.Fatalf("got index %d want 5", status.Index)
+		}
+		if status.LastUpdated.IsZero() {
+			r.Fatal("missing update time")
+		}
+	})
+
+	// a newer result advances the recorded index
+	roots.QueryMeta.Index = 9
+	cn.sendNotification(t, rootsWatchID, cache.UpdateEvent{CorrelationID: rootsWatchID, Result: roots})
+
+	retry.Run(t, func(r *retry.R) {
+		if got := state.WatchStatuses()[rootsWatchID].Index; got != 9 {
+			r.Fatalf("got index %d want 9", got)
+		}
+	})
+
+	// results without query metadata still record a timestamp
+	_, leaf := TestCerts(t)
+	cn.sendNotification(t, leafWatchID, cache.UpdateEvent{CorrelationID: leafWatchID, Result: leaf})
+
+	retry.Run(t, func(r *retry.R) {
+		status, ok := state.WatchStatuses()[leafWatchID]
+		if !ok {
+			r.Fatal("no status for leaf watch yet")
+		}
+		if status.Index != 0 {
+			r.Fatalf("got index %d want 0", status.Index)
+		}
+		if status.LastUpdated.IsZero() {
+			r.Fatal("missing update time")
+		}
+	})
+}
+
+func TestState_gatewayEndpointSourcePrecedence(t *testing.T) {
+	ns := structs.NodeService{
+		Kind:    structs.ServiceKindMeshGateway,
+		ID:      "mesh-gateway",
+		Service: "mesh-gateway",
+		Address: "10.0.1.1",
+		Port:    443,
+	}
+
+	state, _ := newTestState(t, &ns, nil)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	state.cancel = cancel
+
+	snap, err := state.handler.initialize(ctx)
+	require.NoError(t, err)
+
+	// Federation state knows about dc2 and dc4.
+	require.NoError(t, state.handler.handleUpdate(ctx, cache.UpdateEvent{
+		CorrelationID: federationStateListGatewaysWatchID,
+		Result: &structs.DatacenterIndexedCheckServiceNodes{
+			DatacenterNodes: map[string]structs.CheckServiceNodes{
+				"dc2": TestGatewayNodesDC2(t),
+				"dc4": TestGatewayNodesDC4Hostname(t),
+			},
+		},
+	}, &snap))
+	require.Equal(t, map[string]GatewayEndpointSource{
+		"dc2": GatewayEndpointSourceFedState,
+		"dc4": GatewayEndpointSourceFedState,
+	}, snap.MeshGateway.GatewayEndpointSources)
+
+	// A live gateway dump for dc2 takes precedence over federation state.
+	require.NoError(t, state.handler.handleUpdate(ctx, cache.UpdateEvent{
+		CorrelationID: "mesh-gateway:dc2",
+		Result:        &structs.IndexedNodesWithGateways{Nodes: TestGatewayNodesDC2(t)},
+	}, &snap))
+	require.Equal(t, map[string]GatewayEndpointSource{
+		"dc2": GatewayEndpointSourceDump,
+		"dc4": GatewayEndpointSourceFedState,
+	}, snap.MeshGateway.GatewayEndpointSources)
+
+	// Refreshed federation state must not clobber the dump-derived hostname
+	// endpoints for dc4's hostname-based gateways or dc2's precedence.
+	require.NoError(t, state.handler.handleUpdate(ctx, cache.UpdateEvent{
+		CorrelationID: federationStateListGatewaysWatchID,
+		Result: &structs.DatacenterIndexedCheckServiceNodes{
+			DatacenterNodes: map[string]structs.CheckServiceNodes{
+				"dc2": TestGatewayNodesDC2(t),
+				"dc4": TestGatewayNodesDC4Hostname(t),
+			},
+		},
+	}, &snap))
+	require.Equal(t, GatewayEndpointSourceDump, snap.MeshGateway.GatewayEndpointSources["dc2"])
+
+	// When the dump empties out, federation state is in charge again.
+	require.NoError(t, state.handler.handleUpdate(ctx, cache.UpdateEvent{
+		CorrelationID: "mesh-gateway:dc2",
+		Result:        &structs.IndexedNodesWithGateways{},
+	}, &snap))
+	require.Equal(t, GatewayEndpointSourceFedState, snap.MeshGateway.GatewayEndpointSources["dc2"])
+}
+
+func TestState_TransparentProxyReady(t *testing.T) {
+	ns := structs.NodeService{
+		Kind:    structs.ServiceKindConnectProxy,
+		ID:      "web-sidecar-proxy",
+		Service: "web-sidecar-proxy",
+		Address: "10.0.1.1",
+		Port:    443,
+		Proxy: structs.ConnectProxyConfig{
+			DestinationServiceName: "web",
+			Mode:                   structs.ProxyModeTransparent,
+		},
+	}
+
+	state, _ := newTestState(t, &ns, nil)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	snap, err := state.handler.initialize(ctx)
+	require.NoError(t, err)
+
+	roots, leaf := TestCerts(t)
+	for _, event := range []cache.UpdateEvent{
+		{CorrelationID: rootsWatchID, Result: roots},
+		{CorrelationID: leafWatchID, Result: leaf},
+		{CorrelationID: intentionsWatchID, Result: &structs.IndexedIntentionMatches{}},
+	} {
+		require.NoError(t, state.handler.handleUpdate(ctx, event, &snap))
+	}
+
+	require.False(t, snap.TransparentProxyReady())
+	require.Contains(t, snap.ValidReasons(), "transparent proxy: mesh config not loaded")
+	require.Contains(t, snap.ValidReasons(), "transparent proxy: intention upstreams not loaded")
+
+	// mesh config alone is not enough
+	require.NoError(t, state.handler.handleUpdate(ctx, cache.UpdateEvent{
+		CorrelationID: meshConfigEntryID,
+		Result:        &structs.ConfigEntryResponse{},
+	}, &snap))
+	require.True(t, snap.Valid())
+	require.False(t, snap.TransparentProxyReady())
+
+	// once intention-upstreams arrives the proxy is fully operational
+	require.NoError(t, state.handler.handleUpdate(ctx, cache.UpdateEvent{
+		CorrelationID: intentionUpstreamsID,
+		Result:        &structs.IndexedServiceList{},
+	}, &snap))
+	require.True(t, snap.TransparentProxyReady())
+	require.Empty(t, snap.ValidReasons())
+}
+
+func TestState_coalesceWindowByKind(t *testing.T) {
+	newStateForKind := func(t *testing.T, ns structs.NodeService, cfg stateConfig) *state {
+		cn := newTestCacheNotifier()
+		cfg.logger = testutil.Logger(t)
+		cfg.cache = cn
+		cfg.health = &health.Client{Cache: cn, CacheName: cachetype.HealthServicesName}
+		cfg.source = &structs.QuerySource{Datacenter: "dc1"}
+		state, err := newState(&ns, "", cfg)
+		require.NoError(t, err)
+		return state
+	}
+
+	proxy := structs.NodeService{
+		Kind:    structs.ServiceKindConnectProxy,
+		ID:      "web-sidecar-proxy",
+		Service: "web-sidecar-proxy",
+		Proxy:   structs.ConnectProxyConfig{DestinationServiceName: "web"},
+	}
+	gateway := structs.NodeService{
+		Kind:    structs.ServiceKindMeshGateway,
+		ID:      "mesh-gateway",
+		Service: "mesh-gateway",
+	}
+
+	// connect proxies default to the snappy window, gateways batch longer
+	require.Equal(t, coalesceTimeout, newStateForKind(t, proxy, stateConfig{}).coalesceWindow)
+	require.Equal(t, gatewayCoalesceTimeout, newStateForKind(t, gateway, stateConfig{}).coalesceWindow)
+
+	// an explicit override beats the per-kind default
+	override := stateConfig{coalesceTimeout: 5 * time.Second}
+	require.Equal(t, 5*time.Second, newStateForKind(t, gateway, override).coalesceWindow)
+
+	// a negative override is rejected outright
+	_, err := newState(&proxy, "", stateConfig{
+		logger:          testutil.Logger(t),
+		source:          &structs.QuerySource{Datacenter: "dc1"},
+		coalesceTimeout: -time.Second,
+	})
+	require.Error(t, err)
+}
+
+func TestState_chainTargetWatchCap(t *testing.T) {
+	ns := structs.NodeService{
+		Kind:    structs.ServiceKindConnectProxy,
+		ID:      "web-sidecar-proxy",
+		Service: "web-sidecar-proxy",
+		Address: "10.0.1.1",
+		Port:    443,
+		Proxy: structs.ConnectProxyConfig{
+			DestinationServiceName: "web",
+		},
+	}
+
+	state, _ := newTestState(t, &ns, nil)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// A pathological chain: one primary target and a failover target in
+	// far more datacenters than the cap allows.
+	primary := structs.NewDiscoveryTarget("api", "", "default", "dc1")
+	chain := &structs.CompiledDiscoveryChain{
+		ServiceName: "api",
+		Namespace:   "default",
+		Datacenter:  "dc1",
+		Protocol:    "tcp",
+		StartNode:   "resolver:" + primary.ID,
+		Nodes: map[string]*structs.DiscoveryGraphNode{
+			"resolver:" + primary.ID: {
+				Type: structs.DiscoveryGraphNodeTypeResolver,
+				Name: primary.ID,
+				Resolver: &structs.DiscoveryResolver{
+					Target:         primary.ID,
+					ConnectTimeout: 5 * time.Second,
+				},
+			},
+		},
+		Targets: map[string]*structs.DiscoveryTarget{
+			primary.ID: primary,
+		},
+	}
+	for i := 0; i < maxChainTargetWatches+10; i++ {
+		failover := structs.NewDiscoveryTarget("api", "", "default", fmt.Sprintf("dc%03d", i+2))
+		chain.Targets[failover.ID] = failover
+	}
+
+	snap := ConfigSnapshotUpstreams{
+		DiscoveryChain:           map[string]*structs.CompiledDiscoveryChain{},
+		WatchedUpstreams:         map[string]map[string]context.CancelFunc{},
+		WatchedUpstreamEndpoints: map[string]map[string]structs.CheckServiceNodes{},
+		WatchedGateways:          map[string]map[string]context.CancelFunc{},
+		WatchedGatewayEndpoints:  map[string]map[string]structs.CheckServiceNodes{},
+	}
+
+	up := &handlerUpstreams{handlerState: handlerState{
+		stateConfig:     state.handler.(*handlerConnectProxy).stateConfig,
+		serviceInstance: state.serviceInstance,
+		ch:              state.ch,
+	}}
+	require.NoError(t, up.resetWatchesFromChain(ctx, "api", chain, &snap))
+
+	// The watch count is bounded and the primary target always survives.
+	require.Len(t, snap.WatchedUpstreams["api"], maxChainTargetWatches)
+	require.Contains(t, snap.WatchedUpstreams["api"], primary.ID)
+
+	// Dropping is deterministic: the lexically largest failover DCs lose.
+	require.NotContains(t, snap.WatchedUpstreams["api"], "api.default.dc074")
+	require.Contains(t, snap.WatchedUpstreams["api"], "api.default.dc002")
+}
+
+func TestState_WatchSources(t *testing.T) {
+	ns := structs.NodeService{
+		Kind:    structs.ServiceKindConnectProxy,
+		ID:      "web-sidecar-proxy",
+		Service: "web-sidecar-proxy",
+		Address: "10.0.1.1",
+		Port:    443,
+		Proxy: structs.ConnectProxyConfig{
+			DestinationServiceName: "web",
+		},
+	}
+
+	source := structs.QuerySource{Datacenter: "dc1", Node: "node1"}
+	state, _ := newTestState(t, &ns, func(config *stateConfig) {
+		config.source = &source
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	snapFull, err := state.handler.initialize(ctx)
+	require.NoError(t, err)
+	snap := snapFull.ConnectProxy.ConfigSnapshotUpstreams
+	snap.WatchedUpstreams["api"] = make(map[string]context.CancelFunc)
+	snap.WatchedUpstreamEndpoints["api"] = make(map[string]structs.CheckServiceNodes)
+
+	up := &handlerUpstreams{handlerState: handlerState{
+		stateConfig:     state.handler.(*handlerConnectProxy).stateConfig,
+		serviceInstance: state.serviceInstance,
+		ch:              state.ch,
+	}}
+	require.NoError(t, up.watchUpstreamTarget(ctx, &snap, targetWatchOpts{
+		upstreamID: "api",
+		chainID:    "api.default.dc1",
+		service:    "api",
+		datacenter: "dc1",
+	}))
+	require.NoError(t, up.watchUpstreamTarget(ctx, &snap, targetWatchOpts{
+		upstreamID: "api",
+		chainID:    "api.default.dc2",
+		service:    "api",
+		datacenter: "dc2",
+	}))
+
+	sources := state.WatchSources()
+
+	// the mandatory watches registered by initialize are recorded too
+	require.Equal(t, WatchSource{Datacenter: "dc1", Source: source}, sources[rootsWatchID])
+
+	// local and remote targets both carry the local agent as the source,
+	// differing only in the datacenter the query executes in
+	local := sources["upstream-target:api.default.dc1:api"]
+	require.Equal(t, WatchSource{Datacenter: "dc1", Source: source}, local)
+	remote := sources["upstream-target:api.default.dc2:api"]
+	require.Equal(t, WatchSource{Datacenter: "dc2", Source: source}, remote)
+}
+
+func TestState_SnapshotGeneration(t *testing.T) {
+	ns := structs.NodeService{
+		Kind:    structs.ServiceKindConnectProxy,
+		ID:      "web-sidecar-proxy",
+		Service: "web-sidecar-proxy",
+		Address: "10.0.1.1",
+		Port:    443,
+		Proxy: structs.ConnectProxyConfig{
+			DestinationServiceName: "web",
+		},
+	}
+
+	state, _ := newTestState(t, &ns, nil)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	state.cancel = cancel
+
+	snap, err := state.handler.initialize(ctx)
+	require.NoError(t, err)
+
+	go state.run(ctx, &snap)
+
+	roots, leaf := TestCerts(t)
+	for _, event := range []cache.UpdateEvent{
+		{CorrelationID: rootsWatchID, Result: roots},
+		{CorrelationID: leafWatchID, Result: leaf},
+		{CorrelationID: intentionsWatchID, Result: &structs.IndexedIntentionMatches{}},
+	} {
+		state.ch <- event
+	}
+
+	// All three updates coalesce into the first delivery, which is stamped
+	// with the first generation.
+	select {
+	case got := <-state.snapCh:
+		require.Equal(t, uint64(1), got.Generation)
+	case <-time.After(time.Second):
+		t.Fatal("timed out waiting for initial snapshot")
+	}
+
+	// A further change produces a snapshot with a higher generation.
+	newRoots, _ := TestCerts(t)
+	state.ch <- cache.UpdateEvent{CorrelationID: rootsWatchID, Result: newRoots}
+
+	select {
+	case got := <-state.snapCh:
+		require.Equal(t, uint64(2), got.Generation)
+		require.Equal(t, newRoots, got.Roots)
+	case <-time.After(time.Second):
+		t.Fatal("timed out waiting for updated snapshot")
+	}
+}
+
+// flakyCacheNotifier fails a fixed number of Notify calls before delegating,
+// simulating transient cache registration errors during agent startup.
+type flakyCacheNotifier struct {
+	next     CacheNotifier
+	failures int
+	calls    int
+}
+
+func (f *flakyCacheNotifier) Notify(ctx context.Context, t string, r cache.Request, correlationID string, ch chan<- cache.UpdateEvent) error {
+	f.calls++
+	if f.calls <= f.failures {
+		return errors.New("cache not ready")
+	}
+	return f.next.Notify(ctx, t, r, correlationID, ch)
+}
+
+func TestState_notifyRetriesTransientFailures(t *testing.T) {
+	cn := newTestCacheNotifier()
+
+	t.Run("succeeds on the third attempt", func(t *testing.T) {
+		flaky := &flakyCacheNotifier{next: cn, failures: 2}
+		n := &retryingCacheNotifier{
+			next:    flaky,
+			logger:  testutil.Logger(t),
+			minWait: time.Millisecond,
+			maxWait: time.Millisecond,
+		}
+
+		ch := make(chan cache.UpdateEvent, 1)
+		req := &structs.DCSpecificRequest{Datacenter: "dc1"}
+		require.NoError(t, n.Notify(context.Background(), cachetype.ConnectCARootName, req, rootsWatchID, ch))
+		require.Equal(t, 3, flaky.calls)
+	})
+
+	t.Run("gives up after the retry cap", func(t *testing.T) {
+		flaky := &flakyCacheNotifier{next: cn, failures: 100}
+		n := &retryingCacheNotifier{
+			next:       flaky,
+			logger:     testutil.Logger(t),
+			maxRetries: 2,
+			minWait:    time.Millisecond,
+			maxWait:    time.Millisecond,
+		}
+
+		ch := make(chan cache.UpdateEvent, 1)
+		req := &structs.DCSpecificRequest{Datacenter: "dc1"}
+		require.Error(t, n.Notify(context.Background(), cachetype.ConnectCARootName, req, rootsWatchID, ch))
+		require.Equal(t, 3, flaky.calls)
+	})
+}
+
+func TestState_initializeRetriesNotify(t *testing.T) {
+	ns := structs.NodeService{
+		Kind:    structs.ServiceKindConnectProxy,
+		ID:      "web-sidecar-proxy",
+		Service: "web-sidecar-proxy",
+		Address: "10.0.1.1",
+		Port:    443,
+		Proxy: structs.ConnectProxyConfig{
+			DestinationServiceName: "web",
+		},
+	}
+
+	cn := newTestCacheNotifier()
+	flaky := &flakyCacheNotifier{next: cn, failures: 2}
+	state, err := newState(&ns, "", stateConfig{
+		logger: testutil.Logger(t),
+		cache:  flaky,
+		health: &health.Client{Cache: cn, CacheName: cachetype.HealthServicesName},
+		source: &structs.QuerySource{Datacenter: "dc1"},
+	})
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	_, err = state.handler.initialize(ctx)
+	require.NoError(t, err)
+	require.GreaterOrEqual(t, flaky.calls, 3)
+	cn.verifyWatch(t, rootsWatchID)
+}
+
+func TestState_preparedQueryWatchCancelledOnRemoval(t *testing.T) {
+	ns := structs.NodeService{
+		Kind:    structs.ServiceKindConnectProxy,
+		ID:      "web-sidecar-proxy",
+		Service: "web-sidecar-proxy",
+		Address: "10.0.1.1",
+		Port:    443,
+		Proxy: structs.ConnectProxyConfig{
+			DestinationServiceName: "web",
+			Upstreams: structs.Upstreams{
+				{
+					DestinationType: structs.UpstreamDestTypePreparedQuery,
+					DestinationName: "geo",
+					LocalBindPort:   10001,
+				},
+			},
+		},
+	}
+
+	state, cn := newTestState(t, &ns, nil)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	snap, err := state.handler.initialize(ctx)
+	require.NoError(t, err)
+
+	pqID := "prepared_query:geo"
+	watch := cn.getNotifierRequest(t, "upstream:"+pqID)
+	require.NoError(t, watch.ctx.Err(), "poll should be running while the upstream exists")
+	require.Contains(t, snap.ConnectProxy.WatchedPreparedQueries, pqID)
+
+	// While the upstream is still configured the cleanup pass leaves the
+	// poll alone.
+	event := cache.UpdateEvent{
+		CorrelationID: intentionUpstreamsID,
+		Result:        &structs.IndexedServiceList{},
+	}
+	require.NoError(t, state.handler.handleUpdate(ctx, event, &snap))
+	require.NoError(t, watch.ctx.Err())
+
+	// Removing the upstream stops the poll and drops its endpoints.
+	delete(snap.ConnectProxy.UpstreamConfig, pqID)
+	require.NoError(t, state.handler.handleUpdate(ctx, event, &snap))
+	require.Error(t, watch.ctx.Err(), "poll should stop once the upstream is removed")
+	require.NotContains(t, snap.ConnectProxy.WatchedPreparedQueries, pqID)
+	require.NotContains(t, snap.ConnectProxy.PreparedQueryEndpoints, pqID)
+}
+
+func BenchmarkStateChanged(b *testing.B) {
+	ns := structs.TestNodeServiceProxy(b)
+	upstreams := make(structs.Upstreams, 50)
+	for i := range upstreams {
+		upstreams[i] = structs.Upstream{
+			DestinationType: structs.UpstreamDestTypeService,
+			DestinationName: fmt.Sprintf("svc-%02d", i),
+			LocalBindPort:   10000 + i,
+			Config: map[string]interface{}{
+				"connect_timeout_ms": 500,
+			},
+		}
+	}
+	ns.Proxy.Upstreams = upstreams
+
+	state, err := newState(ns, "token", stateConfig{logger: hclog.New(nil)})
+	require.NoError(b, err)
+
+	b.Run("unchanged", func(b *testing.B) {
+		for n := 0; n < b.N; n++ {
+			if state.Changed(ns, "token") {
+				b.Fatal("expected unchanged")
+			}
+		}
+	})
+
+	b.Run("changed", func(b *testing.B) {
+		changed := *ns
+		changed.Proxy.Upstreams = append(structs.Upstreams{}, upstreams...)
+		changed.Proxy.Upstreams[49].LocalBindPort = 20000
+		for n := 0; n < b.N; n++ {
+			if !state.Changed(&changed, "token") {
+				b.Fatal("expected changed")
+			}
+		}
+	})
+}
+
+func TestState_CurrentSnapshotContext(t *testing.T) {
+	ns := structs.NodeService{
+		Kind:    structs.ServiceKindConnectProxy,
+		ID:      "web-sidecar-proxy",
+		Service: "web-sidecar-proxy",
+		Address: "10.0.1.1",
+		Port:    443,
+		Proxy: structs.ConnectProxyConfig{
+			DestinationServiceName: "web",
+		},
+	}
+
+	state, _ := newTestState(t, &ns, nil)
+
+	// Without a running loop nothing services reqCh, so the bounded variant
+	// must give up when its context expires.
+	timeoutCtx, timeoutCancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer timeoutCancel()
+	snap, err := state.CurrentSnapshotContext(timeoutCtx)
+	require.Equal(t, context.DeadlineExceeded, err)
+	require.Nil(t, snap)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	state.cancel = cancel
+
+	initSnap, err := state.handler.initialize(ctx)
+	require.NoError(t, err)
+	go state.run(ctx, &initSnap)
+
+	// A running but not-yet-valid state replies with a nil snapshot and no
+	// error.
+	snap, err = state.CurrentSnapshotContext(context.Background())
+	require.NoError(t, err)
+	require.Nil(t, snap)
+}
+
+func TestState_snapshotBufferSize(t *testing.T) {
+	newNS := func() *structs.NodeService {
+		return &structs.NodeService{
+			Kind:    structs.ServiceKindConnectProxy,
+			ID:      "web-sidecar-proxy",
+			Service: "web-sidecar-proxy",
+			Address: "10.0.1.1",
+			Port:    443,
+			Proxy: structs.ConnectProxyConfig{
+				DestinationServiceName: "web",
+			},
+		}
+	}
+
+	t.Run("negative size is rejected", func(t *testing.T) {
+		_, err := newState(newNS(), "", stateConfig{
+			logger:             testutil.Logger(t),
+			snapshotBufferSize: -1,
+		})
+		require.Error(t, err)
+	})
+
+	// With no consumer reading, a larger buffer absorbs successive
+	// deliveries that a single-slot buffer would push onto the redelivery
+	// retry path.
+	for _, tc := range []struct {
+		name       string
+		bufferSize int
+		expectLen  int
+	}{
+		{"default buffer holds one delivery", 0, 1},
+		{"larger buffer absorbs the second delivery", 2, 2},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			state, _ := newTestState(t, newNS(), func(config *stateConfig) {
+				config.coalesceTimeout = time.Millisecond
+				config.snapshotBufferSize = tc.bufferSize
+			})
+
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			state.cancel = cancel
+
+			snap, err := state.handler.initialize(ctx)
+			require.NoError(t, err)
+			go state.run(ctx, &snap)
+
+			roots, leaf := TestCerts(t)
+			for _, event := range []cache.UpdateEvent{
+				{CorrelationID: rootsWatchID, Result: roots},
+				{CorrelationID: leafWatchID, Result: leaf},
+				{CorrelationID: intentionsWatchID, Result: &structs.IndexedIntentionMatches{}},
+			} {
+				state.ch <- event
+			}
+
+			retry.Run(t, func(r *retry.R) {
+				if got := len(state.snapCh); got != 1 {
+					r.Fatalf("got %d buffered snapshots want 1", got)
+				}
+			})
+
+			newRoots, _ := TestCerts(t)
+			state.ch <- cache.UpdateEvent{CorrelationID: rootsWatchID, Result: newRoots}
+
+			if tc.expectLen > 1 {
+				retry.Run(t, func(r *retry.R) {
+					if got := len(state.snapCh); got != tc.expectLen {
+						r.Fatalf("got %d buffered snapshots want %d", got, tc.expectLen)
+					}
+				})
+			} else {
+				// The second delivery cannot land until a consumer drains
+				// the buffer, so it stays on the retry path.
+				time.Sleep(50 * time.Millisecond)
+				require.Equal(t, tc.expectLen, len(state.snapCh))
+			}
+		})
+	}
+}
+
+func BenchmarkConfigSnapshotClone(b *testing.B) {
+	snap := &ConfigSnapshot{
+		Kind:       structs.ServiceKindMeshGateway,
+		Service:    "mesh-gateway",
+		ProxyID:    structs.NewServiceID("mesh-gateway", nil),
+		Datacenter: "dc1",
+	}
+	roots, _ := TestCerts(b)
+	snap.Roots = roots
+	snap.MeshGateway.ServiceGroups = make(map[structs.ServiceName]structs.CheckServiceNodes, 300)
+	for i := 0; i < 300; i++ {
+		sn := structs.NewServiceName(fmt.Sprintf("svc-%03d", i), nil)
+		snap.MeshGateway.ServiceGroups[sn] = TestUpstreamNodes(b)
+	}
+
+	b.Run("full clone", func(b *testing.B) {
+		for n := 0; n < b.N; n++ {
+			if _, err := snap.Clone(); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+
+	b.Run("roots-only reuse", func(b *testing.B) {
+		prev, err := snap.Clone()
+		require.NoError(b, err)
+		b.ResetTimer()
+		for n := 0; n < b.N; n++ {
+			if _, err := snap.cloneReusing(prev, snapshotSections{roots: true}); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+
+	b.Run("unchanged reuse", func(b *testing.B) {
+		prev, err := snap.Clone()
+		require.NoError(b, err)
+		b.ResetTimer()
+		for n := 0; n < b.N; n++ {
+			if _, err := snap.cloneReusing(prev, snapshotSections{}); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+func TestState_meshGatewayConnectServicesOnly(t *testing.T) {
+	ns := structs.NodeService{
+		Kind:    structs.ServiceKindMeshGateway,
+		ID:      "mesh-gateway",
+		Service: "mesh-gateway",
+		Address: "10.0.1.1",
+		Port:    443,
+		Proxy: structs.ConnectProxyConfig{
+			Config: map[string]interface{}{
+				"mesh_gateway_connect_services_only": true,
+			},
+		},
+	}
+
+	state, cn := newTestState(t, &ns, nil)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	snap, err := state.handler.initialize(ctx)
+	require.NoError(t, err)
+
+	// The filter registers an extra watch on the connect proxy dump.
+	cacheType, req := cn.verifyWatch(t, connectKindServicesWatchID)
+	require.Equal(t, cachetype.InternalServiceDumpName, cacheType)
+	dumpReq, ok := req.(*structs.ServiceDumpRequest)
+	require.True(t, ok)
+	require.Equal(t, structs.ServiceKindConnectProxy, dumpReq.ServiceKind)
+	require.True(t, dumpReq.UseServiceKind)
+
+	web := structs.NewServiceName("web", nil)
+	db := structs.NewServiceName("db", nil)
+
+	// The catalog lists both services but nothing is known to be
+	// connect-capable yet, so no connect-service watches are registered.
+	err = state.handler.handleUpdate(ctx, cache.UpdateEvent{
+		CorrelationID: serviceListWatchID,
+		Result:        &structs.IndexedServiceList{Services: []structs.ServiceName{web, db}},
+	}, &snap)
+	require.NoError(t, err)
+	require.Empty(t, snap.MeshGateway.WatchedServices)
+
+	// Only web has a connect proxy instance, so only web gets a watch.
+	err = state.handler.handleUpdate(ctx, cache.UpdateEvent{
+		CorrelationID: connectKindServicesWatchID,
+		Result: &structs.IndexedNodesWithGateways{
+			Nodes: structs.CheckServiceNodes{
+				{
+					Node: &structs.Node{Node: "node1", Address: "10.0.0.1"},
+					Service: &structs.NodeService{
+						Kind:    structs.ServiceKindConnectProxy,
+						ID:      "web-sidecar-proxy",
+						Service: "web-sidecar-proxy",
+						Proxy:   structs.ConnectProxyConfig{DestinationServiceName: "web"},
+					},
+				},
+			},
+		},
+	}, &snap)
+	require.NoError(t, err)
+	require.Contains(t, snap.MeshGateway.WatchedServices, web)
+	require.NotContains(t, snap.MeshGateway.WatchedServices, db)
+	webWatch := cn.getNotifierRequest(t, "connect-service:web")
+
+	// When web loses its proxies the watch is cancelled again.
+	err = state.handler.handleUpdate(ctx, cache.UpdateEvent{
+		CorrelationID: connectKindServicesWatchID,
+		Result:        &structs.IndexedNodesWithGateways{},
+	}, &snap)
+	require.NoError(t, err)
+	require.Empty(t, snap.MeshGateway.WatchedServices)
+	require.Error(t, webWatch.ctx.Err())
+}
+
+func TestState_meshGatewayServiceFilter(t *testing.T) {
+	ns := structs.NodeService{
+		Kind:    structs.ServiceKindMeshGateway,
+		ID:      "mesh-gateway",
+		Service: "mesh-gateway",
+		Address: "10.0.1.1",
+		Port:    443,
+		Proxy: structs.ConnectProxyConfig{
+			Config: map[string]interface{}{
+				"mesh_gateway_service_filter": `Name == "web"`,
+			},
+		},
+	}
+
+	state, cn := newTestState(t, &ns, nil)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	snap, err := state.handler.initialize(ctx)
+	require.NoError(t, err)
+
+	web := structs.NewServiceName("web", nil)
+	db := structs.NewServiceName("db", nil)
+	serviceList := cache.UpdateEvent{
+		CorrelationID: serviceListWatchID,
+		Result:        &structs.IndexedServiceList{Services: []structs.ServiceName{web, db}},
+	}
+
+	// Only the matching service gets a connect-service watch.
+	require.NoError(t, state.handler.handleUpdate(ctx, serviceList, &snap))
+	require.Contains(t, snap.MeshGateway.WatchedServices, web)
+	require.NotContains(t, snap.MeshGateway.WatchedServices, db)
+	webWatch := cn.getNotifierRequest(t, "connect-service:web")
+
+	// Changing the filter swings the watches across on the next
+	// reconciliation: web is cancelled and db added.
+	newFilter, err := bexpr.CreateFilter(`Name == "db"`, nil, []structs.ServiceName{})
+	require.NoError(t, err)
+	state.handler.(*handlerMeshGateway).serviceFilter = newFilter
+
+	require.NoError(t, state.handler.handleUpdate(ctx, serviceList, &snap))
+	require.NotContains(t, snap.MeshGateway.WatchedServices, web)
+	require.Contains(t, snap.MeshGateway.WatchedServices, db)
+	require.Error(t, webWatch.ctx.Err(), "filtered-out service watch should be cancelled")
+}
+
+func TestHostnameEndpoints(t *testing.T) {
+	logger := testutil.Logger(t)
+
+	// From dc1's perspective the dc4 gateways resolve to two hostnames and
+	// one IP address.
+	nodes := TestGatewayNodesDC4Hostname(t)
+
+	t.Run("defaults to hostnames", func(t *testing.T) {
+		got := hostnameEndpoints(logger, "dc1", nodes, hostnameEndpointsConfig{})
+		require.Len(t, got, 2)
+		for _, n := range got {
+			addr, _ := n.BestAddress(true)
+			require.Contains(t, addr, "elb.notaws.com")
+		}
+	})
+
+	t.Run("prefers IPs when configured", func(t *testing.T) {
+		got := hostnameEndpoints(logger, "dc1", nodes, hostnameEndpointsConfig{PreferIPEndpoints: true})
+		require.Len(t, got, 1)
+		addr, _ := got[0].BestAddress(true)
+		require.Equal(t, "198.38.1.1", addr)
+	})
+
+	t.Run("ipv6 literals are not hostnames", func(t *testing.T) {
+		v6nodes := structs.CheckServiceNodes{
+			{
+				Node:    &structs.Node{Node: "a", Address: "[2001:db8::1]", Datacenter: "dc1"},
+				Service: &structs.NodeService{Service: "api", Port: 8080},
+			},
+			{
+				Node:    &structs.Node{Node: "b", Address: "fe80::1%eth0", Datacenter: "dc1"},
+				Service: &structs.NodeService{Service: "api", Port: 8080},
+			},
+			{
+				Node:    &structs.Node{Node: "c", Address: "db.example.com", Datacenter: "dc1"},
+				Service: &structs.NodeService{Service: "api", Port: 8080},
+			},
+		}
+
+		got := hostnameEndpoints(logger, "dc1", v6nodes, hostnameEndpointsConfig{})
+		require.Len(t, got, 1)
+		addr, _ := got[0].BestAddress(false)
+		require.Equal(t, "db.example.com", addr)
+	})
+
+	t.Run("preference parsed from proxy config", func(t *testing.T) {
+		require.True(t, parseHostnameEndpointsConfig(logger, map[string]interface{}{
+			"prefer_ip_endpoints": true,
+		}).PreferIPEndpoints)
+		require.False(t, parseHostnameEndpointsConfig(logger, nil).PreferIPEndpoints)
+	})
+
+	hostnameNode := func(name, addr, status string) structs.CheckServiceNode {
+		return structs.CheckServiceNode{
+			Node:    &structs.Node{Node: name, Address: addr, Datacenter: "dc1"},
+			Service: &structs.NodeService{Service: "gw", Port: 443},
+			Checks: structs.HealthChecks{
+				{Node: name, CheckID: "check", Status: status},
+			},
+		}
+	}
+	mixed := structs.CheckServiceNodes{
+		hostnameNode("a", "a.example.com", api.HealthCritical),
+		hostnameNode("b", "b.example.com", api.HealthPassing),
+		hostnameNode("c", "c.example.com", api.HealthWarning),
+		hostnameNode("d", "d.example.com", api.HealthPassing),
+	}
+
+	t.Run("sorted by health tier", func(t *testing.T) {
+		got := hostnameEndpoints(logger, "dc1", mixed, hostnameEndpointsConfig{})
+		require.Len(t, got, 4)
+
+		var order []string
+		for _, n := range got {
+			order = append(order, n.Node.Node)
+		}
+		// Passing nodes keep their relative order ahead of warning and
+		// critical ones.
+		require.Equal(t, []string{"b", "d", "c", "a"}, order)
+	})
+
+	t.Run("critical endpoints dropped when configured", func(t *testing.T) {
+		got := hostnameEndpoints(logger, "dc1", mixed, hostnameEndpointsConfig{
+			DropCriticalHostnameEndpoints: true,
+		})
+		require.Len(t, got, 3)
+		for _, n := range got {
+			require.NotEqual(t, "a", n.Node.Node)
+		}
+	})
+}
+
+func TestState_meshGatewayConnectNativeServices(t *testing.T) {
+	ns := structs.NodeService{
+		Kind:    structs.ServiceKindMeshGateway,
+		ID:      "mesh-gateway",
+		Service: "mesh-gateway",
+		Address: "10.0.1.1",
+		Port:    443,
+		Proxy: structs.ConnectProxyConfig{
+			Config: map[string]interface{}{
+				"mesh_gateway_connect_services_only": true,
+			},
+		},
+	}
+
+	state, cn := newTestState(t, &ns, nil)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	snap, err := state.handler.initialize(ctx)
+	require.NoError(t, err)
+
+	// The filter registers a companion watch on the full service dump to
+	// spot connect-native instances.
+	cacheType, req := cn.verifyWatch(t, connectNativeServicesWatchID)
+	require.Equal(t, cachetype.InternalServiceDumpName, cacheType)
+	dumpReq, ok := req.(*structs.ServiceDumpRequest)
+	require.True(t, ok)
+	require.False(t, dumpReq.UseServiceKind)
+
+	db := structs.NewServiceName("db", nil)
+
+	err = state.handler.handleUpdate(ctx, cache.UpdateEvent{
+		CorrelationID: serviceListWatchID,
+		Result:        &structs.IndexedServiceList{Services: []structs.ServiceName{db}},
+	}, &snap)
+	require.NoError(t, err)
+	require.Empty(t, snap.MeshGateway.WatchedServices)
+
+	// db has no sidecar but registers as connect-native, so it still gets a
+	// connect-service watch.
+	dbNative := structs.CheckServiceNodes{
+		{
+			Node: &structs.Node{Node: "node1", Address: "10.0.0.1", Datacenter: "dc1"},
+			Service: &structs.NodeService{
+				ID:      "db",
+				Service: "db",
+				Port:    5432,
+				Connect: structs.ServiceConnect{Native: true},
+			},
+		},
+	}
+	err = state.handler.handleUpdate(ctx, cache.UpdateEvent{
+		CorrelationID: connectNativeServicesWatchID,
+		Result:        &structs.IndexedNodesWithGateways{Nodes: dbNative},
+	}, &snap)
+	require.NoError(t, err)
+	require.Contains(t, snap.MeshGateway.WatchedServices, db)
+
+	// The health result for the native service lands in ServiceGroups like
+	// any proxied service.
+	err = state.handler.handleUpdate(ctx, cache.UpdateEvent{
+		CorrelationID: "connect-service:db",
+		Result:        &structs.IndexedCheckServiceNodes{Nodes: dbNative},
+	}, &snap)
+	require.NoError(t, err)
+	require.Equal(t, dbNative, snap.MeshGateway.ServiceGroups[db])
+}
+
+func TestState_WatchDiagnostics(t *testing.T) {
+	ns := structs.NodeService{
+		Kind:    structs.ServiceKindConnectProxy,
+		ID:      "web-sidecar-proxy",
+		Service: "web-sidecar-proxy",
+		Address: "10.0.1.1",
+		Port:    443,
+		Proxy: structs.ConnectProxyConfig{
+			DestinationServiceName: "web",
+		},
+	}
+
+	state, cn := newTestState(t, &ns, nil)
+
+	_, err := state.Watch()
+	require.NoError(t, err)
+	defer state.Close()
+
+	byID := func(infos []WatchInfo) map[string]WatchInfo {
+		m := make(map[string]WatchInfo, len(infos))
+		for _, info := range infos {
+			m[info.CorrelationID] = info
+		}
+		return m
+	}
+
+	infos := byID(state.WatchDiagnostics())
+	require.Contains(t, infos, rootsWatchID)
+	require.Contains(t, infos, leafWatchID)
+	require.Contains(t, infos, intentionsWatchID)
+	require.Equal(t, cachetype.ConnectCARootName, infos[rootsWatchID].Type)
+	require.Equal(t, cachetype.ConnectCALeafName, infos[leafWatchID].Type)
+	require.True(t, infos[rootsWatchID].LastUpdated.IsZero())
+
+	roots, _ := TestCerts(t)
+	cn.sendNotification(t, rootsWatchID, cache.UpdateEvent{CorrelationID: rootsWatchID, Result: roots})
+
+	retry.Run(t, func(r *retry.R) {
+		info := byID(state.WatchDiagnostics())[rootsWatchID]
+		if info.LastUpdated.IsZero() {
+			r.Fatal("roots watch has no update time yet")
+		}
+	})
+}
+
+func TestState_OnSnapshotHook(t *testing.T) {
+	ns := structs.NodeService{
+		Kind:    structs.ServiceKindConnectProxy,
+		ID:      "web-sidecar-proxy",
+		Service: "web-sidecar-proxy",
+		Address: "10.0.1.1",
+		Port:    443,
+		Proxy: structs.ConnectProxyConfig{
+			DestinationServiceName: "web",
+		},
+	}
+
+	var mu sync.Mutex
+	var seen []uint64
+
+	state, _ := newTestState(t, &ns, func(config *stateConfig) {
+		config.onSnapshot = func(snap *ConfigSnapshot) {
+			mu.Lock()
+			seen = append(seen, snap.Generation)
+			mu.Unlock()
+		}
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	state.cancel = cancel
+
+	snap, err := state.handler.initialize(ctx)
+	require.NoError(t, err)
+
+	go state.run(ctx, &snap)
+
+	roots, leaf := TestCerts(t)
+	for _, event := range []cache.UpdateEvent{
+		{CorrelationID: rootsWatchID, Result: roots},
+		{CorrelationID: leafWatchID, Result: leaf},
+		{CorrelationID: intentionsWatchID, Result: &structs.IndexedIntentionMatches{}},
+	} {
+		state.ch <- event
+	}
+
+	select {
+	case <-state.snapCh:
+	case <-time.After(time.Second):
+		t.Fatal("timed out waiting for initial snapshot")
+	}
+
+	newRoots, _ := TestCerts(t)
+	state.ch <- cache.UpdateEvent{CorrelationID: rootsWatchID, Result: newRoots}
+
+	select {
+	case <-state.snapCh:
+	case <-time.After(time.Second):
+		t.Fatal("timed out waiting for updated snapshot")
+	}
+
+	// The hook saw each generation exactly once, even though redelivery
+	// attempts can run the send path multiple times.
+	mu.Lock()
+	defer mu.Unlock()
+	require.Equal(t, []uint64{1, 2}, seen)
+}
+
+func TestParseReducedUpstreamConfig(t *testing.T) {
+	cfg, err := parseReducedUpstreamConfig(map[string]interface{}{
+		"protocol":           "http",
+		"connect_timeout_ms": 1500,
+		"limits": map[string]interface{}{
+			"max_connections":      3,
+			"max_pending_requests": 7,
+		},
+		"passive_health_check": map[string]interface{}{
+			"interval":     "10s",
+			"max_failures": 2,
+		},
+	})
+	require.NoError(t, err)
+	require.Equal(t, "http", cfg.Protocol)
+	require.Equal(t, 1500*time.Millisecond, cfg.ConnectTimeout())
+	require.NotNil(t, cfg.Limits)
+	require.Equal(t, 3, *cfg.Limits.MaxConnections)
+	require.Equal(t, 7, *cfg.Limits.MaxPendingRequests)
+	require.NotNil(t, cfg.PassiveHealthCheck)
+	require.Equal(t, 10*time.Second, cfg.PassiveHealthCheck.Interval)
+	require.Equal(t, uint32(2), cfg.PassiveHealthCheck.MaxFailures)
+}
+
+func TestState_upstreamConfigOverridesPropagate(t *testing.T) {
+	ns := structs.NodeService{
+		Kind:    structs.ServiceKindConnectProxy,
+		ID:      "web-sidecar-proxy",
+		Service: "web-sidecar-proxy",
+		Address: "10.0.1.1",
+		Port:    443,
+		Proxy: structs.ConnectProxyConfig{
+			DestinationServiceName: "web",
+			Upstreams: structs.Upstreams{
+				{
+					DestinationType: structs.UpstreamDestTypeService,
+					DestinationName: "api",
+					LocalBindPort:   10001,
+					Config: map[string]interface{}{
+						"protocol": "http",
+						"limits": map[string]interface{}{
+							"max_connections": 5,
+						},
+						"passive_health_check": map[string]interface{}{
+							"max_failures": 4,
+						},
+					},
+				},
+			},
+		},
+	}
+
+	state, cn := newTestState(t, &ns, nil)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	_, err := state.handler.initialize(ctx)
+	require.NoError(t, err)
+
+	cacheType, req := cn.verifyWatch(t, "discovery-chain:api")
+	require.Equal(t, cachetype.CompiledDiscoveryChainName, cacheType)
+	chainReq, ok := req.(*structs.DiscoveryChainRequest)
+	require.True(t, ok)
+	require.Equal(t, "http", chainReq.OverrideProtocol)
+	require.NotNil(t, chainReq.OverrideLimits)
+	require.Equal(t, 5, *chainReq.OverrideLimits.MaxConnections)
+	require.NotNil(t, chainReq.OverridePassiveHealthCheck)
+	require.Equal(t, uint32(4), chainReq.OverridePassiveHealthCheck.MaxFailures)
+}
+
+func TestState_strictUpstreamConfigWarnsOnUnknownKeys(t *testing.T) {
+	ns := structs.NodeService{
+		Kind:    structs.ServiceKindConnectProxy,
+		ID:      "web-sidecar-proxy",
+		Service: "web-sidecar-proxy",
+		Address: "10.0.1.1",
+		Port:    443,
+		Proxy: structs.ConnectProxyConfig{
+			DestinationServiceName: "web",
+			Upstreams: structs.Upstreams{
+				{
+					DestinationType: structs.UpstreamDestTypeService,
+					DestinationName: "api",
+					LocalBindPort:   10001,
+					Config: map[string]interface{}{
+						"conect_timeout_ms": 1500,
+					},
+				},
+			},
+		},
+	}
+
+	var logBuf bytes.Buffer
+	logger := hclog.New(&hclog.LoggerOptions{Output: &logBuf})
+
+	state, _ := newTestState(t, &ns, func(config *stateConfig) {
+		config.logger = logger
+		config.strictUpstreamConfig = true
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	_, err := state.handler.initialize(ctx)
+	require.NoError(t, err)
+
+	out := logBuf.String()
+	require.Contains(t, out, "upstream config contains unknown keys")
+	require.Contains(t, out, "conect_timeout_ms")
+	require.Contains(t, out, "api")
+}
+
+func TestState_sharedDiscoveryChainWatches(t *testing.T) {
+	ns := structs.NodeService{
+		Kind:    structs.ServiceKindConnectProxy,
+		ID:      "web-sidecar-proxy",
+		Service: "web-sidecar-proxy",
+		Address: "10.0.1.1",
+		Port:    443,
+		Proxy: structs.ConnectProxyConfig{
+			DestinationServiceName: "web",
+		},
+	}
+
+	state, cn := newTestState(t, &ns, nil)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	snap, err := state.handler.initialize(ctx)
+	require.NoError(t, err)
+
+	up := &handlerUpstreams{handlerState: state.handler.(*handlerConnectProxy).handlerState}
+
+	// Two upstream ids with identical chain request parameters share one
+	// underlying watch, registered under the first id's correlation.
+	for _, id := range []string{"api", "api-clone"} {
+		require.NoError(t, up.watchDiscoveryChain(ctx, &snap, discoveryChainWatchOpts{
+			id:         id,
+			name:       "api",
+			namespace:  "default",
+			datacenter: "dc1",
+		}))
+	}
+
+	primaryWatch := cn.getNotifierRequest(t, "discovery-chain:api")
+	cn.lock.RLock()
+	_, cloneRegistered := cn.notifiers["discovery-chain:api-clone"]
+	cn.lock.RUnlock()
+	require.False(t, cloneRegistered, "expected second upstream to share the first watch")
+
+	require.Len(t, snap.ConnectProxy.WatchedChainsByKey, 1)
+	require.Len(t, snap.ConnectProxy.WatchedDiscoveryChains, 2)
+
+	// A result delivered under the primary correlation is fanned out to
+	// both upstreams.
+	chain := discoverychain.TestCompileConfigEntries(t, "api", "default", "dc1", connect.TestClusterID+".consul", "dc1", nil)
+	err = state.handler.handleUpdate(ctx, cache.UpdateEvent{
+		CorrelationID: "discovery-chain:api",
+		Result:        &structs.DiscoveryChainResponse{Chain: chain},
+	}, &snap)
+	require.NoError(t, err)
+	require.Contains(t, snap.ConnectProxy.DiscoveryChain, "api")
+	require.Contains(t, snap.ConnectProxy.DiscoveryChain, "api-clone")
+
+	// Dropping one reference keeps the watch alive; dropping the last one
+	// cancels it.
+	snap.ConnectProxy.WatchedDiscoveryChains["api-clone"]()
+	delete(snap.ConnectProxy.WatchedDiscoveryChains, "api-clone")
+	require.NoError(t, primaryWatch.ctx.Err())
+
+	snap.ConnectProxy.WatchedDiscoveryChains["api"]()
+	require.Error(t, primaryWatch.ctx.Err())
+	require.Empty(t, snap.ConnectProxy.WatchedChainsByKey)
+}
+
+func TestState_passthroughUpstreamsPruned(t *testing.T) {
+	ns := structs.NodeService{
+		Kind:    structs.ServiceKindConnectProxy,
+		ID:      "web-sidecar-proxy",
+		Service: "web-sidecar-proxy",
+		Address: "10.0.1.1",
+		Port:    443,
+		Proxy: structs.ConnectProxyConfig{
+			DestinationServiceName: "web",
+			Mode:                   structs.ProxyModeTransparent,
+		},
+	}
+
+	state, _ := newTestState(t, &ns, nil)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	snap, err := state.handler.initialize(ctx)
+	require.NoError(t, err)
+
+	roots, _ := TestCerts(t)
+	snap.Roots = roots
+
+	node := func(name, addr string) structs.CheckServiceNode {
+		return structs.CheckServiceNode{
+			Node: &structs.Node{Node: name, Address: addr, Datacenter: "dc1"},
+			Service: &structs.NodeService{
+				Kind:    structs.ServiceKindConnectProxy,
+				ID:      "api-sidecar-proxy",
+				Service: "api-sidecar-proxy",
+				Port:    8443,
+				Proxy: structs.ConnectProxyConfig{
+					DestinationServiceName: "api",
+					TransparentProxy:       structs.TransparentProxyConfig{DialedDirectly: true},
+				},
+			},
+		}
+	}
+
+	api := structs.NewServiceName("api", nil)
+
+	// Two dialed-directly instances produce two passthrough addresses.
+	err = state.handler.handleUpdate(ctx, cache.UpdateEvent{
+		CorrelationID: "upstream-target:api.default.dc1:api",
+		Result: &structs.IndexedCheckServiceNodes{
+			Nodes: structs.CheckServiceNodes{node("node1", "10.0.0.1"), node("node2", "10.0.0.2")},
+		},
+	}, &snap)
+	require.NoError(t, err)
+	require.Equal(t, map[string]struct{}{"10.0.0.1": {}, "10.0.0.2": {}},
+		snap.ConnectProxy.PassthroughUpstreams[api.String()].Addrs)
+
+	// When one instance goes away its address is pruned.
+	err = state.handler.handleUpdate(ctx, cache.UpdateEvent{
+		CorrelationID: "upstream-target:api.default.dc1:api",
+		Result: &structs.IndexedCheckServiceNodes{
+			Nodes: structs.CheckServiceNodes{node("node1", "10.0.0.1")},
+		},
+	}, &snap)
+	require.NoError(t, err)
+	require.Equal(t, map[string]struct{}{"10.0.0.1": {}},
+		snap.ConnectProxy.PassthroughUpstreams[api.String()].Addrs)
+
+	// With no instances left the whole entry is removed.
+	err = state.handler.handleUpdate(ctx, cache.UpdateEvent{
+		CorrelationID: "upstream-target:api.default.dc1:api",
+		Result:        &structs.IndexedCheckServiceNodes{},
+	}, &snap)
+	require.NoError(t, err)
+	require.NotContains(t, snap.ConnectProxy.PassthroughUpstreams, api.String())
+	require.Empty(t, snap.ConnectProxy.PassthroughContributions)
+}
+
+func TestState_peeredUpstreamWatch(t *testing.T) {
+	ns := structs.NodeService{
+		Kind:    structs.ServiceKindConnectProxy,
+		ID:      "web-sidecar-proxy",
+		Service: "web-sidecar-proxy",
+		Address: "10.0.1.1",
+		Port:    443,
+		Proxy: structs.ConnectProxyConfig{
+			DestinationServiceName: "web",
+			Upstreams: structs.Upstreams{
+				{
+					DestinationType: structs.UpstreamDestTypeService,
+					DestinationName: "api",
+					DestinationPeer: "cluster-01",
+					LocalBindPort:   10001,
+				},
+			},
+		},
+	}
+
+	state, cn := newTestState(t, &ns, nil)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	snap, err := state.handler.initialize(ctx)
+	require.NoError(t, err)
+
+	correlationID := upstreamPeerWatchIDPrefix + "api?peer=cluster-01"
+	cacheType, req := cn.verifyWatch(t, correlationID)
+	require.Equal(t, cachetype.HealthServicesName, cacheType)
+	healthReq, ok := req.(*structs.ServiceSpecificRequest)
+	require.True(t, ok)
+	require.Equal(t, "cluster-01", healthReq.PeerName)
+	require.Equal(t, "api", healthReq.ServiceName)
+	require.True(t, healthReq.Connect)
+
+	// No discovery chain should be compiled for a peered upstream.
+	cn.lock.Lock()
+	_, ok = cn.notifiers["discovery-chain:api?peer=cluster-01"]
+	cn.lock.Unlock()
+	require.False(t, ok)
+
+	// Imported instances land in the snapshot keyed by the upstream.
+	err = state.handler.handleUpdate(ctx, cache.UpdateEvent{
+		CorrelationID: correlationID,
+		Result: &structs.IndexedCheckServiceNodes{
+			Nodes: structs.CheckServiceNodes{
+				{
+					Node:    &structs.Node{Node: "node1", Address: "10.1.2.3"},
+					Service: &structs.NodeService{ID: "api", Service: "api", Port: 8080},
+				},
+			},
+		},
+	}, &snap)
+	require.NoError(t, err)
+	require.Len(t, snap.ConnectProxy.PeerUpstreamEndpoints["api?peer=cluster-01"], 1)
+}
+
+func TestState_meshConfigWatchedInDirectMode(t *testing.T) {
+	ns := structs.NodeService{
+		Kind:    structs.ServiceKindConnectProxy,
+		ID:      "web-sidecar-proxy",
+		Service: "web-sidecar-proxy",
+		Address: "10.0.1.1",
+		Port:    443,
+		Proxy: structs.ConnectProxyConfig{
+			DestinationServiceName: "web",
+		},
+	}
+
+	state, cn := newTestState(t, &ns, nil)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	snap, err := state.handler.initialize(ctx)
+	require.NoError(t, err)
+
+	cacheType, req := cn.verifyWatch(t, meshConfigEntryID)
+	require.Equal(t, cachetype.ConfigEntryName, cacheType)
+	ceReq, ok := req.(*structs.ConfigEntryQuery)
+	require.True(t, ok)
+	require.Equal(t, structs.MeshConfig, ceReq.Kind)
+
+	err = state.handler.handleUpdate(ctx, cache.UpdateEvent{
+		CorrelationID: meshConfigEntryID,
+		Result: &structs.ConfigEntryResponse{
+			Entry: &structs.MeshConfigEntry{
+				TransparentProxy: structs.TransparentProxyMeshConfig{MeshDestinationsOnly: true},
+			},
+		},
+	}, &snap)
+	require.NoError(t, err)
+	require.True(t, snap.ConnectProxy.MeshConfigSet)
+	require.NotNil(t, snap.ConnectProxy.MeshConfig)
+	require.True(t, snap.ConnectProxy.MeshConfig.TransparentProxy.MeshDestinationsOnly)
+}
+
+func TestState_watchErrorsTrackedOnSnapshot(t *testing.T) {
+	ns := structs.NodeService{
+		Kind:    structs.ServiceKindConnectProxy,
+		ID:      "web-sidecar-proxy",
+		Service: "web-sidecar-proxy",
+		Address: "10.0.1.1",
+		Port:    443,
+		Proxy: structs.ConnectProxyConfig{
+			DestinationServiceName: "web",
+			Upstreams: structs.Upstreams{
+				{
+					DestinationType: structs.UpstreamDestTypeService,
+					DestinationName: "api",
+					LocalBindPort:   10001,
+				},
+				{
+					DestinationType: structs.UpstreamDestTypeService,
+					DestinationName: "db",
+					LocalBindPort:   10002,
+				},
+			},
+		},
+	}
+
+	state, _ := newTestState(t, &ns, nil)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	state.cancel = cancel
+
+	snap, err := state.handler.initialize(ctx)
+	require.NoError(t, err)
+
+	go state.run(ctx, &snap)
+
+	roots, leaf := TestCerts(t)
+	for _, event := range []cache.UpdateEvent{
+		{CorrelationID: rootsWatchID, Result: roots},
+		{CorrelationID: leafWatchID, Result: leaf},
+		{CorrelationID: intentionsWatchID, Result: &structs.IndexedIntentionMatches{}},
+		{
+			CorrelationID: "discovery-chain:api",
+			Result: &structs.DiscoveryChainResponse{
+				Chain: discoverychain.TestCompileConfigEntries(t, "api", "default", "dc1", "trustdomain.consul", "dc1", nil),
+			},
+		},
+		{CorrelationID: "discovery-chain:db", Err: errors.New("watch broken")},
+	} {
+		state.ch <- event
+	}
+
+	// The events may be split across multiple deliveries, so read snapshots
+	// until the failure shows up.
+	var got ConfigSnapshot
+	deadline := time.After(time.Second)
+	for got.WatchErrors["discovery-chain:db"] == "" {
+		select {
+		case got = <-state.snapCh:
+		case <-deadline:
+			t.Fatal("timed out waiting for snapshot with watch error")
+		}
+	}
+
+	// The healthy chain still delivered while the broken one is flagged.
+	require.NotNil(t, got.ConnectProxy.DiscoveryChain["api"])
+	require.Contains(t, got.WatchErrors["discovery-chain:db"], "watch broken")
+
+	// A good result clears the recorded error.
+	state.ch <- cache.UpdateEvent{
+		CorrelationID: "discovery-chain:db",
+		Result: &structs.DiscoveryChainResponse{
+			Chain: discoverychain.TestCompileConfigEntries(t, "db", "default", "dc1", "trustdomain.consul", "dc1", nil),
+		},
+	}
+
+	deadline = time.After(time.Second)
+	for got.WatchErrors["discovery-chain:db"] != "" {
+		select {
+		case got = <-state.snapCh:
+		case <-deadline:
+			t.Fatal("timed out waiting for watch error to clear")
+		}
+	}
+	require.NotNil(t, got.ConnectProxy.DiscoveryChain["db"])
+}
+
+func TestState_preparedQueryPollIntervalOverride(t *testing.T) {
+	tests := []struct {
+		name   string
+		config map[string]interface{}
+		want   time.Duration
+	}{
+		{
+			name: "default",
+			want: defaultPreparedQueryPollInterval,
+		},
+		{
+			name:   "custom interval",
+			config: map[string]interface{}{"prepared_query_poll_interval": "5s"},
+			want:   5 * time.Second,
+		},
+		{
+			name:   "below minimum is clamped",
+			config: map[string]interface{}{"prepared_query_poll_interval": "100ms"},
+			want:   minPreparedQueryPollInterval,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ns := structs.NodeService{
+				Kind:    structs.ServiceKindConnectProxy,
+				ID:      "web-sidecar-proxy",
+				Service: "web-sidecar-proxy",
+				Address: "10.0.1.1",
+				Port:    443,
+				Proxy: structs.ConnectProxyConfig{
+					DestinationServiceName: "web",
+					Upstreams: structs.Upstreams{
+						{
+							DestinationType: structs.UpstreamDestTypePreparedQuery,
+							DestinationName: "geo-cache",
+							LocalBindPort:   10001,
+							Config:          tt.config,
+						},
+					},
+				},
+			}
+
+			state, cn := newTestState(t, &ns, nil)
+
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			_, err := state.handler.initialize(ctx)
+			require.NoError(t, err)
+
+			cacheType, req := cn.verifyWatch(t, "upstream:prepared_query:geo-cache")
+			require.Equal(t, cachetype.PreparedQueryName, cacheType)
+			pqReq, ok := req.(*structs.PreparedQueryExecuteRequest)
+			require.True(t, ok)
+			require.Equal(t, tt.want, pqReq.QueryOptions.MaxAge)
+		})
+	}
+}
+
+func TestState_meshGatewayCrossDCWatchConditional(t *testing.T) {
+	newGatewayState := func(t *testing.T, meta map[string]string) (*state, *testCacheNotifier) {
+		ns := structs.NodeService{
+			Kind:    structs.ServiceKindMeshGateway,
+			ID:      "mesh-gateway",
+			Service: "mesh-gateway",
+			Address: "10.0.1.1",
+			Port:    443,
+			Meta:    meta,
+		}
+
+		state, cn := newTestState(t, &ns, nil)
+		return state, cn
+	}
+
+	hasWatch := func(cn *testCacheNotifier, correlationID string) bool {
+		cn.lock.Lock()
+		defer cn.lock.Unlock()
+		_, ok := cn.notifiers[correlationID]
+		return ok
+	}
+
+	t.Run("single DC gateway has no cross-DC watches", func(t *testing.T) {
+		state, cn := newGatewayState(t, nil)
+
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+
+		snap, err := state.handler.initialize(ctx)
+		require.NoError(t, err)
+		require.False(t, hasWatch(cn, datacentersWatchID))
+		require.Nil(t, snap.MeshGateway.WatchedDatacentersCancel)
+	})
+
+	t.Run("WAN federation starts the datacenter watch", func(t *testing.T) {
+		state, cn := newGatewayState(t, map[string]string{structs.MetaWANFederationKey: "1"})
+
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+
+		snap, err := state.handler.initialize(ctx)
+		require.NoError(t, err)
+
+		cacheType, req := cn.verifyWatch(t, datacentersWatchID)
+		verifyDatacentersWatch(t, cacheType, req)
+		require.NotNil(t, snap.MeshGateway.WatchedDatacentersCancel)
+	})
+
+	t.Run("remote resolver target starts and stops the watch", func(t *testing.T) {
+		state, cn := newGatewayState(t, nil)
+
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+
+		snap, err := state.handler.initialize(ctx)
+		require.NoError(t, err)
+		require.False(t, hasWatch(cn, datacentersWatchID))
+
+		// A resolver redirecting to a remote datacenter needs that DC's
+		// gateways, so the datacenter watch starts.
+		err = state.handler.handleUpdate(ctx, cache.UpdateEvent{
+			CorrelationID: serviceResolversWatchID,
+			Result: &structs.IndexedConfigEntries{
+				Kind: structs.ServiceResolver,
+				Entries: []structs.ConfigEntry{
+					&structs.ServiceResolverConfigEntry{
+						Kind:     structs.ServiceResolver,
+						Name:     "db",
+						Redirect: &structs.ServiceResolverRedirect{Service: "db", Datacenter: "dc2"},
+					},
+				},
+			},
+		}, &snap)
+		require.NoError(t, err)
+		require.NotNil(t, snap.MeshGateway.WatchedDatacentersCancel)
+		cacheType, req := cn.verifyWatch(t, datacentersWatchID)
+		verifyDatacentersWatch(t, cacheType, req)
+
+		dcs := []string{"dc1", "dc2"}
+		err = state.handler.handleUpdate(ctx, cache.UpdateEvent{
+			CorrelationID: datacentersWatchID,
+			Result:        &dcs,
+		}, &snap)
+		require.NoError(t, err)
+		require.Contains(t, snap.MeshGateway.WatchedDatacenters, "dc2")
+
+		// Once no resolver points at a remote datacenter anymore, both the
+		// datacenter watch and the per-DC gateway watches are cancelled.
+		err = state.handler.handleUpdate(ctx, cache.UpdateEvent{
+			CorrelationID: serviceResolversWatchID,
+			Result: &structs.IndexedConfigEntries{
+				Kind: structs.ServiceResolver,
+			},
+		}, &snap)
+		require.NoError(t, err)
+		require.Nil(t, snap.MeshGateway.WatchedDatacentersCancel)
+		require.Empty(t, snap.MeshGateway.WatchedDatacenters)
+	})
+}
+
+func TestState_RestartWatches(t *testing.T) {
+	ns := structs.NodeService{
+		Kind:    structs.ServiceKindConnectProxy,
+		ID:      "web-sidecar-proxy",
+		Service: "web-sidecar-proxy",
+		Address: "10.0.1.1",
+		Port:    443,
+		Proxy: structs.ConnectProxyConfig{
+			DestinationServiceName: "web",
+		},
+	}
+
+	cn := newTestCacheNotifier()
+	state, err := newState(&ns, "first-token", stateConfig{
+		logger: testutil.Logger(t),
+		cache:  cn,
+		health: &health.Client{Cache: cn, CacheName: cachetype.HealthServicesName},
+		source: &structs.QuerySource{Datacenter: "dc1"},
+	})
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	state.cancel = cancel
+
+	snap, err := state.handler.initialize(ctx)
+	require.NoError(t, err)
+
+	go state.run(ctx, &snap)
+
+	watchToken := func(correlationID string) string {
+		_, req := cn.verifyWatch(t, correlationID)
+		info := req.CacheInfo()
+		return info.Token
+	}
+
+	require.Equal(t, "first-token", watchToken(rootsWatchID))
+	require.Equal(t, "first-token", watchToken(leafWatchID))
+
+	// Deliver a full set of data before the restart so we can check the
+	// roots are carried over.
+	roots, leaf := TestCerts(t)
+	for _, event := range []cache.UpdateEvent{
+		{CorrelationID: rootsWatchID, Result: roots},
+		{CorrelationID: leafWatchID, Result: leaf},
+		{CorrelationID: intentionsWatchID, Result: &structs.IndexedIntentionMatches{}},
+	} {
+		state.ch <- event
+	}
+	retry.Run(t, func(r *retry.R) {
+		if got := state.CurrentSnapshot(); got == nil {
+			r.Fatal("snapshot not yet valid")
+		}
+	})
+
+	require.NoError(t, state.RestartWatches(ctx, "second-token"))
+
+	require.Equal(t, "second-token", watchToken(rootsWatchID))
+	require.Equal(t, "second-token", watchToken(leafWatchID))
+	require.Equal(t, "second-token", watchToken(intentionsWatchID))
+
+	// The restart dropped the token-dependent data, so delivering just the
+	// leaf and intentions with the new token is enough to be valid again
+	// only because the CA roots were carried over.
+	for _, event := range []cache.UpdateEvent{
+		{CorrelationID: leafWatchID, Result: leaf},
+		{CorrelationID: intentionsWatchID, Result: &structs.IndexedIntentionMatches{}},
+	} {
+		state.ch <- event
+	}
+	retry.Run(t, func(r *retry.R) {
+		got := state.CurrentSnapshot()
+		if got == nil {
+			r.Fatal("snapshot not yet valid after restart")
+		}
+		require.Equal(r, roots, got.Roots)
+	})
+}
+
+func TestState_nilDiscoveryChainKeepsPriorData(t *testing.T) {
+	ns := structs.NodeService{
+		Kind:    structs.ServiceKindConnectProxy,
+		ID:      "web-sidecar-proxy",
+		Service: "web-sidecar-proxy",
+		Address: "10.0.1.1",
+		Port:    443,
+		Proxy: structs.ConnectProxyConfig{
+			DestinationServiceName: "web",
+			Upstreams: structs.Upstreams{
+				{
+					DestinationType: structs.UpstreamDestTypeService,
+					DestinationName: "api",
+					LocalBindPort:   10001,
+				},
+				{
+					DestinationType: structs.UpstreamDestTypeService,
+					DestinationName: "db",
+					LocalBindPort:   10002,
+				},
+			},
+		},
+	}
+
+	state, _ := newTestState(t, &ns, nil)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	snap, err := state.handler.initialize(ctx)
+	require.NoError(t, err)
+
+	chainFor := func(svc string) *structs.CompiledDiscoveryChain {
+		return discoverychain.TestCompileConfigEntries(t, svc, "default", "dc1", "trustdomain.consul", "dc1", nil)
+	}
+	deliver := func(svc string, chain *structs.CompiledDiscoveryChain) error {
+		return state.handler.handleUpdate(ctx, cache.UpdateEvent{
+			CorrelationID: "discovery-chain:" + svc,
+			Result:        &structs.DiscoveryChainResponse{Chain: chain},
+		}, &snap)
+	}
+
+	require.NoError(t, deliver("api", chainFor("api")))
+	require.NoError(t, deliver("db", chainFor("db")))
+	priorDB := snap.ConnectProxy.DiscoveryChain["db"]
+	require.NotNil(t, priorDB)
+
+	// A nil chain for db records an error but keeps db's prior chain and
+	// leaves api untouched.
+	require.NoError(t, deliver("db", nil))
+	require.Equal(t, priorDB, snap.ConnectProxy.DiscoveryChain["db"])
+	require.NotNil(t, snap.ConnectProxy.DiscoveryChain["api"])
+	require.NotContains(t, snap.ConnectProxy.ChainCompileErrors, "api")
+	require.Contains(t, snap.ConnectProxy.ChainCompileErrors, "db")
+
+	// The next good chain clears the recorded error.
+	require.NoError(t, deliver("db", chainFor("db")))
+	require.NotContains(t, snap.ConnectProxy.ChainCompileErrors, "db")
+}
+
+func TestState_failoverTargetHealthWatched(t *testing.T) {
+	ns := structs.NodeService{
+		Kind:    structs.ServiceKindConnectProxy,
+		ID:      "web-sidecar-proxy",
+		Service: "web-sidecar-proxy",
+		Address: "10.0.1.1",
+		Port:    443,
+		Proxy: structs.ConnectProxyConfig{
+			DestinationServiceName: "web",
+			Mode:                   structs.ProxyModeTransparent,
+			Upstreams: structs.Upstreams{
+				{
+					DestinationType: structs.UpstreamDestTypeService,
+					DestinationName: "db",
+					Datacenter:      "dc2",
+					LocalBindPort:   10001,
+				},
+			},
+		},
+	}
+
+	state, cn := newTestState(t, &ns, nil)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	snap, err := state.handler.initialize(ctx)
+	require.NoError(t, err)
+
+	chain := discoverychain.TestCompileConfigEntries(t, "db", "default", "dc1", "trustdomain.consul", "dc1", nil,
+		&structs.ServiceResolverConfigEntry{
+			Kind: structs.ServiceResolver,
+			Name: "db",
+			Failover: map[string]structs.ServiceResolverFailover{
+				"*": {Datacenters: []string{"dc2"}},
+			},
+		},
+	)
+
+	require.NoError(t, state.handler.handleUpdate(ctx, cache.UpdateEvent{
+		CorrelationID: "discovery-chain:db?dc=dc2",
+		Result:        &structs.DiscoveryChainResponse{Chain: chain},
+	}, &snap))
+
+	// Both the primary and the dc2 failover target have direct health
+	// watches so endpoint updates flow during failover, not just through
+	// the gateway dump.
+	watched := snap.ConnectProxy.WatchedUpstreams["db?dc=dc2"]
+	require.Contains(t, watched, "db.default.dc1")
+	require.Contains(t, watched, "db.default.dc2")
+
+	_, req := cn.verifyWatch(t, "upstream-target:db.default.dc2:db?dc=dc2")
+	healthReq, ok := req.(*structs.ServiceSpecificRequest)
+	require.True(t, ok)
+	require.Equal(t, "dc2", healthReq.Datacenter)
+	require.Equal(t, "db", healthReq.ServiceName)
+}
+
+func TestState_watchCountsTrackTargets(t *testing.T) {
+	ns := structs.NodeService{
+		Kind:    structs.ServiceKindConnectProxy,
+		ID:      "web-sidecar-proxy",
+		Service: "web-sidecar-proxy",
+		Address: "10.0.1.1",
+		Port:    443,
+		Proxy: structs.ConnectProxyConfig{
+			DestinationServiceName: "web",
+			Upstreams: structs.Upstreams{
+				{
+					DestinationType: structs.UpstreamDestTypeService,
+					DestinationName: "api",
+					LocalBindPort:   10001,
+				},
+				{
+					DestinationType: structs.UpstreamDestTypeService,
+					DestinationName: "db",
+					LocalBindPort:   10002,
+				},
+			},
+		},
+	}
+
+	state, _ := newTestState(t, &ns, nil)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	snap, err := state.handler.initialize(ctx)
+	require.NoError(t, err)
+	require.Zero(t, snap.ConnectProxy.WatchedUpstreamsCount)
+
+	deliver := func(svc string, chain *structs.CompiledDiscoveryChain) {
+		require.NoError(t, state.handler.handleUpdate(ctx, cache.UpdateEvent{
+			CorrelationID: "discovery-chain:" + svc,
+			Result:        &structs.DiscoveryChainResponse{Chain: chain},
+		}, &snap))
+	}
+
+	deliver("api", discoverychain.TestCompileConfigEntries(t, "api", "default", "dc1", "trustdomain.consul", "dc1", nil))
+	require.Equal(t, 1, snap.ConnectProxy.WatchedUpstreamsCount)
+	require.Zero(t, snap.ConnectProxy.WatchedGatewaysCount)
+
+	// A failover chain through remote gateways adds a second target watch
+	// and a gateway watch for the failover datacenter.
+	deliver("db", discoverychain.TestCompileConfigEntries(t, "db", "default", "dc1", "trustdomain.consul", "dc1",
+		func(req *discoverychain.CompileRequest) {
+			req.OverrideMeshGateway.Mode = structs.MeshGatewayModeRemote
+		},
+		&structs.ServiceResolverConfigEntry{
+			Kind: structs.ServiceResolver,
+			Name: "db",
+			Failover: map[string]structs.ServiceResolverFailover{
+				"*": {Datacenters: []string{"dc2"}},
+			},
+		},
+	))
+	require.Equal(t, 3, snap.ConnectProxy.WatchedUpstreamsCount)
+	require.Equal(t, 1, snap.ConnectProxy.WatchedGatewaysCount)
+
+	// Dropping the failover removes its target and gateway watches again.
+	deliver("db", discoverychain.TestCompileConfigEntries(t, "db", "default", "dc1", "trustdomain.consul", "dc1", nil))
+	require.Equal(t, 2, snap.ConnectProxy.WatchedUpstreamsCount)
+	require.Zero(t, snap.ConnectProxy.WatchedGatewaysCount)
+}
+
+func TestState_ResetUpstream(t *testing.T) {
+	ns := structs.NodeService{
+		Kind:    structs.ServiceKindConnectProxy,
+		ID:      "web-sidecar-proxy",
+		Service: "web-sidecar-proxy",
+		Address: "10.0.1.1",
+		Port:    443,
+		Proxy: structs.ConnectProxyConfig{
+			DestinationServiceName: "web",
+			Upstreams: structs.Upstreams{
+				{
+					DestinationType: structs.UpstreamDestTypeService,
+					DestinationName: "api",
+					LocalBindPort:   10001,
+				},
+				{
+					DestinationType: structs.UpstreamDestTypeService,
+					DestinationName: "db",
+					LocalBindPort:   10002,
+				},
+			},
+		},
+	}
+
+	state, cn := newTestState(t, &ns, nil)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	state.cancel = cancel
+
+	snap, err := state.handler.initialize(ctx)
+	require.NoError(t, err)
+
+	go state.run(ctx, &snap)
+
+	roots, leaf := TestCerts(t)
+	for _, event := range []cache.UpdateEvent{
+		{CorrelationID: rootsWatchID, Result: roots},
+		{CorrelationID: leafWatchID, Result: leaf},
+		{CorrelationID: intentionsWatchID, Result: &structs.IndexedIntentionMatches{}},
+		{
+			CorrelationID: "discovery-chain:api",
+			Result: &structs.DiscoveryChainResponse{
+				Chain: discoverychain.TestCompileConfigEntries(t, "api", "default", "dc1", "trustdomain.consul", "dc1", nil),
+			},
+		},
+		{
+			CorrelationID: "discovery-chain:db",
+			Result: &structs.DiscoveryChainResponse{
+				Chain: discoverychain.TestCompileConfigEntries(t, "db", "default", "dc1", "trustdomain.consul", "dc1", nil),
+			},
+		},
+	} {
+		state.ch <- event
+	}
+
+	select {
+	case <-state.snapCh:
+	case <-time.After(time.Second):
+		t.Fatal("timed out waiting for initial snapshot")
+	}
+
+	apiWatch := cn.getNotifierRequest(t, "upstream-target:api.default.dc1:api")
+	dbWatch := cn.getNotifierRequest(t, "upstream-target:db.default.dc1:db")
+
+	require.Error(t, state.ResetUpstream("nope"), "unknown upstreams are rejected")
+
+	require.NoError(t, state.ResetUpstream("db"))
+
+	// Only db's target watch was cancelled; api's is untouched.
+	require.Error(t, dbWatch.ctx.Err())
+	require.NoError(t, apiWatch.ctx.Err())
+
+	// The delivered snapshot reflects the teardown. Clone nils out the
+	// cancel-func maps, so check the endpoint map and the counts.
+	select {
+	case got := <-state.snapCh:
+		require.NotContains(t, got.ConnectProxy.WatchedUpstreamEndpoints, "db")
+		require.Contains(t, got.ConnectProxy.WatchedUpstreamEndpoints, "api")
+		require.Equal(t, 1, got.ConnectProxy.WatchedUpstreamsCount)
+	case <-time.After(time.Second):
+		t.Fatal("timed out waiting for snapshot after reset")
+	}
+}
+
+func TestState_preparedQueryMeshGatewayMode(t *testing.T) {
+	tests := []struct {
+		name  string
+		mode  structs.MeshGatewayMode
+		gwDC  string
+		watch bool
+	}{
+		{name: "no mode means no gateway watch", mode: structs.MeshGatewayModeDefault},
+		{name: "remote mode watches the query datacenter", mode: structs.MeshGatewayModeRemote, gwDC: "dc2", watch: true},
+		{name: "local mode watches the local datacenter", mode: structs.MeshGatewayModeLocal, gwDC: "dc1", watch: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ns := structs.NodeService{
+				Kind:    structs.ServiceKindConnectProxy,
+				ID:      "web-sidecar-proxy",
+				Service: "web-sidecar-proxy",
+				Address: "10.0.1.1",
+				Port:    443,
+				Proxy: structs.ConnectProxyConfig{
+					DestinationServiceName: "web",
+					Upstreams: structs.Upstreams{
+						{
+							DestinationType: structs.UpstreamDestTypePreparedQuery,
+							DestinationName: "geo-cache",
+							Datacenter:      "dc2",
+							LocalBindPort:   10001,
+							MeshGateway:     structs.MeshGatewayConfig{Mode: tt.mode},
+						},
+					},
+				},
+			}
+
+			state, cn := newTestState(t, &ns, nil)
+
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			snap, err := state.handler.initialize(ctx)
+			require.NoError(t, err)
+
+			// The prepared-query upstream ID contains colons, which the
+			// correlation ID encoding escapes.
+			correlationID := makeColonID("mesh-gateway:", tt.gwDC, "prepared_query:geo-cache?dc=dc2")
+			if !tt.watch {
+				cn.lock.Lock()
+				ids := make([]string, 0, len(cn.notifiers))
+				for id := range cn.notifiers {
+					ids = append(ids, id)
+				}
+				cn.lock.Unlock()
+				for _, id := range ids {
+					require.NotContains(t, id, "mesh-gateway:")
+				}
+				require.Zero(t, snap.ConnectProxy.WatchedGatewaysCount)
+				return
+			}
+
+			cacheType, req := cn.verifyWatch(t, correlationID)
+			require.Equal(t, cachetype.InternalServiceDumpName, cacheType)
+			dumpReq, ok := req.(*structs.ServiceDumpRequest)
+			require.True(t, ok)
+			require.Equal(t, tt.gwDC, dumpReq.Datacenter)
+			require.Equal(t, structs.ServiceKindMeshGateway, dumpReq.ServiceKind)
+			require.Equal(t, 1, snap.ConnectProxy.WatchedGatewaysCount)
+
+			// Gateway endpoint updates land in the snapshot keyed by the
+			// prepared-query upstream.
+			require.NoError(t, state.handler.handleUpdate(ctx, cache.UpdateEvent{
+				CorrelationID: correlationID,
+				Result:        &structs.IndexedNodesWithGateways{Nodes: TestGatewayNodesDC2(t)},
+			}, &snap))
+			require.NotEmpty(t, snap.ConnectProxy.WatchedGatewayEndpoints["prepared_query:geo-cache?dc=dc2"][tt.gwDC])
+		})
+	}
+}
+
+func TestState_terminatingGatewayServiceTLSOverrides(t *testing.T) {
+	ns := structs.NodeService{
+		Kind:    structs.ServiceKindTerminatingGateway,
+		ID:      "terminating-gateway",
+		Service: "terminating-gateway",
+		Address: "10.0.1.1",
+		Port:    443,
+	}
+
+	state, _ := newTestState(t, &ns, nil)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	snap, err := state.handler.initialize(ctx)
+	require.NoError(t, err)
+
+	// TLS origination settings from the linked-service config, including a
+	// custom SNI, ride along on the gateway-services update into the
+	// snapshot for the xDS layer.
+	external := structs.NewServiceName("external-db", nil)
+	require.NoError(t, state.handler.handleUpdate(ctx, cache.UpdateEvent{
+		CorrelationID: gatewayServicesWatchID,
+		Result: &structs.IndexedGatewayServices{
+			Services: structs.GatewayServices{
+				{
+					Gateway:     structs.NewServiceName("terminating-gateway", nil),
+					Service:     external,
+					GatewayKind: structs.ServiceKindTerminatingGateway,
+					CAFile:      "/etc/certs/external-ca.pem",
+					SNI:         "db.external.example.com",
+				},
+			},
+		},
+	}, &snap))
+
+	got, ok := snap.TerminatingGateway.GatewayServices[external]
+	require.True(t, ok)
+	require.Equal(t, "/etc/certs/external-ca.pem", got.CAFile)
+	require.Equal(t, "db.external.example.com", got.SNI)
+}
+
+func TestState_eventChanBufferSizedFromUpstreams(t *testing.T) {
+	makeNS := func(numUpstreams int) *structs.NodeService {
+		var upstreams structs.Upstreams
+		for i := 0; i < numUpstreams; i++ {
+			upstreams = append(upstreams, structs.Upstream{
+				DestinationType: structs.UpstreamDestTypeService,
+				DestinationName: fmt.Sprintf("svc-%d", i),
+				LocalBindPort:   10000 + i,
+			})
+		}
+		return &structs.NodeService{
+			Kind:    structs.ServiceKindConnectProxy,
+			ID:      "web-sidecar-proxy",
+			Service: "web-sidecar-proxy",
+			Port:    9999,
+			Proxy: structs.ConnectProxyConfig{
+				DestinationServiceName: "web",
+				Upstreams:              upstreams,
+			},
+		}
+	}
+
+	tests := []struct {
+		name         string
+		numUpstreams int
+		wantCap      int
+	}{
+		{"few upstreams keep the default", 3, minEventChanBufferSize},
+		{"many upstreams grow the buffer", 50, 50},
+		{"huge upstream counts are capped", 1000, maxEventChanBufferSize},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			state, err := newState(makeNS(tt.numUpstreams), "", stateConfig{
+				logger: testutil.Logger(t),
+				source: &structs.QuerySource{Datacenter: "dc1"},
+			})
+			require.NoError(t, err)
+			require.Equal(t, tt.wantCap, cap(state.ch))
+		})
+	}
+}
+
+func TestConfigSnapshot_Warm(t *testing.T) {
+	snap := TestConfigSnapshot(t)
+	require.True(t, snap.Valid())
+
+	// The test snapshot has endpoints for every watched target, so it is
+	// warm; an upstream target without endpoints makes it merely valid.
+	require.True(t, snap.Warm())
+
+	if snap.ConnectProxy.WatchedUpstreams == nil {
+		snap.ConnectProxy.WatchedUpstreams = make(map[string]map[string]context.CancelFunc)
+	}
+	snap.ConnectProxy.WatchedUpstreams["payments"] = map[string]context.CancelFunc{
+		"payments.default.dc1": func() {},
+	}
+	require.True(t, snap.Valid())
+	require.False(t, snap.Warm())
+
+	if snap.ConnectProxy.WatchedUpstreamEndpoints == nil {
+		snap.ConnectProxy.WatchedUpstreamEndpoints = make(map[string]map[string]structs.CheckServiceNodes)
+	}
+	snap.ConnectProxy.WatchedUpstreamEndpoints["payments"] = map[string]structs.CheckServiceNodes{
+		"payments.default.dc1": TestUpstreamNodes(t),
+	}
+	require.True(t, snap.Warm())
+
+	// Not valid implies not warm regardless of endpoints.
+	snap.Roots = nil
+	require.False(t, snap.Warm())
+}
+
+func TestState_waitForWarmDelaysFirstDelivery(t *testing.T) {
+	ns := structs.NodeService{
+		Kind:    structs.ServiceKindConnectProxy,
+		ID:      "web-sidecar-proxy",
+		Service: "web-sidecar-proxy",
+		Address: "10.0.1.1",
+		Port:    443,
+		Proxy: structs.ConnectProxyConfig{
+			DestinationServiceName: "web",
+			Upstreams: structs.Upstreams{
+				{
+					DestinationType: structs.UpstreamDestTypeService,
+					DestinationName: "db",
+					LocalBindPort:   10001,
+				},
+			},
+		},
+	}
+
+	state, _ := newTestState(t, &ns, func(config *stateConfig) {
+		config.waitForWarm = true
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	state.cancel = cancel
+
+	snap, err := state.handler.initialize(ctx)
+	require.NoError(t, err)
+
+	go state.run(ctx, &snap)
+
+	roots, leaf := TestCerts(t)
+	for _, event := range []cache.UpdateEvent{
+		{CorrelationID: rootsWatchID, Result: roots},
+		{CorrelationID: leafWatchID, Result: leaf},
+		{CorrelationID: intentionsWatchID, Result: &structs.IndexedIntentionMatches{}},
+		{
+			CorrelationID: "discovery-chain:db",
+			Result: &structs.DiscoveryChainResponse{
+				Chain: discoverychain.TestCompileConfigEntries(t, "db", "default", "dc1", "trustdomain.consul", "dc1", nil),
+			},
+		},
+	} {
+		state.ch <- event
+	}
+
+	// The snapshot is valid but db's target has no endpoints yet, so the
+	// first delivery is held back.
+	select {
+	case <-state.snapCh:
+		t.Fatal("snapshot delivered before the upstream was warm")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	state.ch <- cache.UpdateEvent{
+		CorrelationID: "upstream-target:db.default.dc1:db",
+		Result:        &structs.IndexedCheckServiceNodes{Nodes: TestUpstreamNodes(t)},
+	}
+
+	select {
+	case got := <-state.snapCh:
+		require.Len(t, got.ConnectProxy.WatchedUpstreamEndpoints["db"]["db.default.dc1"], 2)
+	case <-time.After(time.Second):
+		t.Fatal("timed out waiting for warm snapshot")
+	}
+}
+
+func TestState_firstDeliveryNotGatedWithoutWaitForWarm(t *testing.T) {
+	ns := structs.NodeService{
+		Kind:    structs.ServiceKindConnectProxy,
+		ID:      "web-sidecar-proxy",
+		Service: "web-sidecar-proxy",
+		Address: "10.0.1.1",
+		Port:    443,
+		Proxy: structs.ConnectProxyConfig{
+			DestinationServiceName: "web",
+			Upstreams: structs.Upstreams{
+				{
+					DestinationType: structs.UpstreamDestTypeService,
+					DestinationName: "db",
+					LocalBindPort:   10001,
+				},
+			},
+		},
+	}
+
+	state, _ := newTestState(t, &ns, nil)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	state.cancel = cancel
+
+	snap, err := state.handler.initialize(ctx)
+	require.NoError(t, err)
+
+	go state.run(ctx, &snap)
+
+	roots, leaf := TestCerts(t)
+	for _, event := range []cache.UpdateEvent{
+		{CorrelationID: rootsWatchID, Result: roots},
+		{CorrelationID: leafWatchID, Result: leaf},
+		{CorrelationID: intentionsWatchID, Result: &structs.IndexedIntentionMatches{}},
+		{
+			CorrelationID: "discovery-chain:db",
+			Result: &structs.DiscoveryChainResponse{
+				Chain: discoverychain.TestCompileConfigEntries(t, "db", "default", "dc1", "trustdomain.consul", "dc1", nil),
+			},
+		},
+	} {
+		state.ch <- event
+	}
+
+	select {
+	case <-state.snapCh:
+	case <-time.After(time.Second):
+		t.Fatal("timed out waiting for snapshot without warm gating")
+	}
+}
+
+func TestState_terminatingGatewayLinkedServiceFilter(t *testing.T) {
+	ns := structs.NodeService{
+		Kind:    structs.ServiceKindTerminatingGateway,
+		ID:      "terminating-gateway",
+		Service: "terminating-gateway",
+		Address: "10.0.1.1",
+		Port:    443,
+		Proxy: structs.ConnectProxyConfig{
+			Config: map[string]interface{}{
+				"linked_service_filter": []string{"db"},
+			},
+		},
+	}
+
+	state, cn := newTestState(t, &ns, nil)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	snap, err := state.handler.initialize(ctx)
+	require.NoError(t, err)
+
+	db := structs.NewServiceName("db", nil)
+	cache_ := structs.NewServiceName("cache", nil)
+	update := cache.UpdateEvent{
+		CorrelationID: gatewayServicesWatchID,
+		Result: &structs.IndexedGatewayServices{
+			Services: structs.GatewayServices{
+				{
+					Gateway:     structs.NewServiceName("terminating-gateway", nil),
+					Service:     db,
+					GatewayKind: structs.ServiceKindTerminatingGateway,
+				},
+				{
+					Gateway:     structs.NewServiceName("terminating-gateway", nil),
+					Service:     cache_,
+					GatewayKind: structs.ServiceKindTerminatingGateway,
+				},
+			},
+		},
+	}
+
+	require.NoError(t, state.handler.handleUpdate(ctx, update, &snap))
+
+	require.Contains(t, snap.TerminatingGateway.WatchedServices, db)
+	require.NotContains(t, snap.TerminatingGateway.WatchedServices, cache_)
+	require.NotContains(t, snap.TerminatingGateway.GatewayServices, cache_)
+	cn.verifyWatch(t, externalServiceIDPrefix+db.String())
+
+	// Widening the filter picks the previously excluded service up on the
+	// next gateway-services update.
+	handler := state.handler.(*handlerTerminatingGateway)
+	handler.serviceInstance.proxyCfg.Config = map[string]interface{}{
+		"linked_service_filter": []string{"db", "cache"},
+	}
+	require.NoError(t, state.handler.handleUpdate(ctx, update, &snap))
+
+	require.Contains(t, snap.TerminatingGateway.WatchedServices, cache_)
+	cn.verifyWatch(t, externalServiceIDPrefix+cache_.String())
+	cacheWatch := cn.getNotifierRequest(t, externalServiceIDPrefix+cache_.String())
+
+	// Narrowing it back cancels the watches for the now-excluded service.
+	handler.serviceInstance.proxyCfg.Config = map[string]interface{}{
+		"linked_service_filter": []string{"db"},
+	}
+	require.NoError(t, state.handler.handleUpdate(ctx, update, &snap))
+
+	require.NotContains(t, snap.TerminatingGateway.WatchedServices, cache_)
+	require.Error(t, cacheWatch.ctx.Err())
+	require.Contains(t, snap.TerminatingGateway.WatchedServices, db)
+}
+
+func TestState_upstreamEndpointChangeMetrics(t *testing.T) {
+	sink := metrics.NewInmemSink(time.Minute, time.Minute)
+	cfg := metrics.DefaultConfig("")
+	cfg.EnableHostname = false
+	cfg.EnableRuntimeMetrics = false
+	metrics.NewGlobal(cfg, sink)
+	t.Cleanup(func() {
+		metrics.NewGlobal(cfg, &metrics.BlackholeSink{})
+	})
+
+	ns := structs.NodeService{
+		Kind:    structs.ServiceKindConnectProxy,
+		ID:      "web-sidecar-proxy",
+		Service: "web-sidecar-proxy",
+		Address: "10.0.1.1",
+		Port:    443,
+		Proxy: structs.ConnectProxyConfig{
+			DestinationServiceName: "web",
+			Upstreams: structs.Upstreams{
+				{
+					DestinationType: structs.UpstreamDestTypeService,
+					DestinationName: "db",
+					LocalBindPort:   10001,
+				},
+			},
+		},
+	}
+
+	state, _ := newTestState(t, &ns, nil)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	snap, err := state.handler.initialize(ctx)
+	require.NoError(t, err)
+
+	require.NoError(t, state.handler.handleUpdate(ctx, cache.UpdateEvent{
+		CorrelationID: "discovery-chain:db",
+		Result: &structs.DiscoveryChainResponse{
+			Chain: discoverychain.TestCompileConfigEntries(t, "db", "default", "dc1", "trustdomain.consul", "dc1", nil),
+		},
+	}, &snap))
+
+	const counterKey = "proxycfg.upstream.endpoint_changes;upstream=db;target=db.default.dc1"
+	counterCount := func() int {
+		for _, intv := range sink.Data() {
+			intv.RLock()
+			c, ok := intv.Counters[counterKey]
+			intv.RUnlock()
+			if ok {
+				return c.Count
+			}
+		}
+		return 0
+	}
+
+	deliver := func(nodes structs.CheckServiceNodes) {
+		require.NoError(t, state.handler.handleUpdate(ctx, cache.UpdateEvent{
+			CorrelationID: "upstream-target:db.default.dc1:db",
+			Result:        &structs.IndexedCheckServiceNodes{Nodes: nodes},
+		}, &snap))
+	}
+
+	// Initial result counts as a change.
+	nodes := TestUpstreamNodes(t)
+	deliver(nodes)
+	require.Equal(t, 1, counterCount())
+
+	// Identical redelivery is a no-op.
+	deliver(TestUpstreamNodes(t))
+	require.Equal(t, 1, counterCount())
+
+	// A genuinely different result increments again.
+	deliver(nodes[:1])
+	require.Equal(t, 2, counterCount())
+}
+
+func TestState_meshGatewayAllowedNamespaces(t *testing.T) {
+	ns := structs.NodeService{
+		Kind:    structs.ServiceKindMeshGateway,
+		ID:      "mesh-gateway",
+		Service: "mesh-gateway",
+		Address: "10.0.1.1",
+		Port:    443,
+		Proxy: structs.ConnectProxyConfig{
+			Config: map[string]interface{}{
+				"mesh_gateway_allowed_namespaces": []string{"default"},
+			},
+		},
+	}
+
+	state, cn := newTestState(t, &ns, nil)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	snap, err := state.handler.initialize(ctx)
+	require.NoError(t, err)
+
+	web := structs.NewServiceName("web", nil)
+	serviceList := cache.UpdateEvent{
+		CorrelationID: serviceListWatchID,
+		Result:        &structs.IndexedServiceList{Services: []structs.ServiceName{web}},
+	}
+
+	// Services in an allowed namespace get a connect-service watch.
+	require.NoError(t, state.handler.handleUpdate(ctx, serviceList, &snap))
+	require.Contains(t, snap.MeshGateway.WatchedServices, web)
+	webWatch := cn.getNotifierRequest(t, "connect-service:web")
+
+	// Narrowing the allow list cancels watches for services whose namespace
+	// is no longer exported on the next reconciliation.
+	state.handler.(*handlerMeshGateway).allowedNamespaces = map[string]struct{}{"other": {}}
+
+	require.NoError(t, state.handler.handleUpdate(ctx, serviceList, &snap))
+	require.NotContains(t, snap.MeshGateway.WatchedServices, web)
+	require.Error(t, webWatch.ctx.Err(), "excluded-namespace service watch should be cancelled")
+}
+
+func TestState_PauseResume(t *testing.T) {
+	ns := structs.NodeService{
+		Kind:    structs.ServiceKindConnectProxy,
+		ID:      "web-sidecar-proxy",
+		Service: "web-sidecar-proxy",
+		Address: "10.0.1.1",
+		Port:    443,
+		Proxy: structs.ConnectProxyConfig{
+			DestinationServiceName: "web",
+		},
+	}
+
+	state, _ := newTestState(t, &ns, nil)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	state.cancel = cancel
+
+	snap, err := state.handler.initialize(ctx)
+	require.NoError(t, err)
+
+	go state.run(ctx, &snap)
+
+	roots, leaf := TestCerts(t)
+	for _, event := range []cache.UpdateEvent{
+		{CorrelationID: rootsWatchID, Result: roots},
+		{CorrelationID: leafWatchID, Result: leaf},
+		{CorrelationID: intentionsWatchID, Result: &structs.IndexedIntentionMatches{}},
+	} {
+		state.ch <- event
+	}
+
+	select {
+	case <-state.snapCh:
+	case <-time.After(time.Second):
+		t.Fatal("timed out waiting for initial snapshot")
+	}
+
+	state.Pause()
+
+	// Updates while paused fold into the snapshot but are not delivered.
+	_, leaf2 := TestCerts(t)
+	state.ch <- cache.UpdateEvent{CorrelationID: leafWatchID, Result: leaf2}
+	state.ch <- cache.UpdateEvent{CorrelationID: intentionsWatchID, Result: &structs.IndexedIntentionMatches{}}
+
+	select {
+	case <-state.snapCh:
+		t.Fatal("snapshot delivered while paused")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	state.Resume()
+
+	// Everything that accumulated arrives as one coalesced delivery.
+	select {
+	case got := <-state.snapCh:
+		require.Equal(t, leaf2, got.ConnectProxy.Leaf)
+	case <-time.After(time.Second):
+		t.Fatal("timed out waiting for snapshot after resume")
+	}
+
+	select {
+	case <-state.snapCh:
+		t.Fatal("expected a single coalesced delivery after resume")
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestState_defaultQueryOptionsOnWatches(t *testing.T) {
+	ns := structs.NodeService{
+		Kind:    structs.ServiceKindConnectProxy,
+		ID:      "web-sidecar-proxy",
+		Service: "web-sidecar-proxy",
+		Address: "10.0.1.1",
+		Port:    443,
+		Proxy: structs.ConnectProxyConfig{
+			DestinationServiceName: "web",
+			Upstreams: structs.Upstreams{
+				{
+					DestinationType: structs.UpstreamDestTypePreparedQuery,
+					DestinationName: "geo-cache",
+					LocalBindPort:   10001,
+				},
+			},
+		},
+	}
+
+	cn := newTestCacheNotifier()
+	state, err := newState(&ns, "the-token", stateConfig{
+		logger: testutil.Logger(t),
+		cache:  cn,
+		health: &health.Client{Cache: cn, CacheName: cachetype.HealthServicesName},
+		source: &structs.QuerySource{Datacenter: "dc1"},
+		defaultQueryOptions: structs.QueryOptions{
+			AllowStale:   true,
+			MaxAge:       15 * time.Second,
+			StaleIfError: time.Minute,
+		},
+	})
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	_, err = state.handler.initialize(ctx)
+	require.NoError(t, err)
+
+	_, rootsReq := cn.verifyWatch(t, rootsWatchID)
+	rootsOpts := rootsReq.CacheInfo()
+	require.Equal(t, "the-token", rootsOpts.Token)
+	require.Equal(t, 15*time.Second, rootsOpts.MaxAge)
+
+	_, intentionsReq := cn.verifyWatch(t, intentionsWatchID)
+	intentionsQuery, ok := intentionsReq.(*structs.IntentionQueryRequest)
+	require.True(t, ok)
+	require.True(t, intentionsQuery.QueryOptions.AllowStale)
+	require.Equal(t, time.Minute, intentionsQuery.QueryOptions.StaleIfError)
+
+	// The prepared query poll keeps its own MaxAge while still inheriting
+	// the other staleness options.
+	_, pqReq := cn.verifyWatch(t, "upstream:prepared_query:geo-cache")
+	pqQuery, ok := pqReq.(*structs.PreparedQueryExecuteRequest)
+	require.True(t, ok)
+	require.True(t, pqQuery.QueryOptions.AllowStale)
+	require.Equal(t, defaultPreparedQueryPollInterval, pqQuery.QueryOptions.MaxAge)
+}
+
+func TestState_meshGatewayNilDatacenterList(t *testing.T) {
+	ns := structs.NodeService{
+		Kind:    structs.ServiceKindMeshGateway,
+		ID:      "mesh-gateway",
+		Service: "mesh-gateway",
+		Address: "10.0.1.1",
+		Port:    443,
+		Meta: map[string]string{
+			structs.MetaWANFederationKey: "1",
+		},
+	}
+
+	state, cn := newTestState(t, &ns, nil)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	snap, err := state.handler.initialize(ctx)
+	require.NoError(t, err)
+
+	// A normal list establishes the dc2 gateway watch.
+	require.NoError(t, state.handler.handleUpdate(ctx, cache.UpdateEvent{
+		CorrelationID: datacentersWatchID,
+		Result:        &[]string{"dc1", "dc2"},
+	}, &snap))
+	require.Contains(t, snap.MeshGateway.WatchedDatacenters, "dc2")
+	dc2Watch := cn.getNotifierRequest(t, "mesh-gateway:dc2")
+
+	// A transient nil list is ignored instead of erroring, and the existing
+	// cross-DC watch stays up.
+	require.NoError(t, state.handler.handleUpdate(ctx, cache.UpdateEvent{
+		CorrelationID: datacentersWatchID,
+		Result:        (*[]string)(nil),
+	}, &snap))
+	require.Contains(t, snap.MeshGateway.WatchedDatacenters, "dc2")
+	require.NoError(t, dc2Watch.ctx.Err())
+}
+
+// fakeClock implements clock; timers never fire on their own and are
+// triggered explicitly with fire.
+type fakeClock struct {
+	mu      sync.Mutex
+	now     time.Time
+	pending []func()
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) AfterFunc(d time.Duration, f func()) *time.Timer {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.pending = append(c.pending, f)
+	// The run loop only nils its reference out, so hand back a timer that
+	// never fires.
+	return time.NewTimer(time.Hour)
+}
+
+func (c *fakeClock) pendingCount() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.pending)
+}
+
+func (c *fakeClock) fire() {
+	c.mu.Lock()
+	fns := c.pending
+	c.pending = nil
+	c.mu.Unlock()
+	for _, f := range fns {
+		go f()
+	}
+}
+
+func TestState_coalesceTimerUsesClock(t *testing.T) {
+	ns := structs.NodeService{
+		Kind:    structs.ServiceKindConnectProxy,
+		ID:      "web-sidecar-proxy",
+		Service: "web-sidecar-proxy",
+		Address: "10.0.1.1",
+		Port:    443,
+		Proxy: structs.ConnectProxyConfig{
+			DestinationServiceName: "web",
+		},
+	}
+
+	state, _ := newTestState(t, &ns, nil)
+
+	fc := &fakeClock{now: time.Now()}
+	state.clock = fc
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	state.cancel = cancel
+
+	snap, err := state.handler.initialize(ctx)
+	require.NoError(t, err)
+
+	go state.run(ctx, &snap)
+
+	roots, leaf := TestCerts(t)
+	for _, event := range []cache.UpdateEvent{
+		{CorrelationID: rootsWatchID, Result: roots},
+		{CorrelationID: leafWatchID, Result: leaf},
+		{CorrelationID: intentionsWatchID, Result: &structs.IndexedIntentionMatches{}},
+	} {
+		state.ch <- event
+	}
+
+	// The run loop armed the coalesce timer on the fake clock; nothing is
+	// delivered until it is triggered.
+	retry.Run(t, func(r *retry.R) {
+		if fc.pendingCount() == 0 {
+			r.Fatal("coalesce timer not armed yet")
+		}
+	})
+	select {
+	case <-state.snapCh:
+		t.Fatal("snapshot delivered before the coalesce timer fired")
+	default:
+	}
+
+	fc.fire()
+
+	select {
+	case got := <-state.snapCh:
+		require.True(t, got.Valid())
+	case <-time.After(time.Second):
+		t.Fatal("timed out waiting for snapshot after firing the timer")
+	}
+}
+
+// syncWriter is a goroutine-safe log sink for tests that read logs while the
+// run goroutine is still writing them.
+type syncWriter struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (w *syncWriter) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.buf.Write(p)
+}
+
+func (w *syncWriter) String() string {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.buf.String()
+}
+
+func TestState_stuckConsumerEscalation(t *testing.T) {
+	sink := metrics.NewInmemSink(time.Minute, time.Minute)
+	cfg := metrics.DefaultConfig("")
+	cfg.EnableHostname = false
+	cfg.EnableRuntimeMetrics = false
+	metrics.NewGlobal(cfg, sink)
+	t.Cleanup(func() {
+		metrics.NewGlobal(cfg, &metrics.BlackholeSink{})
+	})
+
+	ns := structs.NodeService{
+		Kind:    structs.ServiceKindConnectProxy,
+		ID:      "web-sidecar-proxy",
+		Service: "web-sidecar-proxy",
+		Address: "10.0.1.1",
+		Port:    443,
+		Proxy: structs.ConnectProxyConfig{
+			DestinationServiceName: "web",
+		},
+	}
+
+	logOut := &syncWriter{}
+	logger := hclog.New(&hclog.LoggerOptions{Output: logOut})
+
+	state, _ := newTestState(t, &ns, func(config *stateConfig) {
+		config.logger = logger
+		config.coalesceTimeout = time.Millisecond
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	state.cancel = cancel
+
+	snap, err := state.handler.initialize(ctx)
+	require.NoError(t, err)
+
+	go state.run(ctx, &snap)
+
+	// Nothing ever reads snapCh, so the first delivery fills its buffer and
+	// every retry after the next update fails until the warning threshold.
+	roots, leaf := TestCerts(t)
+	for _, event := range []cache.UpdateEvent{
+		{CorrelationID: rootsWatchID, Result: roots},
+		{CorrelationID: leafWatchID, Result: leaf},
+		{CorrelationID: intentionsWatchID, Result: &structs.IndexedIntentionMatches{}},
+	} {
+		state.ch <- event
+	}
+
+	// Wait for the first delivery to land in the buffer before pushing the
+	// update whose delivery can never succeed.
+	retry.Run(t, func(r *retry.R) {
+		if len(state.snapCh) == 0 {
+			r.Fatal("first snapshot not buffered yet")
+		}
+	})
+
+	_, leaf2 := TestCerts(t)
+	state.ch <- cache.UpdateEvent{CorrelationID: leafWatchID, Result: leaf2}
+
+	retry.Run(t, func(r *retry.R) {
+		if !strings.Contains(logOut.String(), "persistently failing") {
+			r.Fatalf("delivery failure warning not logged yet: %s", logOut.String())
+		}
+	})
+
+	// The gauge tracks the number of pending retries.
+	var gauge float32
+	for _, intv := range sink.Data() {
+		intv.RLock()
+		for key, g := range intv.Gauges {
+			if strings.HasPrefix(key, "proxycfg.snapshot.pending_retries") {
+				gauge = g.Value
+			}
+		}
+		intv.RUnlock()
+	}
+	require.GreaterOrEqual(t, gauge, float32(failedDeliveryWarnThreshold))
+}
+
+func TestState_mergeWildcardUpstreamDefaults(t *testing.T) {
+	ns := structs.NodeService{
+		Kind:    structs.ServiceKindConnectProxy,
+		ID:      "web-sidecar-proxy",
+		Service: "web-sidecar-proxy",
+		Address: "10.0.1.1",
+		Port:    443,
+		Proxy: structs.ConnectProxyConfig{
+			DestinationServiceName: "web",
+			Upstreams: structs.Upstreams{
+				{
+					DestinationType: structs.UpstreamDestTypeService,
+					DestinationName: structs.WildcardSpecifier,
+					Config: map[string]interface{}{
+						"protocol":           "http",
+						"connect_timeout_ms": 2500,
+					},
+				},
+				{
+					DestinationType: structs.UpstreamDestTypeService,
+					DestinationName: "db",
+					LocalBindPort:   10001,
+					Config: map[string]interface{}{
+						"protocol": "grpc",
+					},
+				},
+			},
+		},
+	}
+
+	state, cn := newTestState(t, &ns, func(config *stateConfig) {
+		config.mergeUpstreamDefaults = true
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	_, err := state.handler.initialize(ctx)
+	require.NoError(t, err)
+
+	// The upstream's own protocol wins while the wildcard's timeout fills
+	// the gap.
+	_, req := cn.verifyWatch(t, "discovery-chain:db")
+	chainReq, ok := req.(*structs.DiscoveryChainRequest)
+	require.True(t, ok)
+	require.Equal(t, "grpc", chainReq.OverrideProtocol)
+	require.Equal(t, 2500*time.Millisecond, chainReq.OverrideConnectTimeout)
+}
+
+func TestState_wildcardDefaultsNotMergedWithoutFlag(t *testing.T) {
+	ns := structs.NodeService{
+		Kind:    structs.ServiceKindConnectProxy,
+		ID:      "web-sidecar-proxy",
+		Service: "web-sidecar-proxy",
+		Address: "10.0.1.1",
+		Port:    443,
+		Proxy: structs.ConnectProxyConfig{
+			DestinationServiceName: "web",
+			Upstreams: structs.Upstreams{
+				{
+					DestinationType: structs.UpstreamDestTypeService,
+					DestinationName: structs.WildcardSpecifier,
+					Config: map[string]interface{}{
+						"protocol": "http",
+					},
+				},
+				{
+					DestinationType: structs.UpstreamDestTypeService,
+					DestinationName: "db",
+					LocalBindPort:   10001,
+				},
+			},
+		},
+	}
+
+	state, cn := newTestState(t, &ns, nil)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	_, err := state.handler.initialize(ctx)
+	require.NoError(t, err)
+
+	_, req := cn.verifyWatch(t, "discovery-chain:db")
+	chainReq, ok := req.(*structs.DiscoveryChainRequest)
+	require.True(t, ok)
+	require.Empty(t, chainReq.OverrideProtocol)
+}
+
+func TestState_closeWithPendingRetryDoesNotLeak(t *testing.T) {
+	ns := structs.NodeService{
+		Kind:    structs.ServiceKindConnectProxy,
+		ID:      "web-sidecar-proxy",
+		Service: "web-sidecar-proxy",
+		Address: "10.0.1.1",
+		Port:    443,
+		Proxy: structs.ConnectProxyConfig{
+			DestinationServiceName: "web",
+		},
+	}
+
+	state, _ := newTestState(t, &ns, func(config *stateConfig) {
+		config.coalesceTimeout = time.Millisecond
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	state.cancel = cancel
+
+	snap, err := state.handler.initialize(ctx)
+	require.NoError(t, err)
+
+	go state.run(ctx, &snap)
+
+	roots, leaf := TestCerts(t)
+	for _, event := range []cache.UpdateEvent{
+		{CorrelationID: rootsWatchID, Result: roots},
+		{CorrelationID: leafWatchID, Result: leaf},
+		{CorrelationID: intentionsWatchID, Result: &structs.IndexedIntentionMatches{}},
+	} {
+		state.ch <- event
+	}
+
+	// Leave the first snapshot buffered in snapCh so the next delivery
+	// attempt fails against the full channel.
+	retry.Run(t, func(r *retry.R) {
+		if len(state.snapCh) == 0 {
+			r.Fatal("first snapshot not delivered yet")
+		}
+	})
+
+	// Fold in another update whose delivery fails and schedules a retry
+	// send on sendCh.
+	_, leaf2 := TestCerts(t)
+	state.ch <- cache.UpdateEvent{CorrelationID: leafWatchID, Result: leaf2}
+
+	// Let the coalesce and retry timers fire so the retry send is pending
+	// when the loop stops.
+	time.Sleep(20 * time.Millisecond)
+
+	cancel()
+
+	// run closes snapCh on the way out; draining it confirms the loop
+	// exited and releases the buffered snapshot.
+	for range state.snapCh {
+	}
+
+	// No goroutine may remain parked in run's timer callback trying to
+	// send on sendCh. Other tests leave unrelated goroutines behind, so
+	// scan stacks for the run closures specifically.
+	retry.Run(t, func(r *retry.R) {
+		buf := make([]byte, 1<<20)
+		n := runtime.Stack(buf, true)
+		if strings.Contains(string(buf[:n]), "proxycfg.(*state).run.func") {
+			r.Fatal("goroutine still blocked in a state.run timer callback after close")
+		}
+	})
+}
+
+func TestState_CurrentSnapshotView(t *testing.T) {
+	ns := structs.NodeService{
+		Kind:    structs.ServiceKindConnectProxy,
+		ID:      "web-sidecar-proxy",
+		Service: "web-sidecar-proxy",
+		Address: "10.0.1.1",
+		Port:    443,
+		Proxy: structs.ConnectProxyConfig{
+			DestinationServiceName: "web",
+		},
+	}
+
+	state, _ := newTestState(t, &ns, nil)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	state.cancel = cancel
+
+	snap, err := state.handler.initialize(ctx)
+	require.NoError(t, err)
+
+	go state.run(ctx, &snap)
+
+	// The view works before the snapshot is valid; the callback just sees
+	// the incomplete state.
+	var sawValid bool
+	state.CurrentSnapshotView(func(s *ConfigSnapshot) {
+		sawValid = s.Valid()
+	})
+	require.False(t, sawValid)
+
+	roots, leaf := TestCerts(t)
+	for _, event := range []cache.UpdateEvent{
+		{CorrelationID: rootsWatchID, Result: roots},
+		{CorrelationID: leafWatchID, Result: leaf},
+		{CorrelationID: intentionsWatchID, Result: &structs.IndexedIntentionMatches{}},
+	} {
+		state.ch <- event
+	}
+
+	select {
+	case <-state.snapCh:
+	case <-time.After(time.Second):
+		t.Fatal("timed out waiting for snapshot")
+	}
+
+	// Read the leaf serial through the view without paying for a clone.
+	var serial string
+	state.CurrentSnapshotView(func(s *ConfigSnapshot) {
+		serial = s.Leaf().SerialNumber
+	})
+	require.Equal(t, leaf.SerialNumber, serial)
+}
+
+func TestState_ingressListenerProtocolConflict(t *testing.T) {
+	ns := structs.NodeService{
+		Kind:    structs.ServiceKindIngressGateway,
+		ID:      "ingress-gateway",
+		Service: "ingress-gateway",
+		Address: "10.0.1.1",
+	}
+
+	state, _ := newTestState(t, &ns, nil)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	snap, err := state.handler.initialize(ctx)
+	require.NoError(t, err)
+
+	update := cache.UpdateEvent{
+		CorrelationID: gatewayServicesWatchID,
+		Result: &structs.IndexedGatewayServices{
+			Services: structs.GatewayServices{
+				{
+					Gateway:  structs.NewServiceName("ingress-gateway", nil),
+					Service:  structs.NewServiceName("api", nil),
+					Port:     9999,
+					Protocol: "http",
+				},
+				{
+					Gateway:  structs.NewServiceName("ingress-gateway", nil),
+					Service:  structs.NewServiceName("db", nil),
+					Port:     9999,
+					Protocol: "tcp",
+				},
+				{
+					Gateway:  structs.NewServiceName("ingress-gateway", nil),
+					Service:  structs.NewServiceName("web", nil),
+					Port:     8080,
+					Protocol: "http",
+				},
+			},
+		},
+	}
+
+	require.NoError(t, state.handler.handleUpdate(ctx, update, &snap))
+
+	httpKey := IngressListenerKey{Protocol: "http", Port: 9999}
+	tcpKey := IngressListenerKey{Protocol: "tcp", Port: 9999}
+	cleanKey := IngressListenerKey{Protocol: "http", Port: 8080}
+
+	require.Equal(t, "conflicting protocols for port 9999: http, tcp",
+		snap.IngressGateway.ListenerErrors[httpKey])
+	require.Equal(t, "conflicting protocols for port 9999: http, tcp",
+		snap.IngressGateway.ListenerErrors[tcpKey])
+	require.NotContains(t, snap.IngressGateway.ListenerErrors, cleanKey)
+
+	// A later update without the conflict clears the recorded errors.
+	update.Result = &structs.IndexedGatewayServices{
+		Services: structs.GatewayServices{
+			{
+				Gateway:  structs.NewServiceName("ingress-gateway", nil),
+				Service:  structs.NewServiceName("api", nil),
+				Port:     9999,
+				Protocol: "http",
+			},
+		},
+	}
+	require.NoError(t, state.handler.handleUpdate(ctx, update, &snap))
+	require.Empty(t, snap.IngressGateway.ListenerErrors)
+}
+
+func TestState_upstreamEndpointHealthSummary(t *testing.T) {
+	ns := structs.NodeService{
+		Kind:    structs.ServiceKindConnectProxy,
+		ID:      "web-sidecar-proxy",
+		Service: "web-sidecar-proxy",
+		Address: "10.0.1.1",
+		Port:    443,
+		Proxy: structs.ConnectProxyConfig{
+			DestinationServiceName: "web",
+			Upstreams: structs.Upstreams{
+				{
+					DestinationType: structs.UpstreamDestTypeService,
+					DestinationName: "db",
+					LocalBindPort:   10001,
+				},
+			},
+		},
+	}
+
+	state, _ := newTestState(t, &ns, nil)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	snap, err := state.handler.initialize(ctx)
+	require.NoError(t, err)
+
+	require.NoError(t, state.handler.handleUpdate(ctx, cache.UpdateEvent{
+		CorrelationID: "discovery-chain:db",
+		Result: &structs.DiscoveryChainResponse{
+			Chain: discoverychain.TestCompileConfigEntries(t, "db", "default", "dc1", "trustdomain.consul", "dc1", nil),
+		},
+	}, &snap))
+
+	deliver := func(nodes structs.CheckServiceNodes) {
+		require.NoError(t, state.handler.handleUpdate(ctx, cache.UpdateEvent{
+			CorrelationID: "upstream-target:db.default.dc1:db",
+			Result:        &structs.IndexedCheckServiceNodes{Nodes: nodes},
+		}, &snap))
+	}
+
+	// Nodes without failing checks all count as healthy.
+	healthy := TestUpstreamNodes(t)
+	deliver(healthy)
+	require.Equal(t, UpstreamHealthSummary{Healthy: len(healthy), Total: len(healthy)},
+		snap.ConnectProxy.UpstreamEndpointHealth["db"])
+
+	// The same endpoints going critical drop to zero healthy while the
+	// total is unchanged.
+	critical := TestUpstreamNodes(t)
+	for i := range critical {
+		critical[i].Checks = structs.HealthChecks{
+			{
+				Node:    critical[i].Node.Node,
+				CheckID: "service:db",
+				Status:  api.HealthCritical,
+			},
+		}
+	}
+	deliver(critical)
+	require.Equal(t, UpstreamHealthSummary{Healthy: 0, Total: len(critical)},
+		snap.ConnectProxy.UpstreamEndpointHealth["db"])
+}
+
+func TestState_meshGatewayEndpointTimestamps(t *testing.T) {
+	ns := structs.NodeService{
+		Kind:    structs.ServiceKindMeshGateway,
+		ID:      "mesh-gateway",
+		Service: "mesh-gateway",
+		Address: "10.0.1.1",
+		Port:    443,
+	}
+
+	state, _ := newTestState(t, &ns, nil)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	snap, err := state.handler.initialize(ctx)
+	require.NoError(t, err)
+	require.Empty(t, snap.MeshGateway.GatewayGroupLastUpdated)
+
+	deliver := func() {
+		require.NoError(t, state.handler.handleUpdate(ctx, cache.UpdateEvent{
+			CorrelationID: "mesh-gateway:dc2",
+			Result: &structs.IndexedNodesWithGateways{
+				Nodes: TestGatewayNodesDC2(t),
+			},
+		}, &snap))
+	}
+
+	deliver()
+	first := snap.MeshGateway.GatewayGroupLastUpdated["dc2"]
+	require.False(t, first.IsZero())
+	require.Contains(t, snap.MeshGateway.GatewayGroups, "dc2")
+
+	// A later successful update advances the timestamp.
+	time.Sleep(time.Millisecond)
+	deliver()
+	require.True(t, snap.MeshGateway.GatewayGroupLastUpdated["dc2"].After(first))
+}
+
+func TestState_correlationIDColonEscaping(t *testing.T) {
+	cases := []struct {
+		name   string
+		first  string
+		second string
+	}{
+		{"plain", "db.default.dc1", "db"},
+		{"colon in service name", "db:v1.default.dc1", "db:v1"},
+		{"colon in filter expression", "db.default.dc1", `db?filter=Service.Meta["a:b"] == "c"`},
+		{"backslashes", `weird\name`, `svc\:tricky`},
+		{"empty first component", "", "db"},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			id := makeColonID("upstream-target:", tc.first, tc.second)
+			require.True(t, strings.HasPrefix(id, "upstream-target:"))
+
+			first, second, ok := removeColonPrefix(strings.TrimPrefix(id, "upstream-target:"))
+			require.True(t, ok)
+			require.Equal(t, tc.first, first)
+			require.Equal(t, tc.second, second)
+		})
+	}
+
+	// IDs built before escaping existed parse the same way they always did.
+	first, second, ok := removeColonPrefix("db.default.dc1:db")
+	require.True(t, ok)
+	require.Equal(t, "db.default.dc1", first)
+	require.Equal(t, "db", second)
+
+	_, _, ok = removeColonPrefix("no-colon-here")
+	require.False(t, ok)
+}
+
+func TestState_initialSnapshotSeedsWatch(t *testing.T) {
+	ns := structs.NodeService{
+		Kind:    structs.ServiceKindConnectProxy,
+		ID:      "web-sidecar-proxy",
+		Service: "web-sidecar-proxy",
+		Address: "10.0.1.1",
+		Port:    443,
+		Proxy: structs.ConnectProxyConfig{
+			DestinationServiceName: "web",
+		},
+	}
+
+	seed := TestConfigSnapshot(t)
+	require.True(t, seed.Valid())
+
+	state, _ := newTestState(t, &ns, func(config *stateConfig) {
+		config.initialSnapshot = seed
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	state.cancel = cancel
+
+	snap, err := state.handler.initialize(ctx)
+	require.NoError(t, err)
+
+	go state.run(ctx, &snap)
+
+	// The seed arrives before any cache update has been handled.
+	select {
+	case got := <-state.snapCh:
+		require.True(t, got.Valid())
+		require.Equal(t, seed.ConnectProxy.Leaf, got.ConnectProxy.Leaf)
+	case <-time.After(time.Second):
+		t.Fatal("timed out waiting for the seeded snapshot")
+	}
+
+	// The watches stay live: once they deliver, the real snapshot replaces
+	// the seed as usual.
+	roots, leaf := TestCerts(t)
+	for _, event := range []cache.UpdateEvent{
+		{CorrelationID: rootsWatchID, Result: roots},
+		{CorrelationID: leafWatchID, Result: leaf},
+		{CorrelationID: intentionsWatchID, Result: &structs.IndexedIntentionMatches{}},
+	} {
+		state.ch <- event
+	}
+	select {
+	case got := <-state.snapCh:
+		require.Equal(t, leaf, got.ConnectProxy.Leaf)
+	case <-time.After(time.Second):
+		t.Fatal("timed out waiting for the live snapshot")
+	}
+}
+
+// failingCacheNotifier fails watch registration for one correlation ID and
+// delegates everything else, so tests can inject a mid-initialize error.
+type failingCacheNotifier struct {
+	*testCacheNotifier
+	failID string
+}
+
+func (cn failingCacheNotifier) Notify(ctx context.Context, t string, r cache.Request,
+	correlationID string, ch chan<- cache.UpdateEvent) error {
+	if correlationID == cn.failID {
+		return errors.New("injected notify failure")
+	}
+	return cn.testCacheNotifier.Notify(ctx, t, r, correlationID, ch)
+}
+
+func TestState_initializeFailureLeavesConsistentSnapshot(t *testing.T) {
+	cases := map[string]struct {
+		ns     structs.NodeService
+		failID string
+		verify func(t *testing.T, snap ConfigSnapshot)
+	}{
+		"terminating-gateway": {
+			ns: structs.NodeService{
+				Kind:    structs.ServiceKindTerminatingGateway,
+				ID:      "terminating-gateway",
+				Service: "terminating-gateway",
+			},
+			failID: gatewayServicesWatchID,
+			verify: func(t *testing.T, snap ConfigSnapshot) {
+				require.NotNil(t, snap.TerminatingGateway.WatchedServices)
+				require.NotNil(t, snap.TerminatingGateway.GatewayServices)
+				require.NotNil(t, snap.TerminatingGateway.ServiceLeaves)
+				require.NotNil(t, snap.TerminatingGateway.HostnameServices)
+			},
+		},
+		"mesh-gateway": {
+			ns: structs.NodeService{
+				Kind:    structs.ServiceKindMeshGateway,
+				ID:      "mesh-gateway",
+				Service: "mesh-gateway",
+			},
+			failID: serviceListWatchID,
+			verify: func(t *testing.T, snap ConfigSnapshot) {
+				require.NotNil(t, snap.MeshGateway.WatchedServices)
+				require.NotNil(t, snap.MeshGateway.WatchedDatacenters)
+				require.NotNil(t, snap.MeshGateway.GatewayGroups)
+				require.NotNil(t, snap.MeshGateway.HostnameDatacenters)
+			},
+		},
+		"ingress-gateway": {
+			ns: structs.NodeService{
+				Kind:    structs.ServiceKindIngressGateway,
+				ID:      "ingress-gateway",
+				Service: "ingress-gateway",
+			},
+			failID: gatewayConfigWatchID,
+			verify: func(t *testing.T, snap ConfigSnapshot) {
+				require.NotNil(t, snap.IngressGateway.WatchedDiscoveryChains)
+				require.NotNil(t, snap.IngressGateway.WatchedUpstreams)
+				require.NotNil(t, snap.IngressGateway.ListenerLeaves)
+				require.NotNil(t, snap.IngressGateway.WatchedListenerLeaves)
+			},
+		},
+	}
+
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			cn := failingCacheNotifier{
+				testCacheNotifier: newTestCacheNotifier(),
+				failID:            tc.failID,
+			}
+			state, err := newState(&tc.ns, "", stateConfig{
+				logger: testutil.Logger(t),
+				cache:  cn,
+				health: &health.Client{Cache: cn, CacheName: cachetype.HealthServicesName},
+				source: &structs.QuerySource{Datacenter: "dc1"},
+			})
+			require.NoError(t, err)
+
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			snap, err := state.handler.initialize(ctx)
+			require.Error(t, err)
+
+			// The failed initialize must still hand back a snapshot whose
+			// maps can be used without nil-map panics.
+			tc.verify(t, snap)
+		})
+	}
+}
+
+func TestState_passthroughUpstreamWeights(t *testing.T) {
+	ns := structs.NodeService{
+		Kind:    structs.ServiceKindConnectProxy,
+		ID:      "web-sidecar-proxy",
+		Service: "web-sidecar-proxy",
+		Address: "10.0.1.1",
+		Port:    443,
+		Proxy: structs.ConnectProxyConfig{
+			DestinationServiceName: "web",
+			Mode:                   structs.ProxyModeTransparent,
+		},
+	}
+
+	state, _ := newTestState(t, &ns, nil)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	snap, err := state.handler.initialize(ctx)
+	require.NoError(t, err)
+
+	roots, _ := TestCerts(t)
+	snap.Roots = roots
+
+	node := func(name, addr string, weights *structs.Weights) structs.CheckServiceNode {
+		return structs.CheckServiceNode{
+			Node: &structs.Node{Node: name, Address: addr, Datacenter: "dc1"},
+			Service: &structs.NodeService{
+				Kind:    structs.ServiceKindConnectProxy,
+				ID:      "api-sidecar-proxy",
+				Service: "api-sidecar-proxy",
+				Port:    8443,
+				Weights: weights,
+				Proxy: structs.ConnectProxyConfig{
+					DestinationServiceName: "api",
+					TransparentProxy:       structs.TransparentProxyConfig{DialedDirectly: true},
+				},
+			},
+		}
+	}
+
+	api := structs.NewServiceName("api", nil)
+
+	require.NoError(t, state.handler.handleUpdate(ctx, cache.UpdateEvent{
+		CorrelationID: "upstream-target:api.default.dc1:api",
+		Result: &structs.IndexedCheckServiceNodes{
+			Nodes: structs.CheckServiceNodes{
+				node("node1", "10.0.0.1", &structs.Weights{Passing: 5, Warning: 1}),
+				node("node2", "10.0.0.2", nil),
+			},
+		},
+	}, &snap))
+
+	// Instance weights are carried per address; instances without weights
+	// default to 1.
+	require.Equal(t, map[string]int{"10.0.0.1": 5, "10.0.0.2": 1},
+		snap.ConnectProxy.PassthroughUpstreams[api.String()].AddrWeights)
+
+	// Pruning an instance also drops its weight entry.
+	require.NoError(t, state.handler.handleUpdate(ctx, cache.UpdateEvent{
+		CorrelationID: "upstream-target:api.default.dc1:api",
+		Result: &structs.IndexedCheckServiceNodes{
+			Nodes: structs.CheckServiceNodes{
+				node("node2", "10.0.0.2", nil),
+			},
+		},
+	}, &snap))
+	require.Equal(t, map[string]int{"10.0.0.2": 1},
+		snap.ConnectProxy.PassthroughUpstreams[api.String()].AddrWeights)
+}
+
+// timestampingCacheNotifier records the time of every watch registration and
+// delegates, so tests can observe how registrations are spread out.
+type timestampingCacheNotifier struct {
+	*testCacheNotifier
+	mu    sync.Mutex
+	times []time.Time
+}
+
+func (cn *timestampingCacheNotifier) Notify(ctx context.Context, t string, r cache.Request,
+	correlationID string, ch chan<- cache.UpdateEvent) error {
+	cn.mu.Lock()
+	cn.times = append(cn.times, time.Now())
+	cn.mu.Unlock()
+	return cn.testCacheNotifier.Notify(ctx, t, r, correlationID, ch)
+}
+
+func TestState_watchRegistrationRateLimit(t *testing.T) {
+	upstreams := make(structs.Upstreams, 0, 100)
+	for i := 0; i < 100; i++ {
+		upstreams = append(upstreams, structs.Upstream{
+			DestinationType: structs.UpstreamDestTypeService,
+			DestinationName: fmt.Sprintf("api-%d", i),
+			LocalBindPort:   10000 + i,
+		})
+	}
+	ns := structs.NodeService{
+		Kind:    structs.ServiceKindConnectProxy,
+		ID:      "web-sidecar-proxy",
+		Service: "web-sidecar-proxy",
+		Address: "10.0.1.1",
+		Port:    443,
+		Proxy: structs.ConnectProxyConfig{
+			DestinationServiceName: "web",
+			Upstreams:              upstreams,
+		},
+	}
+
+	limit := 20
+	interval := 100 * time.Millisecond
+
+	cn := &timestampingCacheNotifier{testCacheNotifier: newTestCacheNotifier()}
+	state, err := newState(&ns, "", stateConfig{
+		logger:            testutil.Logger(t),
+		cache:             cn,
+		health:            &health.Client{Cache: cn.testCacheNotifier, CacheName: cachetype.HealthServicesName},
+		source:            &structs.QuerySource{Datacenter: "dc1"},
+		watchRateLimit:    limit,
+		watchRateInterval: interval,
+	})
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	_, err = state.handler.initialize(ctx)
+	require.NoError(t, err)
+
+	cn.mu.Lock()
+	times := cn.times
+	cn.mu.Unlock()
+
+	// The 100 upstream chain watches plus the base watches all pass through
+	// the limiter.
+	require.GreaterOrEqual(t, len(times), 100)
+
+	// With at most limit registrations started per interval, the
+	// registrations must have been spread over ceil(n/limit) windows, each
+	// a full interval apart. A little slack covers the gap between the
+	// limiter opening a window and the timestamp being recorded.
+	windows := (len(times) + limit - 1) / limit
+	minElapsed := time.Duration(windows-1)*interval - 10*time.Millisecond
+	elapsed := times[len(times)-1].Sub(times[0])
+	if elapsed < minElapsed {
+		t.Fatalf("%d registrations with limit %d per %v finished in %v, want at least %v",
+			len(times), limit, interval, elapsed, minElapsed)
+	}
+}
@@ -0,0 +1,95 @@
+// Package testsnap provides a chainable builder for constructing valid
+// proxycfg.ConfigSnapshots directly in consumer tests (e.g. the xDS server)
+// without driving the proxycfg handler machinery.
+package testsnap
+
+import (
+	"github.com/hashicorp/consul/agent/proxycfg"
+	"github.com/hashicorp/consul/agent/structs"
+)
+
+// ConnectProxyBuilder assembles a connect-proxy ConfigSnapshot field by
+// field. NewConnectProxy seeds the minimal registration data; the With
+// methods layer in the results that the real handler would have received
+// from its watches and Build returns the assembled snapshot.
+type ConnectProxyBuilder struct {
+	snap *proxycfg.ConfigSnapshot
+}
+
+// NewConnectProxy returns a builder for a connect-proxy snapshot fronting
+// the named destination service in dc1.
+func NewConnectProxy(service string) *ConnectProxyBuilder {
+	snap := &proxycfg.ConfigSnapshot{
+		Kind:       structs.ServiceKindConnectProxy,
+		Service:    service + "-sidecar-proxy",
+		ProxyID:    structs.NewServiceID(service+"-sidecar-proxy", nil),
+		Address:    "10.0.1.1",
+		Port:       20000,
+		Datacenter: "dc1",
+		Proxy: structs.ConnectProxyConfig{
+			DestinationServiceName: service,
+			DestinationServiceID:   service,
+		},
+	}
+	snap.ConnectProxy.DiscoveryChain = make(map[string]*structs.CompiledDiscoveryChain)
+	snap.ConnectProxy.WatchedUpstreamEndpoints = make(map[string]map[string]structs.CheckServiceNodes)
+	snap.ConnectProxy.WatchedGatewayEndpoints = make(map[string]map[string]structs.CheckServiceNodes)
+	snap.ConnectProxy.UpstreamConfig = make(map[string]*structs.Upstream)
+	snap.ConnectProxy.PassthroughUpstreams = make(map[string]proxycfg.ServicePassthroughAddrs)
+	snap.ConnectProxy.PreparedQueryEndpoints = make(map[string]structs.CheckServiceNodes)
+	snap.ConnectProxy.WatchedServiceChecks = make(map[structs.ServiceID][]structs.CheckType)
+	return &ConnectProxyBuilder{snap: snap}
+}
+
+// WithRoots sets the CA roots as if the roots watch had returned.
+func (b *ConnectProxyBuilder) WithRoots(roots *structs.IndexedCARoots) *ConnectProxyBuilder {
+	b.snap.Roots = roots
+	return b
+}
+
+// WithLeaf sets the proxy's leaf certificate as if the leaf watch had
+// returned.
+func (b *ConnectProxyBuilder) WithLeaf(leaf *structs.IssuedCert) *ConnectProxyBuilder {
+	b.snap.ConnectProxy.Leaf = leaf
+	return b
+}
+
+// WithIntentions records the intentions matching the destination service and
+// marks the intentions watch as having returned. Passing nil is a valid way
+// to simulate a watch that returned no matches.
+func (b *ConnectProxyBuilder) WithIntentions(ixns structs.Intentions) *ConnectProxyBuilder {
+	b.snap.ConnectProxy.Intentions = ixns
+	b.snap.ConnectProxy.IntentionsSet = true
+	return b
+}
+
+// WithUpstream records the configuration for an explicit upstream keyed by
+// its identifier.
+func (b *ConnectProxyBuilder) WithUpstream(u *structs.Upstream) *ConnectProxyBuilder {
+	b.snap.ConnectProxy.UpstreamConfig[u.Identifier()] = u
+	return b
+}
+
+// WithDiscoveryChain stores the compiled discovery chain for the given
+// upstream identifier.
+func (b *ConnectProxyBuilder) WithDiscoveryChain(id string, chain *structs.CompiledDiscoveryChain) *ConnectProxyBuilder {
+	b.snap.ConnectProxy.DiscoveryChain[id] = chain
+	return b
+}
+
+// WithUpstreamEndpoints stores the endpoints of a chain target for the given
+// upstream identifier.
+func (b *ConnectProxyBuilder) WithUpstreamEndpoints(id, targetID string, nodes structs.CheckServiceNodes) *ConnectProxyBuilder {
+	eps, ok := b.snap.ConnectProxy.WatchedUpstreamEndpoints[id]
+	if !ok {
+		eps = make(map[string]structs.CheckServiceNodes)
+		b.snap.ConnectProxy.WatchedUpstreamEndpoints[id] = eps
+	}
+	eps[targetID] = nodes
+	return b
+}
+
+// Build returns the assembled snapshot.
+func (b *ConnectProxyBuilder) Build() *proxycfg.ConfigSnapshot {
+	return b.snap
+}
@@ -0,0 +1,44 @@
+package testsnap
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/hashicorp/consul/agent/consul/discoverychain"
+	"github.com/hashicorp/consul/agent/proxycfg"
+	"github.com/hashicorp/consul/agent/structs"
+)
+
+func TestNewConnectProxy(t *testing.T) {
+	roots, leaf := proxycfg.TestCerts(t)
+	chain := discoverychain.TestCompileConfigEntries(t, "db", "default", "dc1", "trustdomain.consul", "dc1", nil)
+	nodes := proxycfg.TestUpstreamNodes(t)
+
+	snap := NewConnectProxy("web").
+		WithRoots(roots).
+		WithLeaf(leaf).
+		WithIntentions(nil).
+		WithUpstream(&structs.Upstream{
+			DestinationType: structs.UpstreamDestTypeService,
+			DestinationName: "db",
+			LocalBindPort:   10001,
+		}).
+		WithDiscoveryChain("db", chain).
+		WithUpstreamEndpoints("db", "db.default.dc1", nodes).
+		Build()
+
+	require.True(t, snap.Valid())
+	require.Equal(t, structs.ServiceKindConnectProxy, snap.Kind)
+	require.Equal(t, "web-sidecar-proxy", snap.Service)
+	require.Equal(t, "web", snap.Proxy.DestinationServiceName)
+	require.Equal(t, roots, snap.Roots)
+	require.Equal(t, leaf, snap.ConnectProxy.Leaf)
+	require.True(t, snap.ConnectProxy.IntentionsSet)
+	require.Contains(t, snap.ConnectProxy.UpstreamConfig, "db")
+	require.Equal(t, chain, snap.ConnectProxy.DiscoveryChain["db"])
+	require.Equal(t, nodes, snap.ConnectProxy.WatchedUpstreamEndpoints["db"]["db.default.dc1"])
+
+	// a snapshot without all mandatory watch results is not valid
+	require.False(t, NewConnectProxy("web").WithRoots(roots).WithLeaf(leaf).Build().Valid())
+}
@@ -22,6 +22,7 @@ import (
 	"github.com/hashicorp/consul/agent/grpc/resolver"
 	"github.com/hashicorp/consul/agent/local"
 	"github.com/hashicorp/consul/agent/pool"
+	"github.com/hashicorp/consul/agent/proxycfg"
 	"github.com/hashicorp/consul/agent/router"
 	"github.com/hashicorp/consul/agent/submatview"
 	"github.com/hashicorp/consul/agent/token"
@@ -239,6 +240,7 @@ func getPrometheusDefs(cfg lib.TelemetryConfig) ([]prometheus.GaugeDefinition, [
 		consul.RPCCounters,
 		grpc.StatsCounters,
 		local.StateCounters,
+		proxycfg.StateCounters,
 		raftCounters,
 	}
 	// Flatten definitions
@@ -293,6 +295,7 @@ func getPrometheusDefs(cfg lib.TelemetryConfig) ([]prometheus.GaugeDefinition, [
 		consul.TxnSummaries,
 		fsm.CommandsSummaries,
 		fsm.SnapshotSummaries,
+		proxycfg.StateSummaries,
 		raftSummaries,
 	}
 	// Flatten definitions
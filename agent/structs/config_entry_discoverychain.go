@@ -1354,6 +1354,14 @@ type DiscoveryChainRequest struct {
 	// overridden for any resolver in the compiled chain.
 	OverrideConnectTimeout time.Duration
 
+	// OverrideLimits allows for the upstream's connection limits to be
+	// overridden for any resolver in the compiled chain.
+	OverrideLimits *UpstreamLimits
+
+	// OverridePassiveHealthCheck allows for the upstream's passive health
+	// check settings to be overridden for any resolver in the compiled chain.
+	OverridePassiveHealthCheck *PassiveHealthCheck
+
 	Datacenter string // where to route the RPC
 	QueryOptions
 }
@@ -1373,21 +1381,25 @@ func (r *DiscoveryChainRequest) CacheInfo() cache.RequestInfo {
 	}
 
 	v, err := hashstructure.Hash(struct {
-		Name                   string
-		EvaluateInDatacenter   string
-		EvaluateInNamespace    string
-		OverrideMeshGateway    MeshGatewayConfig
-		OverrideProtocol       string
-		OverrideConnectTimeout time.Duration
-		Filter                 string
+		Name                       string
+		EvaluateInDatacenter       string
+		EvaluateInNamespace        string
+		OverrideMeshGateway        MeshGatewayConfig
+		OverrideProtocol           string
+		OverrideConnectTimeout     time.Duration
+		OverrideLimits             *UpstreamLimits
+		OverridePassiveHealthCheck *PassiveHealthCheck
+		Filter                     string
 	}{
-		Name:                   r.Name,
-		EvaluateInDatacenter:   r.EvaluateInDatacenter,
-		EvaluateInNamespace:    r.EvaluateInNamespace,
-		OverrideMeshGateway:    r.OverrideMeshGateway,
-		OverrideProtocol:       r.OverrideProtocol,
-		OverrideConnectTimeout: r.OverrideConnectTimeout,
-		Filter:                 r.QueryOptions.Filter,
+		Name:                       r.Name,
+		EvaluateInDatacenter:       r.EvaluateInDatacenter,
+		EvaluateInNamespace:        r.EvaluateInNamespace,
+		OverrideMeshGateway:        r.OverrideMeshGateway,
+		OverrideProtocol:           r.OverrideProtocol,
+		OverrideConnectTimeout:     r.OverrideConnectTimeout,
+		OverrideLimits:             r.OverrideLimits,
+		OverridePassiveHealthCheck: r.OverridePassiveHealthCheck,
+		Filter:                     r.QueryOptions.Filter,
 	}, nil)
 	if err == nil {
 		// If there is an error, we don't set the key. A blank key forces
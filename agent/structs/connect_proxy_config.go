@@ -345,6 +345,12 @@ type Upstream struct {
 	DestinationNamespace string `json:",omitempty" alias:"destination_namespace"`
 	DestinationName      string `alias:"destination_name"`
 
+	// DestinationPeer is the name of the cluster peering the destination
+	// service was imported from. If set, discovery happens against the
+	// imported instances rather than the local catalog and no discovery
+	// chain is compiled.
+	DestinationPeer string `json:",omitempty" alias:"destination_peer"`
+
 	// Datacenter that the service discovery request should be run against. Note
 	// for prepared queries, the actual results might be from a different
 	// datacenter.
@@ -387,6 +393,7 @@ func (t *Upstream) UnmarshalJSON(data []byte) (err error) {
 		DestinationTypeSnake      string `json:"destination_type"`
 		DestinationNamespaceSnake string `json:"destination_namespace"`
 		DestinationNameSnake      string `json:"destination_name"`
+		DestinationPeerSnake      string `json:"destination_peer"`
 
 		LocalBindAddressSnake string `json:"local_bind_address"`
 		LocalBindPortSnake    int    `json:"local_bind_port"`
@@ -412,6 +419,9 @@ func (t *Upstream) UnmarshalJSON(data []byte) (err error) {
 	if t.DestinationName == "" {
 		t.DestinationName = aux.DestinationNameSnake
 	}
+	if t.DestinationPeer == "" {
+		t.DestinationPeer = aux.DestinationPeerSnake
+	}
 	if t.LocalBindAddress == "" {
 		t.LocalBindAddress = aux.LocalBindAddressSnake
 	}
@@ -446,6 +456,9 @@ func (u *Upstream) Validate() error {
 	if u.DestinationName == WildcardSpecifier && !u.CentrallyConfigured {
 		return fmt.Errorf("upstream destination name cannot be a wildcard")
 	}
+	if u.DestinationPeer != "" && u.DestinationType == UpstreamDestTypePreparedQuery {
+		return fmt.Errorf("upstream destination type cannot be %q for peered upstreams", UpstreamDestTypePreparedQuery)
+	}
 
 	if u.LocalBindPort == 0 && u.LocalBindSocketPath == "" && !u.CentrallyConfigured {
 		return fmt.Errorf("upstream local bind port or local socket path must be defined and nonzero")
@@ -466,6 +479,7 @@ func (u *Upstream) ToAPI() api.Upstream {
 		DestinationType:      api.UpstreamDestType(u.DestinationType),
 		DestinationNamespace: u.DestinationNamespace,
 		DestinationName:      u.DestinationName,
+		DestinationPeer:      u.DestinationPeer,
 		Datacenter:           u.Datacenter,
 		LocalBindAddress:     u.LocalBindAddress,
 		LocalBindPort:        u.LocalBindPort,
@@ -487,6 +501,7 @@ func (u *Upstream) ToKey() UpstreamKey {
 		DestinationType:      u.DestinationType,
 		DestinationNamespace: u.DestinationNamespace,
 		DestinationName:      u.DestinationName,
+		DestinationPeer:      u.DestinationPeer,
 		Datacenter:           u.Datacenter,
 	}
 }
@@ -515,15 +530,17 @@ type UpstreamKey struct {
 	DestinationType      string
 	DestinationName      string
 	DestinationNamespace string
+	DestinationPeer      string
 	Datacenter           string
 }
 
 func (k UpstreamKey) String() string {
 	return fmt.Sprintf(
-		"[type=%q, name=%q, namespace=%q, datacenter=%q]",
+		"[type=%q, name=%q, namespace=%q, peer=%q, datacenter=%q]",
 		k.DestinationType,
 		k.DestinationName,
 		k.DestinationNamespace,
+		k.DestinationPeer,
 		k.Datacenter,
 	)
 }
@@ -539,6 +556,7 @@ func UpstreamFromAPI(u api.Upstream) Upstream {
 		DestinationType:      string(u.DestinationType),
 		DestinationNamespace: u.DestinationNamespace,
 		DestinationName:      u.DestinationName,
+		DestinationPeer:      u.DestinationPeer,
 		Datacenter:           u.Datacenter,
 		LocalBindAddress:     u.LocalBindAddress,
 		LocalBindPort:        u.LocalBindPort,
@@ -24,6 +24,9 @@ func (us *Upstream) Identifier() string {
 	if us.Datacenter != "" {
 		name += "?dc=" + us.Datacenter
 	}
+	if us.DestinationPeer != "" {
+		name += "?peer=" + us.DestinationPeer
+	}
 
 	// Service is default type so never prefix it. This is more readable and long
 	// term it is the only type that matters so we can drop the prefix and have
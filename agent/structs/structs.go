@@ -598,6 +598,10 @@ type ServiceSpecificRequest struct {
 	// Ingress if true will only search for Ingress gateways for the given service.
 	Ingress bool
 
+	// PeerName, if non-empty, scopes the query to instances of the service
+	// imported from the named cluster peering instead of the local catalog.
+	PeerName string
+
 	EnterpriseMeta `hcl:",squash" mapstructure:",squash"`
 	QueryOptions
 }
@@ -643,6 +647,7 @@ func (r *ServiceSpecificRequest) CacheInfo() cache.RequestInfo {
 		r.EnterpriseMeta,
 		r.Ingress,
 		r.ServiceKind,
+		r.PeerName,
 	}, nil)
 	if err == nil {
 		// If there is an error, we don't set the key. A blank key forces